@@ -36,9 +36,7 @@ func bindListener(bindAddress string, log *logger.Logger) (listener net.Listener
 			log.Print("Signal: ", sig)
 			log.Print("Removing API socket")
 			os.Remove(bindAddress)
-			// Restore default handler and re-raise so context-based shutdown can proceed normally
-			signal.Reset(syscall.SIGINT, syscall.SIGTERM)
-			syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+			// Shutdown itself is handled by main (which saves the cache file)
 		}()
 
 	} else {
@@ -7,7 +7,9 @@ import (
 
 	"github.com/miekg/dns"
 	"github.com/paulc/dinosaur-dns/blocklist"
+	"github.com/paulc/dinosaur-dns/cache"
 	"github.com/paulc/dinosaur-dns/config"
+	"github.com/paulc/dinosaur-dns/resolver"
 )
 
 type ApiService struct {
@@ -24,7 +26,29 @@ func NewApiService(c *config.ProxyConfig) *ApiService {
 type Empty struct{}
 
 func (s *ApiService) Config(r *http.Request, req *Empty, res *config.UserConfig) error {
-	*res = *s.config.UserConfig
+	*res = s.config.UserConfig.Redacted()
+	return nil
+}
+
+// Upstream health
+
+type UpstreamHealthRes struct {
+	Upstreams []resolver.HealthStatus `json:"upstreams"`
+}
+
+func (s *ApiService) UpstreamHealth(r *http.Request, req *Empty, res *UpstreamHealthRes) error {
+	res.Upstreams = s.config.Health.Status(s.config.AllUpstreams())
+	return nil
+}
+
+type UpstreamMetricsRes struct {
+	Upstreams []resolver.UpstreamMetrics `json:"upstreams"`
+	Coalesced resolver.CoalescerStats    `json:"coalesced"`
+}
+
+func (s *ApiService) UpstreamMetrics(r *http.Request, req *Empty, res *UpstreamMetricsRes) error {
+	res.Upstreams = s.config.Metrics.Status(s.config.AllUpstreams())
+	res.Coalesced = s.config.Coalescer.Stats()
 	return nil
 }
 
@@ -71,6 +95,11 @@ func (s *ApiService) CacheDebug(r *http.Request, req *Empty, res *CacheDebugRes)
 	return nil
 }
 
+func (s *ApiService) CacheStats(r *http.Request, req *Empty, res *cache.CacheStats) error {
+	*res = s.config.Cache.Stats()
+	return nil
+}
+
 // Manage Blocklist
 
 type BlockListCountRes struct {
@@ -177,7 +206,7 @@ type MergedConfigRes struct {
 
 func (s *ApiService) GetMergedConfig(r *http.Request, req *Empty, res *MergedConfigRes) error {
 	cl := s.changelog.snapshot()
-	uc := *s.config.UserConfig
+	uc := s.config.UserConfig.Redacted()
 
 	// Remove block-deletes from the direct block list where present.
 	// Track which ones were found there vs which came from blocklist files.
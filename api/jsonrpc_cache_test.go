@@ -1,8 +1,11 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 	"testing"
+
+	"github.com/paulc/dinosaur-dns/cache"
 )
 
 func TestAPICacheAdd(t *testing.T) {
@@ -198,3 +201,24 @@ func TestAPICacheDebug(t *testing.T) {
 		t.Errorf("Wrong number of entries: %s", debug_res.Entries)
 	}
 }
+
+func TestAPICacheStats(t *testing.T) {
+
+	api, c := setupApiService(t)
+	r := &http.Request{}
+
+	c.Cache.MaxEntries = 2
+	for i := 0; i < 3; i++ {
+		if err := c.Cache.AddRRString(fmt.Sprintf("%d.abc.com. 60 IN A 1.2.3.4", i), false, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res := &cache.CacheStats{}
+	if err := api.CacheStats(r, &Empty{}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Entries != 2 || res.MaxEntries != 2 || res.Evictions != 1 || res.Bytes == 0 {
+		t.Errorf("Unexpected stats: %+v", res)
+	}
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestAPIUpstreamHealth(t *testing.T) {
+
+	api, c := setupApiService(t)
+	r := &http.Request{}
+
+	res := &UpstreamHealthRes{}
+	if err := api.UpstreamHealth(r, &Empty{}, res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Upstreams) != 1 || res.Upstreams[0].Upstream != "1.1.1.1:53" || res.Upstreams[0].State != "closed" {
+		t.Fatalf("Unexpected health status: %+v", res.Upstreams)
+	}
+
+	// Open circuit
+	for i := 0; i < c.Health.Failures; i++ {
+		c.Health.Report(c.Log, c.Upstream[0], errors.New("timeout"))
+	}
+
+	if err := api.UpstreamHealth(r, &Empty{}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Upstreams[0].State != "open" || res.Upstreams[0].LastError != "timeout" {
+		t.Errorf("Unexpected health status: %+v", res.Upstreams)
+	}
+}
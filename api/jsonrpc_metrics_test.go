@@ -0,0 +1,37 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestAPIUpstreamMetrics(t *testing.T) {
+
+	api, c := setupApiService(t)
+	r := &http.Request{}
+
+	out := new(dns.Msg)
+	c.Metrics.Report(c.Upstream[0], 3*time.Millisecond, out, nil, false)
+	c.Metrics.Report(c.Upstream[0], 0, nil, context.DeadlineExceeded, true)
+	c.Metrics.Report(c.Upstream[0], 0, nil, errors.New("refused"), false)
+
+	res := &UpstreamMetricsRes{}
+	if err := api.UpstreamMetrics(r, &Empty{}, res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Upstreams) != 1 {
+		t.Fatalf("Unexpected metrics: %+v", res.Upstreams)
+	}
+	m := res.Upstreams[0]
+	if m.Upstream != "1.1.1.1:53" || m.Queries != 3 || m.Successes != 1 || m.Timeouts != 1 || m.Errors != 1 || m.Rcodes["NOERROR"] != 1 {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+	if res.Coalesced.Queries != 0 || res.Coalesced.Coalesced != 0 {
+		t.Errorf("Unexpected coalescer stats: %+v", res.Coalesced)
+	}
+}
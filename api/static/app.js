@@ -201,6 +201,7 @@ function buildFilter() {
         { id: 'f-qtype',  test: (item, re) => re.test(item.qtype ?? '') },
         { id: 'f-rcode',  test: (item, re) => re.test(RCODES[item.rcode] ?? String(item.rcode)) },
         { id: 'f-status', test: (item, re) => re.test(formatStatus(item)) },
+        { id: 'f-upstream', test: (item, re) => re.test(item.upstream ?? '') },
     ];
     const fns = [];
     for (const { id, test } of defs) {
@@ -262,6 +263,7 @@ function renderLog() {
         tr.insertCell().textContent = item.qtype ?? '';
         tr.insertCell().textContent = RCODES[item.rcode] ?? item.rcode ?? '';
         tr.insertCell().textContent = status;
+        tr.insertCell().textContent = item.upstream ?? '';
         tr.insertCell().textContent = item.querytime ? (item.querytime * 1000).toFixed(1) : '';
     }
     const totalMatching = logFilter ? logBuf.countFiltered(logFilter, anchor) : logBuf.calculateAvailable(anchor);
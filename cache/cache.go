@@ -2,6 +2,7 @@ package cache
 
 import (
 	"fmt"
+	"net"
 	"sync"
 	"time"
 
@@ -11,20 +12,56 @@ import (
 // For testing
 var timeNow = time.Now
 
+// DNSCacheKey identifies a cached response. Subnet is the ECS client subnet
+// for answers the upstream scoped to the querying subnet (empty for answers
+// valid for all clients).
 type DNSCacheKey struct {
-	Name  string
-	Qtype uint16
+	Name   string
+	Qtype  uint16
+	Subnet string
 }
 
 func (k DNSCacheKey) String() string {
+	if k.Subnet != "" {
+		return fmt.Sprintf("<%s %s %s>", k.Name, dns.TypeToString[k.Qtype], k.Subnet)
+	}
 	return fmt.Sprintf("<%s %s>", k.Name, dns.TypeToString[k.Qtype])
 }
 
+// ecsSubnet returns the client subnet of the EDNS Client Subnet option in msg
+// (the address truncated to the source prefix length) and the scope prefix
+// length.
+func ecsSubnet(msg *dns.Msg) (subnet string, scope uint8, ok bool) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return "", 0, false
+	}
+	for _, o := range opt.Option {
+		if e, isEcs := o.(*dns.EDNS0_SUBNET); isEcs {
+			bits := 32
+			if e.Family == 2 {
+				bits = 128
+			}
+			ip := e.Address.Mask(net.CIDRMask(int(e.SourceNetmask), bits))
+			if ip == nil {
+				return "", 0, false
+			}
+			return fmt.Sprintf("%s/%d", ip, e.SourceNetmask), e.SourceScope, true
+		}
+	}
+	return "", 0, false
+}
+
 type DNSCacheItem struct {
 	Message   *dns.Msg
 	Inserted  time.Time
 	Expires   time.Time
 	Permanent bool
+	Size      int       // approximate memory used (see entrySize)
+	Used      time.Time // last returned by Get (or inserted)
+	Hits      int       // times returned by Get
+	Stale     time.Time // last failed (or refresh) upstream attempt once expired
+	Prefetch  bool      // prefetch requested by GetPrefetch
 }
 
 func (i DNSCacheItem) String() string {
@@ -40,13 +77,168 @@ func (i DNSCacheItem) String() string {
 	}
 }
 
+// Eviction policies
+const (
+	EvictLRU = "lru" // least recently used
+	EvictLFU = "lfu" // least frequently used
+)
+
+const (
+	// evictSample is the number of entries compared to choose each eviction
+	evictSample = 16
+
+	// Approximate memory overheads (beyond the wire size of the message) of
+	// a cache entry and of each parsed RR
+	entryOverhead = 256
+	rrOverhead    = 64
+
+	// StaleTTL is the TTL of stale answers (RFC 8767 4)
+	StaleTTL = 30
+
+	// StaleRecheck is the minimum interval between upstream refreshes of an
+	// answer being served stale (RFC 8767 5 failure recheck timer)
+	StaleRecheck = 30 * time.Second
+
+	// DefaultNegativeMaxTTL bounds the time negative answers are cached
+	// (RFC 2308 5 suggests 1-3 hours)
+	DefaultNegativeMaxTTL = 3 * time.Hour
+
+	// Prefetch defaults - entries returned DefaultPrefetchHits times are
+	// prefetched, at most DefaultPrefetchRate per second
+	DefaultPrefetchHits = 3
+	DefaultPrefetchRate = 10
+)
+
+// DNSCache holds upstream responses until they expire and permanent local
+// records. With MaxEntries or MaxBytes set, non-permanent entries are evicted
+// when the cache grows past either limit: expired entries first, then the
+// least recently (EvictLRU) or frequently (EvictLFU) used. Eviction compares a
+// random sample of entries rather than keeping them ordered, so it is an
+// approximation for large caches.
+//
+// With StaleWindow set, expired entries are kept for that long so that
+// GetStale can answer from them when the upstreams fail (RFC 8767).
+//
+// With Prefetch set, GetPrefetch asks for popular entries (returned at least
+// PrefetchHits times) to be refreshed once they are in the last Prefetch
+// fraction of their TTL, at most PrefetchRate per second.
 type DNSCache struct {
 	sync.RWMutex
-	Cache map[DNSCacheKey]DNSCacheItem
+	Cache          map[DNSCacheKey]DNSCacheItem
+	MaxEntries     int           // maximum number of entries (0 = unlimited)
+	MaxBytes       int           // approximate memory budget (0 = unlimited)
+	Eviction       string        // EvictLRU or EvictLFU
+	StaleWindow    time.Duration // time expired entries are kept (0 = not kept)
+	NegativeMaxTTL time.Duration // maximum time negative answers are cached (0 = not cached)
+	Prefetch       float64       // fraction of the TTL in which to prefetch (0 = disabled)
+	PrefetchHits   int           // hits before an entry is prefetched
+	PrefetchRate   int           // maximum prefetches per second
+	bytes          int
+	evictions      uint64
+	prefetches     uint64
+	limited        uint64    // prefetches skipped by the rate limit
+	rateStart      time.Time // start of the current rate limit second
+	rateCount      int       // prefetches in the current rate limit second
+}
+
+// CacheStats are the cache counters reported by the API.
+type CacheStats struct {
+	Entries           int    `json:"entries"`
+	Bytes             int    `json:"bytes"`              // approximate memory used
+	MaxEntries        int    `json:"max_entries"`        // 0 = unlimited
+	MaxBytes          int    `json:"max_bytes"`          // 0 = unlimited
+	Evictions         uint64 `json:"evictions"`          // entries evicted to stay within the limits
+	Prefetches        uint64 `json:"prefetches"`         // prefetches requested
+	PrefetchesLimited uint64 `json:"prefetches_limited"` // prefetches skipped by the rate limit
 }
 
 func New() *DNSCache {
-	return &DNSCache{Cache: make(map[DNSCacheKey]DNSCacheItem)}
+	return &DNSCache{
+		Cache:          make(map[DNSCacheKey]DNSCacheItem),
+		Eviction:       EvictLRU,
+		NegativeMaxTTL: DefaultNegativeMaxTTL,
+		PrefetchHits:   DefaultPrefetchHits,
+		PrefetchRate:   DefaultPrefetchRate,
+	}
+}
+
+// entrySize estimates the memory used by a cache entry for msg.
+func entrySize(key DNSCacheKey, msg *dns.Msg) int {
+	return entryOverhead + len(key.Name) + len(key.Subnet) + msg.Len() +
+		rrOverhead*(len(msg.Answer)+len(msg.Ns)+len(msg.Extra))
+}
+
+// set stores an entry, first evicting others to make room if the cache would
+// go over its limits. Caller holds lock.
+func (c *DNSCache) set(key DNSCacheKey, item DNSCacheItem) {
+	c.remove(key)
+	item.Size = entrySize(key, item.Message)
+	item.Used = item.Inserted
+	c.evict(item.Size)
+	c.Cache[key] = item
+	c.bytes += item.Size
+}
+
+// remove deletes an entry. Caller holds lock.
+func (c *DNSCache) remove(key DNSCacheKey) {
+	if item, found := c.Cache[key]; found {
+		c.bytes -= item.Size
+		delete(c.Cache, key)
+	}
+}
+
+// full reports whether there is no room for another entry of size bytes.
+func (c *DNSCache) full(size int) bool {
+	return (c.MaxEntries > 0 && len(c.Cache) >= c.MaxEntries) || (c.MaxBytes > 0 && c.bytes+size > c.MaxBytes)
+}
+
+// evict removes non-permanent entries until there is room for another entry
+// of size bytes. Each victim is the worst of a sample of evictSample entries.
+// Caller holds lock.
+func (c *DNSCache) evict(size int) {
+	now := timeNow()
+	for c.full(size) {
+		var victim DNSCacheKey
+		var worst DNSCacheItem
+		found := false
+		n := 0
+		for k, v := range c.Cache {
+			if v.Permanent {
+				continue
+			}
+			if !found || c.worse(v, worst, now) {
+				victim, worst, found = k, v, true
+			}
+			if n++; n == evictSample {
+				break
+			}
+		}
+		if !found {
+			// Only permanent entries
+			return
+		}
+		c.remove(victim)
+		c.evictions++
+	}
+}
+
+// worse reports whether a should be evicted before b.
+func (c *DNSCache) worse(a, b DNSCacheItem, now time.Time) bool {
+	if expired := now.After(a.Expires); expired != now.After(b.Expires) {
+		return expired
+	}
+	if c.Eviction == EvictLFU && a.Hits != b.Hits {
+		return a.Hits < b.Hits
+	}
+	return a.Used.Before(b.Used)
+}
+
+// Stats returns the cache counters.
+func (c *DNSCache) Stats() CacheStats {
+	c.RLock()
+	defer c.RUnlock()
+	return CacheStats{Entries: len(c.Cache), Bytes: c.bytes, MaxEntries: c.MaxEntries, MaxBytes: c.MaxBytes,
+		Evictions: c.evictions, Prefetches: c.prefetches, PrefetchesLimited: c.limited}
 }
 
 func (c *DNSCache) AddRR(rr dns.RR, permanent bool) error {
@@ -75,7 +267,7 @@ func (c *DNSCache) AddRR(rr dns.RR, permanent bool) error {
 	c.Lock()
 	defer c.Unlock()
 
-	c.Cache[key] = val
+	c.set(key, val)
 
 	return nil
 }
@@ -106,11 +298,21 @@ func (c *DNSCache) AddRRString(entry string, permanent bool, ptr bool) error {
 
 func (c *DNSCache) Add(msg *dns.Msg) {
 
-	if (msg.Rcode != dns.RcodeSuccess) || (msg.Truncated == true) || (len(msg.Answer)+len(msg.Ns)+len(msg.Extra) == 0) {
+	if (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) || (msg.Truncated == true) || (len(msg.Answer)+len(msg.Ns)+len(msg.Extra) == 0) {
 		// Error or No RRs
 		return
 	}
 
+	// Negative answers (NXDOMAIN or NODATA) are only cached with an SOA
+	// record in the authority section (RFC 2308 5)
+	negative := msg.Rcode == dns.RcodeNameError || len(msg.Answer) == 0
+	var soa *dns.SOA
+	if negative {
+		if soa = findSOA(msg.Ns); soa == nil || c.NegativeMaxTTL <= 0 {
+			return
+		}
+	}
+
 	// Get minium TTL from RRs
 	minTTL := uint32(86400) // Max cache age
 	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
@@ -123,6 +325,14 @@ func (c *DNSCache) Add(msg *dns.Msg) {
 		}
 	}
 
+	// The negative TTL is the lower of the SOA TTL and MINIMUM (RFC 2308 3),
+	// bounded by NegativeMaxTTL. The SOA is returned with this TTL.
+	msg = msg.Copy()
+	if negative {
+		minTTL = min(minTTL, soa.Minttl, uint32(c.NegativeMaxTTL/time.Second))
+		findSOA(msg.Ns).Hdr.Ttl = minTTL
+	}
+
 	if minTTL == 0 {
 		return
 	}
@@ -131,34 +341,67 @@ func (c *DNSCache) Add(msg *dns.Msg) {
 	now := timeNow()
 	expires := now.Add(time.Second * time.Duration(minTTL))
 
+	// Answers scoped to the client subnet (ECS scope > 0) are only reused for
+	// the same subnet; answers without ECS or with scope 0 apply to all
 	key := DNSCacheKey{Name: dns.CanonicalName(msg.Question[0].Name), Qtype: msg.Question[0].Qtype}
-	val := DNSCacheItem{Message: msg.Copy(), Inserted: now, Expires: expires, Permanent: false}
+	if subnet, scope, ok := ecsSubnet(msg); ok && scope > 0 {
+		key.Subnet = subnet
+	}
+	val := DNSCacheItem{Message: msg, Inserted: now, Expires: expires, Permanent: false}
 
 	c.Lock()
 	defer c.Unlock()
 
-	c.Cache[key] = val
+	c.set(key, val)
 }
 
 func (c *DNSCache) Get(query *dns.Msg) (*dns.Msg, bool) {
+	reply, found, _ := c.GetPrefetch(query)
+	return reply, found
+}
+
+// GetPrefetch is Get, also reporting whether the caller should refresh the
+// entry from upstream in the background (see DNSCache). Each entry is only
+// prefetched once; the refreshed answer replaces it.
+func (c *DNSCache) GetPrefetch(query *dns.Msg) (reply *dns.Msg, found bool, prefetch bool) {
 
 	c.Lock()
 	defer c.Unlock()
 
-	key := DNSCacheKey{Name: dns.CanonicalName(query.Question[0].Name), Qtype: query.Question[0].Qtype}
-
-	entry, found := c.Cache[key]
-	if !found {
-		return nil, false
+	// Try the answer for the client subnet (if the query has ECS) before
+	// the answer for all clients
+	keys := []DNSCacheKey{{Name: dns.CanonicalName(query.Question[0].Name), Qtype: query.Question[0].Qtype}}
+	if subnet, _, ok := ecsSubnet(query); ok {
+		keys = append([]DNSCacheKey{{Name: keys[0].Name, Qtype: keys[0].Qtype, Subnet: subnet}}, keys...)
 	}
 
-	if !entry.Permanent && timeNow().After(entry.Expires) {
-		// Expired - flush key
-		delete(c.Cache, key)
-		return nil, false
+	var entry DNSCacheItem
+	for _, key := range keys {
+		if entry, found = c.Cache[key]; !found {
+			continue
+		}
+		if !entry.Permanent && timeNow().After(entry.Expires) {
+			// Expired - flush key (unless kept for GetStale)
+			if timeNow().After(entry.Expires.Add(c.StaleWindow)) {
+				c.remove(key)
+			}
+			found = false
+			continue
+		}
+		entry.Used = timeNow()
+		entry.Hits++
+		if c.prefetch(entry) {
+			entry.Prefetch = true
+			prefetch = true
+		}
+		c.Cache[key] = entry
+		break
+	}
+	if !found {
+		return nil, false, false
 	}
 
-	reply := entry.Message.Copy()
+	reply = entry.Message.Copy()
 
 	// Fix ID
 	reply.Id = query.Id
@@ -175,9 +418,124 @@ func (c *DNSCache) Get(query *dns.Msg) (*dns.Msg, bool) {
 		}
 	}
 
+	return reply, true, prefetch
+}
+
+// prefetch reports whether entry is due to be prefetched, applying the rate
+// limit. Must be called with the lock held.
+func (c *DNSCache) prefetch(entry DNSCacheItem) bool {
+	if c.Prefetch <= 0 || entry.Permanent || entry.Prefetch || entry.Hits < c.PrefetchHits {
+		return false
+	}
+	now := timeNow()
+	ttl := entry.Expires.Sub(entry.Inserted)
+	if entry.Expires.Sub(now) > time.Duration(float64(ttl)*c.Prefetch) {
+		return false
+	}
+	if now.Sub(c.rateStart) >= time.Second {
+		c.rateStart, c.rateCount = now, 0
+	}
+	if c.rateCount >= c.PrefetchRate {
+		c.limited++
+		return false
+	}
+	c.rateCount++
+	c.prefetches++
+	return true
+}
+
+// GetStale returns the expired answer for query if it expired less than
+// StaleWindow ago, with its TTLs set to StaleTTL. If recent is set the answer
+// is only returned if it has already been served stale (the upstreams failed
+// since it expired); otherwise the upstreams have just failed and the time is
+// recorded (see StaleRefresh).
+func (c *DNSCache) GetStale(query *dns.Msg, recent bool) (*dns.Msg, bool) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	key, entry, found := c.staleEntry(query)
+	if !found || recent && entry.Stale.IsZero() {
+		return nil, false
+	}
+	if !recent {
+		entry.Stale = timeNow()
+		c.Cache[key] = entry
+	}
+	reply := entry.Message.Copy()
+	reply.Id = query.Id
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, v := range section {
+			if v.Header().Rrtype != dns.TypeOPT {
+				v.Header().Ttl = StaleTTL
+			}
+		}
+	}
 	return reply, true
 }
 
+// StaleRefresh reports whether the answer being served stale for query
+// should be refreshed from the upstreams: only if there has been no upstream
+// attempt for StaleRecheck, so that clients do not drive upstream retries at
+// their own query rate. The refresh attempt is recorded.
+func (c *DNSCache) StaleRefresh(query *dns.Msg) bool {
+
+	c.Lock()
+	defer c.Unlock()
+
+	key, entry, found := c.staleEntry(query)
+	if !found || timeNow().Sub(entry.Stale) < StaleRecheck {
+		return false
+	}
+	entry.Stale = timeNow()
+	c.Cache[key] = entry
+	return true
+}
+
+// staleEntry returns the expired entry for query (for the client subnet if
+// the query has ECS, or for all clients) if it expired less than StaleWindow
+// ago (called with the lock held).
+func (c *DNSCache) staleEntry(query *dns.Msg) (DNSCacheKey, DNSCacheItem, bool) {
+	now := timeNow()
+	keys := []DNSCacheKey{{Name: dns.CanonicalName(query.Question[0].Name), Qtype: query.Question[0].Qtype}}
+	if subnet, _, ok := ecsSubnet(query); ok {
+		keys = append([]DNSCacheKey{{Name: keys[0].Name, Qtype: keys[0].Qtype, Subnet: subnet}}, keys...)
+	}
+	for _, key := range keys {
+		entry, found := c.Cache[key]
+		if found && !entry.Permanent && now.After(entry.Expires) && !now.After(entry.Expires.Add(c.StaleWindow)) {
+			return key, entry, true
+		}
+	}
+	return DNSCacheKey{}, DNSCacheItem{}, false
+}
+
+// DeleteStale removes the expired answers for query (for all client
+// subnets), e.g. when a refresh returned an answer that is not cached.
+func (c *DNSCache) DeleteStale(query *dns.Msg) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	now := timeNow()
+	name, qtype := dns.CanonicalName(query.Question[0].Name), query.Question[0].Qtype
+	for k, v := range c.Cache {
+		if k.Name == name && k.Qtype == qtype && !v.Permanent && now.After(v.Expires) {
+			c.remove(k)
+		}
+	}
+}
+
+// findSOA returns the first SOA record in rrs (nil if none).
+func findSOA(rrs []dns.RR) *dns.SOA {
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
+
 // Convenience wrapper for c.Get - for testing
 func (c *DNSCache) GetName(qname string, qtype string) (*dns.Msg, bool) {
 	msg := new(dns.Msg)
@@ -185,13 +543,22 @@ func (c *DNSCache) GetName(qname string, qtype string) (*dns.Msg, bool) {
 	return c.Get(msg)
 }
 
+// deleteAll removes the entries for name/qtype for all client subnets.
+// Caller holds lock.
+func (c *DNSCache) deleteAll(name string, qtype uint16) {
+	for k := range c.Cache {
+		if k.Name == name && k.Qtype == qtype {
+			c.remove(k)
+		}
+	}
+}
+
 func (c *DNSCache) Delete(query *dns.Msg) {
 
 	c.Lock()
 	defer c.Unlock()
 
-	key := DNSCacheKey{Name: dns.CanonicalName(query.Question[0].Name), Qtype: query.Question[0].Qtype}
-	delete(c.Cache, key)
+	c.deleteAll(dns.CanonicalName(query.Question[0].Name), query.Question[0].Qtype)
 }
 
 func (c *DNSCache) DeleteName(name string, qtype string, ptr bool) {
@@ -205,11 +572,9 @@ func (c *DNSCache) DeleteName(name string, qtype string, ptr bool) {
 			for _, rr := range fwd.Answer {
 				switch v := rr.(type) {
 				case *dns.A:
-					key := DNSCacheKey{Name: reverseIP4(v.A), Qtype: dns.TypePTR}
-					delete(c.Cache, key)
+					c.remove(DNSCacheKey{Name: reverseIP4(v.A), Qtype: dns.TypePTR})
 				case *dns.AAAA:
-					key := DNSCacheKey{Name: reverseIP6(v.AAAA), Qtype: dns.TypePTR}
-					delete(c.Cache, key)
+					c.remove(DNSCacheKey{Name: reverseIP6(v.AAAA), Qtype: dns.TypePTR})
 				default:
 					// Ignore
 				}
@@ -220,8 +585,7 @@ func (c *DNSCache) DeleteName(name string, qtype string, ptr bool) {
 
 	// We ignore invalid qtype as delete will just fail
 	c.Lock()
-	key := DNSCacheKey{Name: dns.CanonicalName(name), Qtype: dns.StringToType[qtype]}
-	delete(c.Cache, key)
+	c.deleteAll(dns.CanonicalName(name), dns.StringToType[qtype])
 	c.Unlock()
 }
 
@@ -233,8 +597,8 @@ func (c *DNSCache) Flush() (total, expired int) {
 	now := timeNow()
 	for k, v := range c.Cache {
 		total++
-		if !v.Permanent && now.After(v.Expires) {
-			delete(c.Cache, k)
+		if !v.Permanent && now.After(v.Expires.Add(c.StaleWindow)) {
+			c.remove(k)
 			expired++
 		}
 	}
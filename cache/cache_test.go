@@ -2,6 +2,7 @@ package cache
 
 import (
 	"fmt"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -143,10 +144,17 @@ func TestConcurrent(t *testing.T) {
 		wg.Done()
 	}()
 
+	// Stop flushing before later tests mock timeNow
+	done := make(chan bool)
+	defer close(done)
 	go func() {
 		for {
 			cache.Flush()
-			time.Sleep(time.Millisecond * 500)
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond * 500):
+			}
 		}
 	}()
 
@@ -183,3 +191,363 @@ func TestGetName(t *testing.T) {
 		t.Errorf("GetName:: not found")
 	}
 }
+
+func setEcs(msg *dns.Msg, subnet string, scope uint8) {
+	_, cidr, _ := net.ParseCIDR(subnet)
+	ones, bits := cidr.Mask.Size()
+	family := uint16(1)
+	if bits == 128 {
+		family = 2
+	}
+	msg.SetEdns0(1232, false)
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: uint8(ones), SourceScope: scope, Address: cidr.IP,
+	})
+}
+
+func TestEcs(t *testing.T) {
+
+	cache := New()
+
+	// Scoped answer - only used for the same client subnet
+	msg, _ := createCacheItem("scoped.test.com.", "A", "scoped.test.com. 60 IN A 1.2.3.4")
+	setEcs(msg, "192.0.2.0/24", 24)
+	cache.Add(msg)
+
+	// Answer with scope 0 - used for all clients
+	msg, _ = createCacheItem("global.test.com.", "A", "global.test.com. 60 IN A 1.2.3.5")
+	setEcs(msg, "192.0.2.0/24", 0)
+	cache.Add(msg)
+
+	for _, v := range []struct {
+		name   string
+		subnet string
+		found  bool
+	}{
+		{"scoped.test.com.", "192.0.2.0/24", true},
+		{"scoped.test.com.", "198.51.100.0/24", false},
+		{"scoped.test.com.", "", false},
+		{"global.test.com.", "192.0.2.0/24", true},
+		{"global.test.com.", "2001:db8::/56", true},
+		{"global.test.com.", "", true},
+	} {
+		q := util.CreateQuery(v.name, "A")
+		if v.subnet != "" {
+			setEcs(q, v.subnet, 0)
+		}
+		if _, found := cache.Get(q); found != v.found {
+			t.Errorf("%s (%s): found=%v", v.name, v.subnet, found)
+		}
+	}
+
+	// Delete removes answers for all subnets
+	cache.DeleteName("scoped.test.com.", "A", false)
+	if len(cache.Cache) != 1 {
+		t.Errorf("Invalid # cache items: %d", len(cache.Cache))
+	}
+}
+
+func TestEviction(t *testing.T) {
+
+	// Use mock time.Now
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	add := func(cache *DNSCache, name string) {
+		msg, _ := createCacheItem(name, "A", name+" 60 IN A 1.2.3.4")
+		cache.Add(msg)
+		now = now.Add(time.Second)
+	}
+	get := func(cache *DNSCache, name string) bool {
+		_, found := cache.GetName(name, "A")
+		now = now.Add(time.Second)
+		return found
+	}
+
+	for _, v := range []struct {
+		eviction string
+		evicted  string
+	}{
+		{EvictLRU, "b.test.com."}, // a and c used more recently than b
+		{EvictLFU, "a.test.com."}, // b used more often, c as often but more recently
+	} {
+		cache := New()
+		cache.MaxEntries = 4
+		cache.Eviction = v.eviction
+		if err := cache.AddRRString("local.test.com. 60 IN A 192.168.0.1", true, false); err != nil {
+			t.Fatal(err)
+		}
+		add(cache, "a.test.com.")
+		add(cache, "b.test.com.")
+		get(cache, "b.test.com.")
+		get(cache, "b.test.com.")
+		get(cache, "a.test.com.")
+		add(cache, "c.test.com.")
+		get(cache, "c.test.com.")
+		add(cache, "d.test.com.")
+
+		if get(cache, v.evicted) {
+			t.Errorf("%s: %s not evicted", v.eviction, v.evicted)
+		}
+		// Permanent entries are never evicted
+		if !get(cache, "local.test.com.") || len(cache.Cache) != 4 {
+			t.Errorf("%s: unexpected entries %v", v.eviction, cache.Debug())
+		}
+		if stats := cache.Stats(); stats.Evictions != 1 || stats.Entries != 4 {
+			t.Errorf("%s: unexpected stats %+v", v.eviction, stats)
+		}
+	}
+
+	// Expired entries are evicted first
+	cache := New()
+	cache.MaxEntries = 2
+	add(cache, "a.test.com.")
+	msg, _ := createCacheItem("short.test.com.", "A", "short.test.com. 1 IN A 1.2.3.4")
+	cache.Add(msg)
+	now = now.Add(5 * time.Second)
+	add(cache, "b.test.com.")
+	if !get(cache, "a.test.com.") || !get(cache, "b.test.com.") {
+		t.Errorf("unexpected entries %v", cache.Debug())
+	}
+}
+
+func TestEvictionBytes(t *testing.T) {
+
+	cache := New()
+	msg, _ := createCacheItem("a.test.com.", "A", "a.test.com. 60 IN A 1.2.3.4")
+	size := entrySize(DNSCacheKey{Name: "a.test.com.", Qtype: dns.TypeA}, msg)
+	cache.MaxBytes = 10 * size
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("%c.test.com.", 'a'+i%26)
+		msg, _ := createCacheItem(fmt.Sprintf("%d.%s", i%10, name), "A", name+" 60 IN A 1.2.3.4")
+		cache.Add(msg)
+	}
+	stats := cache.Stats()
+	if stats.Bytes > cache.MaxBytes || stats.Entries == 0 || stats.Evictions == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Accounting follows deletes
+	for k := range cache.Cache {
+		cache.DeleteName(k.Name, "A", false)
+	}
+	if stats := cache.Stats(); stats.Bytes != 0 || stats.Entries != 0 {
+		t.Errorf("unexpected stats after delete %+v", stats)
+	}
+}
+
+func TestStale(t *testing.T) {
+
+	// Use mock time.Now
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	cache := New()
+	cache.StaleWindow = time.Hour
+
+	msg, _ := createCacheItem("stale.test.com.", "A", "stale.test.com. 60 IN A 1.2.3.4")
+	cache.Add(msg)
+	q := util.CreateQuery("stale.test.com.", "A")
+
+	// Not stale until expired
+	if _, found := cache.GetStale(q, false); found {
+		t.Errorf("Unexpired entry returned as stale")
+	}
+
+	// Expired - kept for GetStale but not returned by Get
+	now = now.Add(time.Second * 100)
+	if _, found := cache.Get(q); found {
+		t.Errorf("Expired entry returned by Get")
+	}
+	cache.Flush()
+	if len(cache.Cache) != 1 {
+		t.Fatalf("Stale entry flushed")
+	}
+
+	// Only returned with recent if already served stale
+	if _, found := cache.GetStale(q, true); found {
+		t.Errorf("Stale entry returned with recent before failure")
+	}
+	out, found := cache.GetStale(q, false)
+	if !found || out.Id != q.Id || out.Answer[0].Header().Ttl != StaleTTL {
+		t.Errorf("Invalid stale answer: %v", out)
+	}
+	if _, found := cache.GetStale(q, true); !found {
+		t.Errorf("Stale entry not returned with recent")
+	}
+
+	// Refreshed at most every StaleRecheck after the failure
+	if cache.StaleRefresh(q) {
+		t.Errorf("Stale entry refreshed before StaleRecheck")
+	}
+	now = now.Add(StaleRecheck)
+	if !cache.StaleRefresh(q) {
+		t.Errorf("Stale entry not refreshed after StaleRecheck")
+	}
+	if cache.StaleRefresh(q) {
+		t.Errorf("Stale entry refreshed twice")
+	}
+	if _, found := cache.GetStale(q, true); !found {
+		t.Errorf("Stale entry not returned with recent")
+	}
+	if cache.StaleRefresh(util.CreateQuery("other.test.com.", "A")) {
+		t.Errorf("Refresh for missing entry")
+	}
+
+	// DeleteStale removes expired entries only
+	msg, _ = createCacheItem("fresh.test.com.", "A", "fresh.test.com. 60 IN A 1.2.3.4")
+	cache.Add(msg)
+	cache.DeleteStale(q)
+	cache.DeleteStale(util.CreateQuery("fresh.test.com.", "A"))
+	if len(cache.Cache) != 1 {
+		t.Errorf("Invalid # cache items: %d", len(cache.Cache))
+	}
+
+	// Flushed after the stale window
+	cache.Add(msg)
+	now = now.Add(time.Hour * 2)
+	if _, found := cache.GetStale(util.CreateQuery("fresh.test.com.", "A"), false); found {
+		t.Errorf("Entry returned after stale window")
+	}
+	cache.Flush()
+	if len(cache.Cache) != 0 {
+		t.Errorf("Invalid # cache items: %d", len(cache.Cache))
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+
+	// Use mock time.Now
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	cache := New()
+	cache.Prefetch = 0.1
+	cache.PrefetchRate = 1
+
+	for _, name := range []string{"a.test.com.", "b.test.com."} {
+		msg, _ := createCacheItem(name, "A", name+" 100 IN A 1.2.3.4")
+		cache.Add(msg)
+	}
+	qa, qb := util.CreateQuery("a.test.com.", "A"), util.CreateQuery("b.test.com.", "A")
+
+	// Popular entries are not prefetched until the last 10% of the TTL
+	for i := 0; i < DefaultPrefetchHits; i++ {
+		if _, _, prefetch := cache.GetPrefetch(qa); prefetch {
+			t.Errorf("Prefetch before end of TTL")
+		}
+	}
+	now = now.Add(time.Second * 95)
+	if _, found, prefetch := cache.GetPrefetch(qa); !found || !prefetch {
+		t.Errorf("Expected prefetch")
+	}
+	// Only once
+	if _, _, prefetch := cache.GetPrefetch(qa); prefetch {
+		t.Errorf("Prefetch repeated")
+	}
+
+	// Unpopular entries are not prefetched
+	if _, _, prefetch := cache.GetPrefetch(qb); prefetch {
+		t.Errorf("Prefetch of unpopular entry")
+	}
+
+	// Rate limit
+	cache.GetPrefetch(qb)
+	if _, _, prefetch := cache.GetPrefetch(qb); prefetch {
+		t.Errorf("Prefetch not rate limited")
+	}
+	now = now.Add(time.Second)
+	if _, _, prefetch := cache.GetPrefetch(qb); !prefetch {
+		t.Errorf("Expected prefetch after rate limit")
+	}
+
+	if stats := cache.Stats(); stats.Prefetches != 2 || stats.PrefetchesLimited != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestNegative(t *testing.T) {
+
+	// Use mock time.Now
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	negative := func(qname string, qtype string, rcode int, authority ...string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(qname, dns.StringToType[qtype])
+		msg.Response = true
+		msg.Rcode = rcode
+		for _, v := range authority {
+			rr, _ := dns.NewRR(v)
+			msg.Ns = append(msg.Ns, rr)
+		}
+		return msg
+	}
+	soa := "test.com. 3600 IN SOA ns.test.com. admin.test.com. 1 3600 600 86400 300"
+
+	cache := New()
+	cache.Add(negative("nx.test.com.", "A", dns.RcodeNameError, soa))
+	cache.Add(negative("www.test.com.", "AAAA", dns.RcodeSuccess, soa))
+	cache.Add(negative("nosoa.test.com.", "A", dns.RcodeNameError))
+	cache.Add(negative("fail.test.com.", "A", dns.RcodeServerFailure, soa))
+	if len(cache.Cache) != 2 {
+		t.Fatalf("Invalid # cache items: %d", len(cache.Cache))
+	}
+
+	// Served with the rcode and the SOA TTL bounded by MINIMUM
+	now = now.Add(time.Second * 100)
+	for _, v := range []struct {
+		qname, qtype string
+		rcode        int
+	}{{"nx.test.com.", "A", dns.RcodeNameError}, {"www.test.com.", "AAAA", dns.RcodeSuccess}} {
+		out, found := cache.Get(util.CreateQuery(v.qname, v.qtype))
+		if !found || out.Rcode != v.rcode || len(out.Answer) != 0 || out.Ns[0].Header().Ttl != 200 {
+			t.Errorf("Invalid negative answer for %s: %v", v.qname, out)
+		}
+	}
+
+	// Expires after MINIMUM
+	now = now.Add(time.Second * 201)
+	if _, found := cache.Get(util.CreateQuery("nx.test.com.", "A")); found {
+		t.Errorf("Negative answer not expired")
+	}
+
+	// Bounded by NegativeMaxTTL
+	cache.NegativeMaxTTL = time.Minute
+	cache.Add(negative("nx.test.com.", "A", dns.RcodeNameError, soa))
+	if out, found := cache.Get(util.CreateQuery("nx.test.com.", "A")); !found || out.Ns[0].Header().Ttl != 60 {
+		t.Errorf("Invalid negative answer: %v", out)
+	}
+
+	// Disabled
+	cache.NegativeMaxTTL = 0
+	cache.Add(negative("nx2.test.com.", "A", dns.RcodeNameError, soa))
+	if _, found := cache.Get(util.CreateQuery("nx2.test.com.", "A")); found {
+		t.Errorf("Negative answer cached with NegativeMaxTTL = 0")
+	}
+}
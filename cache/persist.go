@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Cache file format: the magic string followed by a gob encoded
+// persistFile. persistVersion must be incremented if persistFile or
+// persistEntry change incompatibly.
+const (
+	persistMagic   = "dinosaur-cache\n"
+	persistVersion = 1
+)
+
+type persistFile struct {
+	Version int
+	Saved   time.Time
+	Entries []persistEntry
+}
+
+type persistEntry struct {
+	Subnet   string
+	Inserted time.Time
+	Expires  time.Time
+	Hits     int
+	Message  []byte // wire format
+}
+
+// Save writes the non-permanent cache entries to w.
+func (c *DNSCache) Save(w io.Writer) (int, error) {
+
+	c.RLock()
+	file := persistFile{Version: persistVersion, Saved: timeNow(), Entries: make([]persistEntry, 0, len(c.Cache))}
+	for k, v := range c.Cache {
+		if v.Permanent {
+			continue
+		}
+		msg, err := v.Message.Pack()
+		if err != nil {
+			continue
+		}
+		file.Entries = append(file.Entries, persistEntry{Subnet: k.Subnet, Inserted: v.Inserted, Expires: v.Expires, Hits: v.Hits, Message: msg})
+	}
+	c.RUnlock()
+
+	if _, err := io.WriteString(w, persistMagic); err != nil {
+		return 0, err
+	}
+	if err := gob.NewEncoder(w).Encode(&file); err != nil {
+		return 0, err
+	}
+	return len(file.Entries), nil
+}
+
+// Load adds the entries saved by Save that have not expired (or are within
+// StaleWindow) to the cache. TTLs are adjusted on Get from the original
+// insertion time. Existing entries (e.g. local records) are not replaced.
+func (c *DNSCache) Load(r io.Reader) (int, error) {
+
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(persistMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != persistMagic {
+		return 0, errors.New("not a cache file")
+	}
+	var file persistFile
+	if err := gob.NewDecoder(br).Decode(&file); err != nil {
+		return 0, err
+	}
+	if file.Version != persistVersion {
+		return 0, fmt.Errorf("unsupported version %d", file.Version)
+	}
+
+	// Decode everything before adding so that a corrupt file is ignored
+	now := timeNow()
+	keys := make([]DNSCacheKey, 0, len(file.Entries))
+	items := make([]DNSCacheItem, 0, len(file.Entries))
+	for _, v := range file.Entries {
+		msg := new(dns.Msg)
+		if err := msg.Unpack(v.Message); err != nil {
+			return 0, err
+		}
+		if len(msg.Question) != 1 {
+			return 0, errors.New("invalid message")
+		}
+		if now.After(v.Expires.Add(c.StaleWindow)) {
+			continue
+		}
+		keys = append(keys, DNSCacheKey{Name: dns.CanonicalName(msg.Question[0].Name), Qtype: msg.Question[0].Qtype, Subnet: v.Subnet})
+		items = append(items, DNSCacheItem{Message: msg, Inserted: v.Inserted, Expires: v.Expires, Hits: v.Hits})
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	loaded := 0
+	for i, key := range keys {
+		if _, found := c.Cache[key]; found {
+			continue
+		}
+		c.set(key, items[i])
+		loaded++
+	}
+	return loaded, nil
+}
+
+// SaveFile saves the cache to path, replacing it atomically.
+func (c *DNSCache) SaveFile(path string) (int, error) {
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	n, err := c.Save(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, os.Rename(f.Name(), path)
+}
+
+// LoadFile loads the cache saved to path by SaveFile.
+func (c *DNSCache) LoadFile(path string) (int, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return c.Load(f)
+}
@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/paulc/dinosaur-dns/util"
+)
+
+func TestPersist(t *testing.T) {
+
+	// Use mock time.Now
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	cache := New()
+	for name, rr := range map[string]string{"a.test.com.": "a.test.com. 60 IN A 1.2.3.4", "b.test.com.": "b.test.com. 300 IN A 1.2.3.5"} {
+		msg, _ := createCacheItem(name, "A", rr)
+		cache.Add(msg)
+	}
+	if err := cache.AddRRString("local.test.com. 60 IN A 10.0.0.1", true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "cache")
+	if n, err := cache.SaveFile(path); err != nil || n != 2 {
+		t.Fatalf("SaveFile: %d %v", n, err)
+	}
+
+	// Reload after a.test.com. has expired - TTLs adjusted for the time
+	// since the answer was cached
+	now = now.Add(time.Second * 100)
+	reloaded := New()
+	if n, err := reloaded.LoadFile(path); err != nil || n != 1 {
+		t.Fatalf("LoadFile: %d %v", n, err)
+	}
+	out, found := reloaded.Get(util.CreateQuery("b.test.com.", "A"))
+	if !found || out.Answer[0].Header().Ttl != 200 {
+		t.Errorf("Invalid reloaded answer: %v", out)
+	}
+	if _, found := reloaded.GetName("local.test.com.", "A"); found {
+		t.Errorf("Permanent entry saved")
+	}
+	if stats := reloaded.Stats(); stats.Bytes == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPersistInvalid(t *testing.T) {
+
+	cache := New()
+	msg, _ := createCacheItem("a.test.com.", "A", "a.test.com. 60 IN A 1.2.3.4")
+	cache.Add(msg)
+	var saved bytes.Buffer
+	if _, err := cache.Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wrong version
+	var version bytes.Buffer
+	io.WriteString(&version, persistMagic)
+	gob.NewEncoder(&version).Encode(&persistFile{Version: persistVersion + 1})
+
+	for name, data := range map[string][]byte{
+		"empty":     {},
+		"magic":     []byte("not a cache file"),
+		"truncated": saved.Bytes()[:saved.Len()-10],
+		"version":   version.Bytes(),
+	} {
+		if n, err := New().Load(bytes.NewReader(data)); err == nil || n != 0 {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	if _, err := New().LoadFile(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist error: %v", err)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"log"
+	"os/signal"
+	"syscall"
 
 	"github.com/paulc/dinosaur-dns/config"
 	"github.com/paulc/dinosaur-dns/server"
@@ -20,7 +22,9 @@ func main() {
 		log.Fatal("Config Error: ", err)
 	}
 
-	ctx := context.Background()
-	ready := make(chan bool)
+	// Shut down (saving the cache file if set) on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ready := make(chan bool, 1)
 	server.StartServer(ctx, proxy_config, ready)
 }
@@ -3,8 +3,10 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/paulc/dinosaur-dns/config"
 	"github.com/paulc/dinosaur-dns/util"
@@ -18,11 +20,33 @@ func GetUserConfig() (*config.UserConfig, error) {
 	var configFlag = flag.String("config", "", "JSON config file")
 	var dns64Flag = flag.Bool("dns64", false, "Enable DNS64 (for queries from IPv6 addresses)")
 	var dns64PrefixFlag = flag.String("dns64-prefix", "", "DNS64 prefix (default: 64:ff9b::/96)")
+	var ecsFlag = flag.String("ecs", "", "EDNS Client Subnet policy [forward, strip, add[:v4,v6]] (default: forward, add: 24,56)")
+	var dnssecFlag = flag.Bool("dnssec", false, "Enable DNSSEC validation of upstream answers (default: false)")
+	var rebindFlag = flag.String("rebind", "", "DNS rebinding protection for private addresses in upstream answers [off, drop, nxdomain] (default: off)")
 	var apiFlag = flag.Bool("api", false, "Enable API (default: false)")
 	var apiBindFlag = flag.String("api-bind", "", "API bind address (default: 127.0.0.1:8553)")
 	var dohCertFlag = flag.String("doh-cert", "", "DoH TLS certificate file (auto-generates self-signed if omitted)")
 	var dohKeyFlag = flag.String("doh-key", "", "DoH TLS private key file")
 	var dohPathFlag = flag.String("doh-path", "", "DoH request path (default: /dns-query)")
+	var proxyFlag = flag.String("proxy", "", "Proxy for TCP/DoT/DoH upstreams [socks5://host:port or http://host:port]")
+	var upstreamTimeoutFlag = flag.String("upstream-timeout", "", "Query deadline across all upstream attempts (default: 5s)")
+	var failureRcodesFlag = flag.String("failure-rcodes", "", "Upstream response rcodes treated as failure [rcode,... or none] (default: SERVFAIL,REFUSED)")
+	var failureBestAnswerFlag = flag.Bool("failure-best-answer", false, "Return the best failed upstream response instead of SERVFAIL when all upstreams fail (default: false)")
+	var upstreamStrategyFlag = flag.String("upstream-strategy", "", "Upstream selection strategy [failover, race[:N], round-robin, weighted:W,..., latency] (default: failover)")
+	var healthIntervalFlag = flag.String("health-interval", "", "Upstream health check interval (0 disables, default: 30s)")
+	var healthFailuresFlag = flag.Int("health-failures", 0, "Consecutive upstream errors before it is skipped (default: 3)")
+	var healthRecoveryFlag = flag.Int("health-recovery", 0, "Consecutive successes before a skipped upstream is restored (default: 2)")
+	var healthCooldownFlag = flag.String("health-cooldown", "", "Time before a skipped upstream is retried (default: 60s)")
+	var cacheSizeFlag = flag.Int("cache-size", 0, "Maximum number of cache entries (default: 0 - unlimited)")
+	var cacheMemoryFlag = flag.String("cache-memory", "", "Approximate cache memory budget [bytes, with optional k, M or G suffix] (default: unlimited)")
+	var cacheEvictionFlag = flag.String("cache-eviction", "", "Cache eviction policy when full [lru, lfu] (default: lru)")
+	var cacheFileFlag = flag.String("cache-file", "", "Save cache to file on shutdown and reload at startup (default: none)")
+	var cacheSaveIntervalFlag = flag.String("cache-save-interval", "", "Also save cache file periodically (default: 0 - on shutdown only)")
+	var negativeMaxTTLFlag = flag.String("negative-max-ttl", "", "Maximum time NXDOMAIN/NODATA answers are cached (0 disables, default: 3h)")
+	var prefetchFlag = flag.Float64("prefetch", 0, "Prefetch popular cache entries in this fraction of their TTL [0-1] (default: 0 - disabled)")
+	var prefetchHitsFlag = flag.Int("prefetch-hits", 0, "Cache hits before an entry is prefetched (default: 3)")
+	var prefetchRateFlag = flag.Int("prefetch-rate", 0, "Maximum prefetches per second (default: 10)")
+	var serveStaleFlag = flag.String("serve-stale", "", "Serve expired cache entries for this long when upstreams fail (default: disabled)")
 	var refreshFlag = flag.Bool("refresh", false, "Auto refresh blocklist (default: false)")
 	var refreshIntervalFlag = flag.String("refresh-interval", "", "Blocklist refresh interval (default: 24hrs)")
 	var debugFlag = flag.Bool("debug", false, "Debug log (default: false)")
@@ -34,7 +58,18 @@ func GetUserConfig() (*config.UserConfig, error) {
 	flag.Var(&listenFlag, "listen", "Listen address/interface (default: lo0:8053)")
 
 	var upstreamFlag util.MultiFlag
-	flag.Var(&upstreamFlag, "upstream", "Upstream resolver [host:port or https://...] (default: 1.1.1.1:53,1.0.0.1:53)")
+	flag.Var(&upstreamFlag, "upstream", "Upstream resolver [host:port, tcp://..., tls://..., quic://... or https://...] (default: 1.1.1.1:53,1.0.0.1:53)")
+
+	var dnssecAnchorFlag util.MultiFlag
+	flag.Var(&dnssecAnchorFlag, "dnssec-anchor", "DNSSEC trust anchor [DS or DNSKEY record] (default: root zone KSKs)")
+
+	var rebindAllowFlag util.MultiFlag
+	flag.Var(&rebindAllowFlag, "rebind-allow", "Domain allowed private addresses in upstream answers (rebinding protection)")
+
+	var bootstrapFlag util.MultiFlag
+	flag.Var(&bootstrapFlag, "bootstrap", "Bootstrap resolver IP for upstream hostnames [ip[:port]] (default: system resolver)")
+	var forwardFlag util.MultiFlag
+	flag.Var(&forwardFlag, "forward", "Forward zone (format: 'domain=upstream[,upstream...]')")
 
 	var blockFlag util.MultiFlag
 	flag.Var(&blockFlag, "block", "Block entry (format: 'domain[:qtype]')")
@@ -103,6 +138,53 @@ func GetUserConfig() (*config.UserConfig, error) {
 		user_config.Upstream = append(user_config.Upstream, v)
 	}
 
+	// Forward zones
+	for _, v := range forwardFlag {
+		domain, upstreams, ok := strings.Cut(v, "=")
+		if !ok || domain == "" || upstreams == "" {
+			return nil, fmt.Errorf("Invalid forward zone: %s", v)
+		}
+		user_config.Forward[domain] = append(user_config.Forward[domain], strings.Split(upstreams, ",")...)
+	}
+
+	// Bootstrap resolvers
+	for _, v := range bootstrapFlag {
+		user_config.Bootstrap = append(user_config.Bootstrap, v)
+	}
+
+	// Upstream proxy
+	if *proxyFlag != "" {
+		user_config.Proxy = *proxyFlag
+	}
+
+	// Upstream strategy and timeout
+	if *upstreamTimeoutFlag != "" {
+		user_config.UpstreamTimeout = *upstreamTimeoutFlag
+	}
+	if *upstreamStrategyFlag != "" {
+		user_config.UpstreamStrategy = *upstreamStrategyFlag
+	}
+
+	// Upstream failure rcodes
+	if *failureRcodesFlag != "" {
+		user_config.FailureRcodes = *failureRcodesFlag
+	}
+	user_config.FailureBestAnswer = user_config.FailureBestAnswer || *failureBestAnswerFlag
+
+	// Upstream health checks
+	if *healthIntervalFlag != "" {
+		user_config.HealthInterval = *healthIntervalFlag
+	}
+	if *healthFailuresFlag != 0 {
+		user_config.HealthFailures = *healthFailuresFlag
+	}
+	if *healthRecoveryFlag != 0 {
+		user_config.HealthRecovery = *healthRecoveryFlag
+	}
+	if *healthCooldownFlag != "" {
+		user_config.HealthCooldown = *healthCooldownFlag
+	}
+
 	// Local cache entries
 	for _, v := range localRRFlag {
 		user_config.LocalRR = append(user_config.LocalRR, v)
@@ -118,6 +200,38 @@ func GetUserConfig() (*config.UserConfig, error) {
 		user_config.Localzone = append(user_config.Localzone, v)
 	}
 
+	// Cache limits
+	if *cacheSizeFlag != 0 {
+		user_config.CacheSize = *cacheSizeFlag
+	}
+	if *cacheMemoryFlag != "" {
+		user_config.CacheMemory = *cacheMemoryFlag
+	}
+	if *cacheEvictionFlag != "" {
+		user_config.CacheEviction = *cacheEvictionFlag
+	}
+	if *serveStaleFlag != "" {
+		user_config.ServeStale = *serveStaleFlag
+	}
+	if *cacheFileFlag != "" {
+		user_config.CacheFile = *cacheFileFlag
+	}
+	if *cacheSaveIntervalFlag != "" {
+		user_config.CacheSaveInterval = *cacheSaveIntervalFlag
+	}
+	if *negativeMaxTTLFlag != "" {
+		user_config.NegativeMaxTTL = *negativeMaxTTLFlag
+	}
+	if *prefetchFlag != 0 {
+		user_config.Prefetch = *prefetchFlag
+	}
+	if *prefetchHitsFlag != 0 {
+		user_config.PrefetchHits = *prefetchHitsFlag
+	}
+	if *prefetchRateFlag != 0 {
+		user_config.PrefetchRate = *prefetchRateFlag
+	}
+
 	// Block entries
 	for _, v := range blockFlag {
 		user_config.Block = append(user_config.Block, v)
@@ -155,6 +269,25 @@ func GetUserConfig() (*config.UserConfig, error) {
 		user_config.Dns64Prefix = *dns64PrefixFlag
 	}
 
+	// EDNS Client Subnet
+	if *ecsFlag != "" {
+		user_config.Ecs = *ecsFlag
+	}
+
+	// DNSSEC
+	user_config.Dnssec = user_config.Dnssec || *dnssecFlag
+	for _, v := range dnssecAnchorFlag {
+		user_config.DnssecAnchor = append(user_config.DnssecAnchor, v)
+	}
+
+	// DNS rebinding protection
+	if *rebindFlag != "" {
+		user_config.Rebind = *rebindFlag
+	}
+	for _, v := range rebindAllowFlag {
+		user_config.RebindAllow = append(user_config.RebindAllow, v)
+	}
+
 	// API
 	user_config.Api = user_config.Api || *apiFlag
 	if *apiBindFlag != "" {
@@ -16,6 +16,18 @@ func TestGetUserConfig(t *testing.T) {
 		"-listen", "[::1]:8053",
 		"-upstream", "1.1.1.1",
 		"-upstream", "8.8.8.8",
+		"-upstream-strategy", "race:2",
+		"-upstream-timeout", "3s",
+		"-failure-rcodes", "SERVFAIL,REFUSED,NOTIMP",
+		"-failure-best-answer",
+		"-bootstrap", "9.9.9.9",
+		"-proxy", "socks5://127.0.0.1:1080",
+		"-forward", "corp.example=10.0.0.1,10.0.0.2",
+		"-forward", "10.in-addr.arpa=10.0.0.1",
+		"-health-interval", "10s",
+		"-health-failures", "5",
+		"-health-recovery", "3",
+		"-health-cooldown", "2m",
 		"-acl", "127.0.0.1/32",
 		"-acl", "::1/128",
 		"-block", "abcd.xyz",
@@ -26,8 +38,23 @@ func TestGetUserConfig(t *testing.T) {
 		"-localrr", "abcd.local. 60 IN A 127.0.0.1",
 		"-localrr-ptr", "ptr.local. 60 IN A 1.2.3.4",
 		"-localzone", "local-zone.txt",
+		"-cache-size", "10000",
+		"-cache-memory", "64M",
+		"-cache-eviction", "lfu",
+		"-serve-stale", "24h",
+		"-negative-max-ttl", "1h",
+		"-cache-file", "/var/cache/dinosaur.cache",
+		"-cache-save-interval", "10m",
+		"-prefetch", "0.1",
+		"-prefetch-hits", "5",
+		"-prefetch-rate", "20",
 		"-dns64",
 		"-dns64-prefix", "1111::/96",
+		"-ecs", "add:24,48",
+		"-dnssec",
+		"-dnssec-anchor", ". 3600 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+		"-rebind", "nxdomain",
+		"-rebind-allow", "home.arpa",
 		"-api",
 		"-api-bind", "127.0.0.1:9999",
 		"-doh", "127.0.0.1:8443",
@@ -48,6 +75,18 @@ func TestGetUserConfig(t *testing.T) {
 
 	if slices.Compare(user_config.Listen, []string{"127.0.0.1:8053", "[::1]:8053"}) != 0 ||
 		slices.Compare(user_config.Upstream, []string{"1.1.1.1", "8.8.8.8"}) != 0 ||
+		user_config.UpstreamStrategy != "race:2" ||
+		user_config.UpstreamTimeout != "3s" ||
+		user_config.FailureRcodes != "SERVFAIL,REFUSED,NOTIMP" ||
+		!user_config.FailureBestAnswer ||
+		slices.Compare(user_config.Bootstrap, []string{"9.9.9.9"}) != 0 ||
+		user_config.Proxy != "socks5://127.0.0.1:1080" ||
+		slices.Compare(user_config.Forward["corp.example"], []string{"10.0.0.1", "10.0.0.2"}) != 0 ||
+		slices.Compare(user_config.Forward["10.in-addr.arpa"], []string{"10.0.0.1"}) != 0 ||
+		user_config.HealthInterval != "10s" ||
+		user_config.HealthFailures != 5 ||
+		user_config.HealthRecovery != 3 ||
+		user_config.HealthCooldown != "2m" ||
 		slices.Compare(user_config.Acl, []string{"127.0.0.1/32", "::1/128"}) != 0 ||
 		slices.Compare(user_config.Block, []string{"abcd.xyz"}) != 0 ||
 		slices.Compare(user_config.BlockDelete, []string{"abcd.xyz"}) != 0 ||
@@ -57,8 +96,23 @@ func TestGetUserConfig(t *testing.T) {
 		slices.Compare(user_config.LocalRR, []string{"abcd.local. 60 IN A 127.0.0.1"}) != 0 ||
 		slices.Compare(user_config.LocalRRPtr, []string{"ptr.local. 60 IN A 1.2.3.4"}) != 0 ||
 		slices.Compare(user_config.Localzone, []string{"local-zone.txt"}) != 0 ||
+		user_config.CacheSize != 10000 ||
+		user_config.CacheMemory != "64M" ||
+		user_config.CacheEviction != "lfu" ||
+		user_config.ServeStale != "24h" ||
+		user_config.NegativeMaxTTL != "1h" ||
+		user_config.CacheFile != "/var/cache/dinosaur.cache" ||
+		user_config.CacheSaveInterval != "10m" ||
+		user_config.Prefetch != 0.1 ||
+		user_config.PrefetchHits != 5 ||
+		user_config.PrefetchRate != 20 ||
 		!user_config.Dns64 ||
 		user_config.Dns64Prefix != "1111::/96" ||
+		user_config.Ecs != "add:24,48" ||
+		!user_config.Dnssec ||
+		slices.Compare(user_config.DnssecAnchor, []string{". 3600 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"}) != 0 ||
+		user_config.Rebind != "nxdomain" ||
+		slices.Compare(user_config.RebindAllow, []string{"home.arpa"}) != 0 ||
 		!user_config.Api ||
 		user_config.ApiBind != "127.0.0.1:9999" ||
 		slices.Compare(user_config.Doh, []string{"127.0.0.1:8443"}) != 0 ||
@@ -5,50 +5,104 @@ import (
 	"sync"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/paulc/dinosaur-dns/blocklist"
 	"github.com/paulc/dinosaur-dns/cache"
+	"github.com/paulc/dinosaur-dns/dnssec"
 	"github.com/paulc/dinosaur-dns/logger"
 	"github.com/paulc/dinosaur-dns/resolver"
 	"github.com/paulc/dinosaur-dns/statshandler"
 )
 
+// ForwardZone routes queries for Domain (and all names below it) to its own
+// upstream set instead of the default Upstream list.
+type ForwardZone struct {
+	Domain   string
+	Upstream []resolver.Resolver
+	Strategy resolver.Strategy
+}
+
 type ProxyConfig struct {
 	sync.RWMutex
-	ListenAddr      []string
-	Upstream        []resolver.Resolver
-	UpstreamErr     int
-	Cache           *cache.DNSCache
-	CacheFlush      time.Duration
-	BlockList       *blocklist.BlockList
-	BlockPauseUntil time.Time // zero = not paused
-	Acl             []net.IPNet
-	Dns64           bool
-	Dns64Prefix     net.IPNet
-	Api             bool
-	ApiBind         string
-	DohBind         []string
-	DohCert         string
-	DohKey          string
-	DohPath         string
-	StatsHandler    *statshandler.StatsHandler
-	Refresh         bool
-	RefreshInterval time.Duration
-	Log             *logger.Logger
-	UserConfig      *UserConfig
-	Setuid          bool
-	SetuidUid       int
-	SetuidGid       int
+	ListenAddr        []string
+	Upstream          []resolver.Resolver
+	Strategy          resolver.Strategy
+	UpstreamTimeout   time.Duration    // budget for all upstream attempts of a query
+	FailureRcodes     map[int]bool     // response rcodes treated as upstream failure
+	FailureBestAnswer bool             // return the best failed response if all upstreams fail
+	Forward           []ForwardZone    // sorted most specific (longest) domain first
+	Dialer            *resolver.Dialer // upstream connections (nil = direct, system resolver)
+	Health            *resolver.HealthChecker
+	HealthInterval    time.Duration // 0 = no active probing
+	Metrics           *resolver.Metrics
+	Coalescer         *resolver.Coalescer
+	Cache             *cache.DNSCache
+	CacheFlush        time.Duration
+	CacheFile         string        // cache saved on shutdown and loaded at startup ("" = none)
+	CacheSaveInterval time.Duration // 0 = only save on shutdown
+	BlockList         *blocklist.BlockList
+	BlockPauseUntil   time.Time // zero = not paused
+	Acl               []net.IPNet
+	Dns64             bool
+	Dns64Prefix       net.IPNet
+	Ecs               string            // EDNS Client Subnet policy (EcsForward, EcsStrip or EcsAdd)
+	EcsPrefix4        int               // source prefix length added for IPv4 clients (EcsAdd)
+	EcsPrefix6        int               // source prefix length added for IPv6 clients (EcsAdd)
+	Dnssec            *dnssec.Validator // validates upstream answers (nil = disabled)
+	Rebind            string            // DNS rebinding protection (RebindOff, RebindDrop or RebindNxdomain)
+	RebindAllow       []string          // domains allowed private addresses in upstream answers
+	Api               bool
+	ApiBind           string
+	DohBind           []string
+	DohCert           string
+	DohKey            string
+	DohPath           string
+	StatsHandler      *statshandler.StatsHandler
+	Refresh           bool
+	RefreshInterval   time.Duration
+	Log               *logger.Logger
+	UserConfig        *UserConfig
+	Setuid            bool
+	SetuidUid         int
+	SetuidGid         int
 }
 
+// EDNS Client Subnet policies
+const (
+	EcsForward = "forward" // pass the client's ECS option through unchanged
+	EcsStrip   = "strip"   // remove ECS from queries sent upstream
+	EcsAdd     = "add"     // send a truncated subnet of the client address
+)
+
+// DNS rebinding protection policies
+const (
+	RebindOff      = "off"      // return upstream answers unchanged
+	RebindDrop     = "drop"     // remove private addresses from upstream answers
+	RebindNxdomain = "nxdomain" // answer NXDOMAIN if there are any
+)
+
 func NewProxyConfig() *ProxyConfig {
 	return &ProxyConfig{
 		ListenAddr:      make([]string, 0),
 		Upstream:        make([]resolver.Resolver, 0),
+		Strategy:        resolver.NewFailoverStrategy(),
+		UpstreamTimeout: resolver.DefaultTimeout,
+		FailureRcodes:   map[int]bool{dns.RcodeServerFailure: true, dns.RcodeRefused: true},
+		Forward:         make([]ForwardZone, 0),
+		Health:          resolver.NewHealthChecker(),
+		HealthInterval:  30 * time.Second,
+		Metrics:         resolver.NewMetrics(),
+		Coalescer:       resolver.NewCoalescer(),
 		Acl:             make([]net.IPNet, 0),
 		Cache:           cache.New(),
 		CacheFlush:      30 * time.Second,
 		BlockList:       blocklist.New(),
 		Dns64Prefix:     net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)},
+		Ecs:             EcsForward,
+		EcsPrefix4:      24,
+		EcsPrefix6:      56,
+		Rebind:          RebindOff,
+		RebindAllow:     make([]string, 0),
 		ApiBind:         "127.0.0.1:8553",
 		DohBind:         make([]string, 0),
 		DohPath:         "/dns-query",
@@ -57,3 +111,40 @@ func NewProxyConfig() *ProxyConfig {
 		RefreshInterval: time.Hour * 24,
 	}
 }
+
+// UpstreamSet returns the upstream set and strategy for qname: the most
+// specific matching forward zone, or the default upstream list.
+func (c *ProxyConfig) UpstreamSet(qname string) ([]resolver.Resolver, resolver.Strategy) {
+	c.RLock()
+	defer c.RUnlock()
+	for _, zone := range c.Forward {
+		if dns.IsSubDomain(zone.Domain, qname) {
+			return append(zone.Upstream[:0:0], zone.Upstream...), zone.Strategy
+		}
+	}
+	return append(c.Upstream[:0:0], c.Upstream...), c.Strategy
+}
+
+// Forwarded reports whether qname is in a forward zone.
+func (c *ProxyConfig) Forwarded(qname string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	for _, zone := range c.Forward {
+		if dns.IsSubDomain(zone.Domain, qname) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllUpstreams returns the default upstreams followed by those of each
+// forward zone.
+func (c *ProxyConfig) AllUpstreams() []resolver.Resolver {
+	c.RLock()
+	defer c.RUnlock()
+	out := append(c.Upstream[:0:0], c.Upstream...)
+	for _, zone := range c.Forward {
+		out = append(out, zone.Upstream...)
+	}
+	return out
+}
@@ -1,15 +1,20 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"regexp"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/paulc/dinosaur-dns/blocklist"
+	"github.com/paulc/dinosaur-dns/cache"
+	"github.com/paulc/dinosaur-dns/dnssec"
 	"github.com/paulc/dinosaur-dns/logger"
 	"github.com/paulc/dinosaur-dns/resolver"
 	"github.com/paulc/dinosaur-dns/util"
@@ -17,37 +22,65 @@ import (
 )
 
 type UserConfig struct {
-	Listen             []string `json:"listen"`
-	Upstream           []string `json:"upstream"`
-	Acl                []string `json:"acl"`
-	Block              []string `json:"block"`
-	BlockDelete        []string `json:"block-delete"`
-	Blocklist          []string `json:"blocklist"`
-	BlocklistAAAA      []string `json:"blocklist-aaaa"`
-	BlocklistFromHosts []string `json:"blocklist-from-hosts"`
-	LocalRR            []string `json:"localrr"`
-	LocalRRPtr         []string `json:"localrr-ptr"`
-	Localzone          []string `json:"localzone"`
-	Dns64              bool     `json:"dns64"`
-	Dns64Prefix        string   `json:"dns64-prefix"`
-	Api                bool     `json:"api"`
-	ApiBind            string   `json:"api-bind"`
-	Doh                []string `json:"doh"`
-	DohCert            string   `json:"doh-cert"`
-	DohKey             string   `json:"doh-key"`
-	DohPath            string   `json:"doh-path"`
-	Refresh            bool     `json:"refresh"`
-	RefreshInterval    string   `json:"refresh-interval"`
-	Debug              bool     `json:"debug"`
-	Syslog             bool     `json:"syslog"`
-	Discard            bool     `json:"discard"`
-	Setuid             string   `json:"setuid"`
+	Listen             []string            `json:"listen"`
+	Upstream           []string            `json:"upstream"`
+	UpstreamStrategy   string              `json:"upstream-strategy"`
+	UpstreamTimeout    string              `json:"upstream-timeout"`
+	FailureRcodes      string              `json:"failure-rcodes"`
+	FailureBestAnswer  bool                `json:"failure-best-answer"`
+	Bootstrap          []string            `json:"bootstrap"`
+	Proxy              string              `json:"proxy"`
+	Forward            map[string][]string `json:"forward"`
+	HealthInterval     string              `json:"health-interval"`
+	HealthFailures     int                 `json:"health-failures"`
+	HealthRecovery     int                 `json:"health-recovery"`
+	HealthCooldown     string              `json:"health-cooldown"`
+	Acl                []string            `json:"acl"`
+	Block              []string            `json:"block"`
+	BlockDelete        []string            `json:"block-delete"`
+	Blocklist          []string            `json:"blocklist"`
+	BlocklistAAAA      []string            `json:"blocklist-aaaa"`
+	BlocklistFromHosts []string            `json:"blocklist-from-hosts"`
+	LocalRR            []string            `json:"localrr"`
+	LocalRRPtr         []string            `json:"localrr-ptr"`
+	Localzone          []string            `json:"localzone"`
+	CacheSize          int                 `json:"cache-size"`
+	CacheMemory        string              `json:"cache-memory"`
+	CacheEviction      string              `json:"cache-eviction"`
+	ServeStale         string              `json:"serve-stale"`
+	NegativeMaxTTL     string              `json:"negative-max-ttl"`
+	CacheFile          string              `json:"cache-file"`
+	CacheSaveInterval  string              `json:"cache-save-interval"`
+	Prefetch           float64             `json:"prefetch"`
+	PrefetchHits       int                 `json:"prefetch-hits"`
+	PrefetchRate       int                 `json:"prefetch-rate"`
+	Dns64              bool                `json:"dns64"`
+	Dns64Prefix        string              `json:"dns64-prefix"`
+	Ecs                string              `json:"ecs"`
+	Dnssec             bool                `json:"dnssec"`
+	DnssecAnchor       []string            `json:"dnssec-anchor"`
+	Rebind             string              `json:"rebind"`
+	RebindAllow        []string            `json:"rebind-allow"`
+	Api                bool                `json:"api"`
+	ApiBind            string              `json:"api-bind"`
+	Doh                []string            `json:"doh"`
+	DohCert            string              `json:"doh-cert"`
+	DohKey             string              `json:"doh-key"`
+	DohPath            string              `json:"doh-path"`
+	Refresh            bool                `json:"refresh"`
+	RefreshInterval    string              `json:"refresh-interval"`
+	Debug              bool                `json:"debug"`
+	Syslog             bool                `json:"syslog"`
+	Discard            bool                `json:"discard"`
+	Setuid             string              `json:"setuid"`
 }
 
 func NewUserConfig() *UserConfig {
 	return &UserConfig{
 		Listen:             make([]string, 0),
 		Upstream:           make([]string, 0),
+		Bootstrap:          make([]string, 0),
+		Forward:            make(map[string][]string),
 		Acl:                make([]string, 0),
 		Block:              make([]string, 0),
 		BlockDelete:        make([]string, 0),
@@ -73,22 +106,126 @@ func (user_config *UserConfig) GetProxyConfig(config *ProxyConfig) error {
 		}
 	}
 
+	// Bootstrap resolvers for upstream hostnames
+	if len(user_config.Bootstrap) > 0 {
+		bootstrap, err := resolver.NewBootstrap(user_config.Bootstrap)
+		if err != nil {
+			return err
+		}
+		config.Dialer = &resolver.Dialer{Bootstrap: bootstrap}
+	}
+
+	// Upstream proxy
+	if user_config.Proxy != "" {
+		proxy, err := resolver.ParseProxy(user_config.Proxy)
+		if err != nil {
+			return err
+		}
+		if config.Dialer == nil {
+			config.Dialer = &resolver.Dialer{}
+		}
+		config.Dialer.Proxy = proxy
+	}
+
 	// Upstream resolvers
 	for _, v := range user_config.Upstream {
-		switch {
-		case strings.HasPrefix(v, "https://"):
-			config.Upstream = append(config.Upstream, resolver.NewDohResolver(v))
-		case strings.HasPrefix(v, "tls://"):
-			if !regexp.MustCompile(`:\d+$`).MatchString(v) {
-				v += ":853"
-			}
-			config.Upstream = append(config.Upstream, resolver.NewDotResolver(v))
-		default:
-			if !regexp.MustCompile(`:\d+$`).MatchString(v) {
-				v += ":53"
+		r, err := resolver.NewResolver(v, config.Dialer)
+		if err != nil {
+			return err
+		}
+		config.Upstream = append(config.Upstream, r)
+	}
+
+	// Upstream selection strategy - normalise the user config so that the
+	// strategy in use is reported by the API
+	strategy, err := resolver.NewStrategy(user_config.UpstreamStrategy, len(config.Upstream))
+	if err != nil {
+		return err
+	}
+	config.Strategy = strategy
+	user_config.UpstreamStrategy = strategy.String()
+
+	// Query deadline across all upstream attempts
+	if user_config.UpstreamTimeout != "" {
+		duration, err := time.ParseDuration(user_config.UpstreamTimeout)
+		if err != nil {
+			return err
+		}
+		if duration <= 0 {
+			return fmt.Errorf("Invalid upstream-timeout: %s", duration)
+		}
+		config.UpstreamTimeout = duration
+	}
+
+	// Response rcodes treated as upstream failure - normalise the user config
+	// so that the set in use is reported by the API
+	if user_config.FailureRcodes != "" {
+		rcodes, err := parseRcodes(user_config.FailureRcodes)
+		if err != nil {
+			return err
+		}
+		config.FailureRcodes = rcodes
+	}
+	user_config.FailureRcodes = formatRcodes(config.FailureRcodes)
+	config.FailureBestAnswer = user_config.FailureBestAnswer
+
+	// Forward zones - these share the global strategy (weighted weights are
+	// positional so do not apply and fall back to failover)
+	for domain, upstreams := range user_config.Forward {
+		name := dns.CanonicalName(strings.TrimPrefix(domain, "*."))
+		if _, ok := dns.IsDomainName(name); !ok || len(upstreams) == 0 {
+			return fmt.Errorf("Forward Error (%s): Invalid forward zone", domain)
+		}
+		zone := ForwardZone{Domain: name, Upstream: make([]resolver.Resolver, 0, len(upstreams))}
+		for _, v := range upstreams {
+			r, err := resolver.NewResolver(v, config.Dialer)
+			if err != nil {
+				return fmt.Errorf("Forward Error (%s): %s", domain, err)
 			}
-			config.Upstream = append(config.Upstream, resolver.NewUdpResolver(v))
+			zone.Upstream = append(zone.Upstream, r)
 		}
+		if strings.HasPrefix(user_config.UpstreamStrategy, "weighted:") {
+			log.Printf("Forward (%s): weighted strategy does not apply to forward zones - using failover", domain)
+			zone.Strategy = resolver.NewFailoverStrategy()
+		} else if zone.Strategy, err = resolver.NewStrategy(user_config.UpstreamStrategy, len(zone.Upstream)); err != nil {
+			return fmt.Errorf("Forward Error (%s): %s", domain, err)
+		}
+		config.Forward = append(config.Forward, zone)
+	}
+	sort.Slice(config.Forward, func(i, j int) bool {
+		ci, cj := dns.CountLabel(config.Forward[i].Domain), dns.CountLabel(config.Forward[j].Domain)
+		if ci != cj {
+			return ci > cj
+		}
+		return config.Forward[i].Domain < config.Forward[j].Domain
+	})
+
+	// Upstream health checks
+	if user_config.HealthInterval != "" {
+		duration, err := time.ParseDuration(user_config.HealthInterval)
+		if err != nil {
+			return err
+		}
+		if duration != 0 && duration < time.Second {
+			return fmt.Errorf("Invalid health-interval: %s", duration)
+		}
+		config.HealthInterval = duration
+	}
+	if user_config.HealthFailures < 0 || user_config.HealthRecovery < 0 {
+		return fmt.Errorf("Invalid health thresholds: %d/%d", user_config.HealthFailures, user_config.HealthRecovery)
+	}
+	if user_config.HealthFailures > 0 {
+		config.Health.Failures = user_config.HealthFailures
+	}
+	if user_config.HealthRecovery > 0 {
+		config.Health.Recovery = user_config.HealthRecovery
+	}
+	if user_config.HealthCooldown != "" {
+		duration, err := time.ParseDuration(user_config.HealthCooldown)
+		if err != nil {
+			return err
+		}
+		config.Health.Cooldown = duration
 	}
 
 	// Generate blocklist
@@ -96,6 +233,77 @@ func (user_config *UserConfig) GetProxyConfig(config *ProxyConfig) error {
 		return err
 	}
 
+	// Cache limits - normalise the user config so that the eviction policy
+	// in use is reported by the API
+	if user_config.CacheSize < 0 {
+		return fmt.Errorf("Invalid cache-size (%d): must be >= 0", user_config.CacheSize)
+	}
+	config.Cache.MaxEntries = user_config.CacheSize
+	if user_config.CacheMemory != "" {
+		size, err := parseSize(user_config.CacheMemory)
+		if err != nil {
+			return fmt.Errorf("Invalid cache-memory (%s): %s", user_config.CacheMemory, err)
+		}
+		config.Cache.MaxBytes = size
+	}
+	switch user_config.CacheEviction {
+	case "":
+	case cache.EvictLRU, cache.EvictLFU:
+		config.Cache.Eviction = user_config.CacheEviction
+	default:
+		return fmt.Errorf("Invalid cache-eviction (%s): must be lru or lfu", user_config.CacheEviction)
+	}
+	user_config.CacheEviction = config.Cache.Eviction
+
+	// Serve-stale window (expired entries are kept for this long)
+	if user_config.ServeStale != "" {
+		duration, err := time.ParseDuration(user_config.ServeStale)
+		if err != nil {
+			return err
+		}
+		if duration < 0 {
+			return fmt.Errorf("Invalid serve-stale: %s", duration)
+		}
+		config.Cache.StaleWindow = duration
+	}
+
+	// Negative caching bound (0 disables negative caching)
+	if user_config.NegativeMaxTTL != "" {
+		duration, err := time.ParseDuration(user_config.NegativeMaxTTL)
+		if err != nil {
+			return err
+		}
+		if duration < 0 {
+			return fmt.Errorf("Invalid negative-max-ttl: %s", duration)
+		}
+		config.Cache.NegativeMaxTTL = duration
+	}
+
+	// Cache persistence
+	config.CacheFile = user_config.CacheFile
+	if user_config.CacheSaveInterval != "" {
+		duration, err := time.ParseDuration(user_config.CacheSaveInterval)
+		if err != nil {
+			return err
+		}
+		if duration < 0 {
+			return fmt.Errorf("Invalid cache-save-interval: %s", duration)
+		}
+		config.CacheSaveInterval = duration
+	}
+
+	// Prefetch of popular entries in the last fraction of their TTL
+	if user_config.Prefetch < 0 || user_config.Prefetch >= 1 {
+		return fmt.Errorf("Invalid prefetch (%g): must be >= 0 and < 1", user_config.Prefetch)
+	}
+	config.Cache.Prefetch = user_config.Prefetch
+	if user_config.PrefetchHits > 0 {
+		config.Cache.PrefetchHits = user_config.PrefetchHits
+	}
+	if user_config.PrefetchRate > 0 {
+		config.Cache.PrefetchRate = user_config.PrefetchRate
+	}
+
 	// Local RRs
 	for _, v := range user_config.LocalRR {
 		if err := config.Cache.AddRRString(v, true, false); err != nil {
@@ -150,6 +358,60 @@ func (user_config *UserConfig) GetProxyConfig(config *ProxyConfig) error {
 		}
 	}
 
+	// EDNS Client Subnet - normalise the user config so that the policy in
+	// use is reported by the API
+	if user_config.Ecs != "" {
+		if err := parseEcs(user_config.Ecs, config); err != nil {
+			return err
+		}
+	}
+	user_config.Ecs = config.Ecs
+	if config.Ecs == EcsAdd {
+		user_config.Ecs = fmt.Sprintf("%s:%d,%d", EcsAdd, config.EcsPrefix4, config.EcsPrefix6)
+	}
+
+	// DNSSEC validation - the trust anchors in use (the root anchors unless
+	// configured) are reported back in the user config
+	if user_config.Dnssec {
+		if len(user_config.DnssecAnchor) == 0 {
+			user_config.DnssecAnchor = dnssec.RootAnchors
+		}
+		anchors := make([]dns.RR, 0, len(user_config.DnssecAnchor))
+		for _, v := range user_config.DnssecAnchor {
+			rr, err := dns.NewRR(v)
+			if err != nil {
+				return fmt.Errorf("Invalid dnssec-anchor (%s): %s", v, err)
+			}
+			if rr == nil {
+				return fmt.Errorf("Invalid dnssec-anchor (%s): no record", v)
+			}
+			anchors = append(anchors, rr)
+		}
+		validator, err := dnssec.NewValidator(anchors)
+		if err != nil {
+			return err
+		}
+		config.Dnssec = validator
+	}
+
+	// DNS rebinding protection - normalise the user config so that the
+	// policy in use is reported by the API
+	switch user_config.Rebind {
+	case "":
+	case RebindOff, RebindDrop, RebindNxdomain:
+		config.Rebind = user_config.Rebind
+	default:
+		return fmt.Errorf("Invalid rebind (%s): must be off, drop or nxdomain", user_config.Rebind)
+	}
+	user_config.Rebind = config.Rebind
+	for _, v := range user_config.RebindAllow {
+		name := dns.CanonicalName(strings.TrimPrefix(v, "*."))
+		if _, ok := dns.IsDomainName(name); !ok {
+			return fmt.Errorf("Invalid rebind-allow (%s): invalid domain", v)
+		}
+		config.RebindAllow = append(config.RebindAllow, name)
+	}
+
 	// API
 	config.Api = user_config.Api
 	if user_config.ApiBind != "" {
@@ -212,6 +474,133 @@ func (user_config *UserConfig) GetProxyConfig(config *ProxyConfig) error {
 	return nil
 }
 
+// Redacted returns a copy of the user config with the passwords of proxy
+// URLs (and of any upstream URL) masked, for reporting by the API.
+func (user_config *UserConfig) Redacted() UserConfig {
+	out := *user_config
+	out.Proxy = redactURL(user_config.Proxy)
+	out.Upstream = make([]string, len(user_config.Upstream))
+	for i, v := range user_config.Upstream {
+		out.Upstream[i] = redactUpstream(v)
+	}
+	out.Forward = make(map[string][]string, len(user_config.Forward))
+	for domain, upstreams := range user_config.Forward {
+		out.Forward[domain] = make([]string, len(upstreams))
+		for i, v := range upstreams {
+			out.Forward[domain][i] = redactUpstream(v)
+		}
+	}
+	return out
+}
+
+// redactURL masks the password in a URL (other strings are unchanged).
+func redactURL(s string) string {
+	if u, err := url.Parse(s); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return s
+}
+
+// redactUpstream masks the passwords in an upstream spec and its 'proxy'
+// option.
+func redactUpstream(spec string) string {
+	upstream, fragment, found := strings.Cut(spec, "#")
+	upstream = redactURL(upstream)
+	if !found {
+		return upstream
+	}
+	options := strings.Split(fragment, "&")
+	for i, kv := range options {
+		if k, v, _ := strings.Cut(kv, "="); k == "proxy" {
+			if value, err := url.PathUnescape(v); err == nil {
+				options[i] = "proxy=" + redactURL(value)
+			}
+		}
+	}
+	return upstream + "#" + strings.Join(options, "&")
+}
+
+// parseRcodes parses a comma separated list of rcode names (e.g.
+// SERVFAIL,REFUSED) or "none" for an empty set.
+func parseRcodes(spec string) (map[int]bool, error) {
+	rcodes := make(map[int]bool)
+	if strings.EqualFold(strings.TrimSpace(spec), "none") {
+		return rcodes, nil
+	}
+	for _, v := range strings.Split(spec, ",") {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(strings.TrimSpace(v))]
+		if !ok || rcode == dns.RcodeSuccess {
+			return nil, fmt.Errorf("Invalid failure-rcodes (%s): unknown rcode %s", spec, v)
+		}
+		rcodes[rcode] = true
+	}
+	return rcodes, nil
+}
+
+func formatRcodes(rcodes map[int]bool) string {
+	if len(rcodes) == 0 {
+		return "none"
+	}
+	codes := make([]int, 0, len(rcodes))
+	for rcode := range rcodes {
+		codes = append(codes, rcode)
+	}
+	sort.Ints(codes)
+	names := make([]string, len(codes))
+	for i, rcode := range codes {
+		names[i] = dns.RcodeToString[rcode]
+	}
+	return strings.Join(names, ",")
+}
+
+// parseSize parses a byte count with an optional k, M or G suffix (powers of
+// 1024).
+func parseSize(spec string) (int, error) {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(spec, "k"), strings.HasSuffix(spec, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(spec, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(spec, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		spec = spec[:len(spec)-1]
+	}
+	n, err := strconv.Atoi(spec)
+	if err != nil || n < 0 {
+		return 0, errors.New("must be <bytes>[k|M|G]")
+	}
+	return n * multiplier, nil
+}
+
+// parseEcs parses an ECS policy spec: forward, strip or add[:<v4>,<v6>]
+// where v4/v6 are the source prefix lengths (0 sends no ECS for that family).
+func parseEcs(spec string, config *ProxyConfig) error {
+	policy, arg, hasArg := strings.Cut(spec, ":")
+	switch policy {
+	case EcsForward, EcsStrip:
+		if hasArg {
+			return fmt.Errorf("Invalid ecs (%s): unexpected prefix lengths", spec)
+		}
+	case EcsAdd:
+		if hasArg {
+			v4, v6, ok := strings.Cut(arg, ",")
+			prefix4, err4 := strconv.Atoi(strings.TrimSpace(v4))
+			prefix6, err6 := strconv.Atoi(strings.TrimSpace(v6))
+			if !ok || err4 != nil || err6 != nil || prefix4 < 0 || prefix4 > 32 || prefix6 < 0 || prefix6 > 128 {
+				return fmt.Errorf("Invalid ecs (%s): prefix lengths must be <0-32>,<0-128>", spec)
+			}
+			config.EcsPrefix4, config.EcsPrefix6 = prefix4, prefix6
+		}
+	default:
+		return fmt.Errorf("Invalid ecs (%s): must be forward, strip or add", spec)
+	}
+	config.Ecs = policy
+	return nil
+}
+
 func (user_config *UserConfig) UpdateBlockList(bl *blocklist.BlockList) error {
 
 	// Block entries
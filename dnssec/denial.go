@@ -0,0 +1,276 @@
+package dnssec
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// canonicalCompare orders names in canonical DNS order (RFC 4034 6.1):
+// label by label from the right, comparing the (lower case) label octets.
+func canonicalCompare(a, b string) int {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(labelOctets(la[i]), labelOctets(lb[j])); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// labelOctets returns the lower case wire octets of a label in presentation
+// format (decoding \X and \DDD escapes).
+func labelOctets(label string) string {
+	out := make([]byte, 0, len(label))
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if c == '\\' && i+1 < len(label) {
+			if i+3 < len(label) && isDigit(label[i+1]) && isDigit(label[i+2]) && isDigit(label[i+3]) {
+				c = (label[i+1]-'0')*100 + (label[i+2]-'0')*10 + (label[i+3] - '0')
+				i += 3
+			} else {
+				c = label[i+1]
+				i++
+			}
+		}
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		out = append(out, c)
+	}
+	return string(out)
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+// wildcard returns the wildcard name below name.
+func wildcard(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, v := range bitmap {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// delegationPoint reports whether bitmap is that of a delegation (NS without
+// SOA), which is signed by the parent but says nothing about the data in the
+// child zone.
+func delegationPoint(bitmap []uint16) bool {
+	return hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA)
+}
+
+// cutPoint reports whether bitmap is that of a delegation or DNAME, whose
+// NSEC/NSEC3 records cannot prove anything about names below them (RFC 6840
+// 4.1, RFC 5155 8.3).
+func cutPoint(bitmap []uint16) bool {
+	return delegationPoint(bitmap) || hasType(bitmap, dns.TypeDNAME)
+}
+
+// noData reports whether the matching NSEC/NSEC3 bitmap for a name proves
+// that it has no records of qtype (or a CNAME). A parent-side record at a
+// delegation only does so for DS.
+func noData(bitmap []uint16, qtype uint16) bool {
+	if qtype != dns.TypeDS && delegationPoint(bitmap) {
+		return false
+	}
+	return !hasType(bitmap, qtype) && !hasType(bitmap, dns.TypeCNAME)
+}
+
+// ── NSEC (RFC 4035 5.4) ──
+
+// nsecCovers reports whether name falls strictly between the owner and next
+// name of n (the last NSEC of a zone wraps round to the apex).
+func nsecCovers(n *dns.NSEC, name string) bool {
+	owner, next := n.Hdr.Name, n.NextDomain
+	after := canonicalCompare(owner, name) < 0
+	if canonicalCompare(owner, next) < 0 {
+		return after && canonicalCompare(name, next) < 0
+	}
+	// Last NSEC - next is the apex, so anything after owner in the zone
+	return after && dns.IsSubDomain(next, name)
+}
+
+func matchingNSEC(nsec []*dns.NSEC, name string) *dns.NSEC {
+	for _, n := range nsec {
+		if strings.EqualFold(n.Hdr.Name, name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// coveringNSEC returns the NSEC covering name, ignoring those owned by a
+// delegation or DNAME above name.
+func coveringNSEC(nsec []*dns.NSEC, name string) *dns.NSEC {
+	for _, n := range nsec {
+		if nsecCovers(n, name) && !(cutPoint(n.TypeBitMap) && dns.IsSubDomain(n.Hdr.Name, name)) {
+			return n
+		}
+	}
+	return nil
+}
+
+// nsecEncloser returns the closest encloser of name proven by the covering
+// NSEC n: the longest ancestor shared with its owner or next name.
+func nsecEncloser(n *dns.NSEC, name string) string {
+	labels := max(dns.CompareDomainName(name, n.Hdr.Name), dns.CompareDomainName(name, n.NextDomain))
+	return suffix(name, labels)
+}
+
+// nsecNameError proves that name does not exist and that there is no
+// wildcard at its closest encloser.
+func nsecNameError(nsec []*dns.NSEC, name string) bool {
+	n := coveringNSEC(nsec, name)
+	if n == nil {
+		return false
+	}
+	return coveringNSEC(nsec, wildcard(nsecEncloser(n, name))) != nil
+}
+
+// nsecNoData proves that name exists without records of qtype (or a CNAME),
+// either directly, as an empty non-terminal or from a wildcard.
+func nsecNoData(nsec []*dns.NSEC, name string, qtype uint16) bool {
+	if n := matchingNSEC(nsec, name); n != nil {
+		return noData(n.TypeBitMap, qtype)
+	}
+	n := coveringNSEC(nsec, name)
+	if n == nil {
+		return false
+	}
+	if dns.IsSubDomain(name, n.NextDomain) {
+		// Empty non-terminal
+		return true
+	}
+	w := matchingNSEC(nsec, wildcard(nsecEncloser(n, name)))
+	return w != nil && noData(w.TypeBitMap, qtype)
+}
+
+// nsecDelegation returns the delegation status of name proven by the NSEC
+// records for a DS query (ok is false if there is no proof).
+func nsecDelegation(nsec []*dns.NSEC, name string) (delegation, bool) {
+	if n := matchingNSEC(nsec, name); n != nil {
+		switch {
+		case hasType(n.TypeBitMap, dns.TypeDS), hasType(n.TypeBitMap, dns.TypeSOA):
+			// DS hidden, or a denial from the child zone
+			return 0, false
+		case hasType(n.TypeBitMap, dns.TypeNS):
+			return delegationInsecure, true
+		}
+		return delegationNone, true
+	}
+	if coveringNSEC(nsec, name) != nil {
+		return delegationNone, true
+	}
+	return 0, false
+}
+
+// ── NSEC3 (RFC 5155 8) ──
+
+// nsec3MaxIterations is the iteration count above which NSEC3 records are
+// treated as insecure rather than hashed (RFC 9276 3.2).
+const nsec3MaxIterations = 150
+
+// nsec3Excessive reports whether any of the NSEC3 records has more than
+// nsec3MaxIterations iterations.
+func nsec3Excessive(nsec3 []*dns.NSEC3) bool {
+	for _, n := range nsec3 {
+		if n.Iterations > nsec3MaxIterations {
+			return true
+		}
+	}
+	return false
+}
+
+func matchingNSEC3(nsec3 []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, n := range nsec3 {
+		if n.Match(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+func coveringNSEC3(nsec3 []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, n := range nsec3 {
+		if n.Cover(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// closestEncloser returns the closest provable encloser of name and the next
+// closer name (one label longer, towards name), which must be covered for
+// the proof to hold. An encloser above name must not be a delegation or
+// DNAME (RFC 5155 8.3).
+func closestEncloser(nsec3 []*dns.NSEC3, name string) (encloser, nextCloser string, ok bool) {
+	labels := dns.CountLabel(name)
+	for n := labels; n >= 0; n-- {
+		candidate := suffix(name, n)
+		match := matchingNSEC3(nsec3, candidate)
+		if match == nil {
+			continue
+		}
+		if n == labels {
+			return candidate, "", true
+		}
+		if cutPoint(match.TypeBitMap) {
+			return "", "", false
+		}
+		nextCloser = suffix(name, n+1)
+		return candidate, nextCloser, coveringNSEC3(nsec3, nextCloser) != nil
+	}
+	return "", "", false
+}
+
+func nsec3NameError(nsec3 []*dns.NSEC3, name string) bool {
+	encloser, nextCloser, ok := closestEncloser(nsec3, name)
+	return ok && nextCloser != "" && coveringNSEC3(nsec3, wildcard(encloser)) != nil
+}
+
+func nsec3NoData(nsec3 []*dns.NSEC3, name string, qtype uint16) bool {
+	if n := matchingNSEC3(nsec3, name); n != nil {
+		return noData(n.TypeBitMap, qtype)
+	}
+	encloser, nextCloser, ok := closestEncloser(nsec3, name)
+	if !ok || nextCloser == "" {
+		return false
+	}
+	if qtype == dns.TypeDS && coveringNSEC3(nsec3, nextCloser).Flags&1 == 1 {
+		// Opt-out (RFC 5155 8.6)
+		return true
+	}
+	w := matchingNSEC3(nsec3, wildcard(encloser))
+	return w != nil && noData(w.TypeBitMap, qtype)
+}
+
+// nsec3Delegation returns the delegation status of name proven by the NSEC3
+// records for a DS query (ok is false if there is no proof).
+func nsec3Delegation(nsec3 []*dns.NSEC3, name string) (delegation, bool) {
+	if n := matchingNSEC3(nsec3, name); n != nil {
+		switch {
+		case hasType(n.TypeBitMap, dns.TypeDS), hasType(n.TypeBitMap, dns.TypeSOA):
+			return 0, false
+		case hasType(n.TypeBitMap, dns.TypeNS):
+			return delegationInsecure, true
+		}
+		return delegationNone, true
+	}
+	_, nextCloser, ok := closestEncloser(nsec3, name)
+	if !ok || nextCloser == "" {
+		return 0, false
+	}
+	if coveringNSEC3(nsec3, nextCloser).Flags&1 == 1 {
+		// Opt-out span - may hide an unsigned delegation (RFC 5155 8.6)
+		return delegationInsecure, true
+	}
+	return delegationNone, true
+}
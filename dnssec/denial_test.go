@@ -0,0 +1,86 @@
+package dnssec
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCanonicalOrder(t *testing.T) {
+
+	// RFC 4034 6.1
+	expected := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.",
+		"zABC.a.EXAMPLE.", "z.example.", "\\001.z.example.", "*.z.example.", "\\200.z.example."}
+	names := append([]string{}, expected...)
+	sort.Slice(names, func(i, j int) bool { return names[i] > names[j] })
+	sort.SliceStable(names, func(i, j int) bool { return canonicalCompare(names[i], names[j]) < 0 })
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("Order: %v", names)
+			break
+		}
+	}
+}
+
+func TestNsecCovers(t *testing.T) {
+
+	nsec := func(owner, next string) *dns.NSEC {
+		return &dns.NSEC{Hdr: dns.RR_Header{Name: owner}, NextDomain: next}
+	}
+	for _, tc := range []struct {
+		owner, next, name string
+		covers            bool
+	}{
+		{"a.example.", "d.example.", "b.example.", true},
+		{"a.example.", "d.example.", "x.b.example.", true},
+		{"a.example.", "d.example.", "a.example.", false},
+		{"a.example.", "d.example.", "e.example.", false},
+		{"z.example.", "example.", "zz.example.", true},
+		{"z.example.", "example.", "b.example.", false},
+		{"z.example.", "example.", "other.", false},
+	} {
+		if nsecCovers(nsec(tc.owner, tc.next), tc.name) != tc.covers {
+			t.Errorf("%s -> %s covers %s: expected %t", tc.owner, tc.next, tc.name, tc.covers)
+		}
+	}
+}
+
+func TestNsecCutPoint(t *testing.T) {
+
+	nsec := func(owner, next string, types ...uint16) *dns.NSEC {
+		return &dns.NSEC{Hdr: dns.RR_Header{Name: owner}, NextDomain: next, TypeBitMap: types}
+	}
+	// Parent side of a delegation: proves nothing below (or at) the cut
+	deleg := []*dns.NSEC{nsec("sub.example.", "z.example.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC)}
+	if nsecNameError(deleg, "www.sub.example.") {
+		t.Error("Delegation NSEC proves NXDOMAIN below cut")
+	}
+	if nsecNoData(deleg, "sub.example.", dns.TypeA) {
+		t.Error("Delegation NSEC proves NODATA for A at cut")
+	}
+	if !nsecNoData(deleg, "sub.example.", dns.TypeDS) {
+		t.Error("Delegation NSEC does not prove NODATA for DS")
+	}
+	dname := []*dns.NSEC{nsec("d.example.", "z.example.", dns.TypeDNAME, dns.TypeRRSIG, dns.TypeNSEC)}
+	if nsecNameError(dname, "www.d.example.") {
+		t.Error("DNAME NSEC proves NXDOMAIN below DNAME")
+	}
+	apex := []*dns.NSEC{nsec("example.", "z.example.", dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC)}
+	if !nsecNoData(apex, "example.", dns.TypeA) {
+		t.Error("Apex NSEC does not prove NODATA")
+	}
+}
+
+func TestNsec3Excessive(t *testing.T) {
+
+	nsec3 := func(iterations uint16) []*dns.NSEC3 {
+		return []*dns.NSEC3{{Hdr: dns.RR_Header{Name: "x.example."}, Iterations: iterations}}
+	}
+	if nsec3Excessive(nsec3(nsec3MaxIterations)) {
+		t.Errorf("%d iterations excessive", nsec3MaxIterations)
+	}
+	if !nsec3Excessive(nsec3(nsec3MaxIterations + 1)) {
+		t.Errorf("%d iterations not excessive", nsec3MaxIterations+1)
+	}
+}
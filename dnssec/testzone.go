@@ -0,0 +1,212 @@
+package dnssec
+
+import (
+	"context"
+	"crypto"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TestZone is a zone served by the authoritative stand-in returned by
+// TestExchange, signed on the fly (with NSEC or NSEC3 denial) unless it was
+// created unsigned.
+type TestZone struct {
+	Apex   string
+	key    *dns.DNSKEY
+	signer crypto.Signer
+	nsec3  bool
+	rrs    []dns.RR
+}
+
+// NewTestZone creates a zone with SOA, NS (and DNSKEY if signed) records at
+// the apex and the records given in presentation format.
+func NewTestZone(t *testing.T, apex string, signed, nsec3 bool, records ...string) *TestZone {
+	z := &TestZone{Apex: dns.Fqdn(apex), nsec3: nsec3}
+	ns, admin := dns.Fqdn("ns."+strings.TrimSuffix(z.Apex, ".")), dns.Fqdn("admin."+strings.TrimSuffix(z.Apex, "."))
+	z.Add(t, z.Apex+" 3600 IN SOA "+ns+" "+admin+" 1 3600 600 86400 300", z.Apex+" 3600 IN NS "+ns)
+	if signed {
+		z.key = &dns.DNSKEY{
+			Hdr:   dns.RR_Header{Name: z.Apex, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags: dns.ZONE | dns.SEP, Protocol: 3, Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := z.key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.signer = priv.(crypto.Signer)
+		z.rrs = append(z.rrs, z.key)
+	}
+	z.Add(t, records...)
+	return z
+}
+
+// Add adds records (in presentation format) to the zone.
+func (z *TestZone) Add(t *testing.T, records ...string) {
+	for _, v := range records {
+		rr, err := dns.NewRR(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.rrs = append(z.rrs, rr)
+	}
+}
+
+// DS returns the DS record of the zone key (for the parent zone or as a
+// trust anchor).
+func (z *TestZone) DS() *dns.DS {
+	return z.key.ToDS(dns.SHA256)
+}
+
+// TestExchange returns an ExchangeFunc answering from the most specific of
+// zones (the parent zone for DS queries at an apex), following CNAMEs within
+// the zone.
+func TestExchange(zones ...*TestZone) ExchangeFunc {
+	return func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+		name, qtype := dns.CanonicalName(q.Question[0].Name), q.Question[0].Qtype
+		var zone *TestZone
+		for _, z := range zones {
+			if !dns.IsSubDomain(z.Apex, name) || (qtype == dns.TypeDS && z.Apex == name && name != ".") {
+				continue
+			}
+			if zone == nil || dns.CountLabel(z.Apex) > dns.CountLabel(zone.Apex) {
+				zone = z
+			}
+		}
+		out := new(dns.Msg)
+		out.SetReply(q)
+		if zone == nil {
+			out.Rcode = dns.RcodeRefused
+			return out, nil
+		}
+		zone.answer(out, name, qtype)
+		return out, nil
+	}
+}
+
+func (z *TestZone) answer(out *dns.Msg, name string, qtype uint16) {
+	if rrs := z.rrset(name, qtype); len(rrs) > 0 {
+		out.Answer = append(out.Answer, z.sign(rrs)...)
+		return
+	}
+	if cname := z.rrset(name, dns.TypeCNAME); len(cname) > 0 {
+		out.Answer = append(out.Answer, z.sign(cname)...)
+		if target := cname[0].(*dns.CNAME).Target; dns.IsSubDomain(z.Apex, target) {
+			z.answer(out, dns.CanonicalName(target), qtype)
+		}
+		return
+	}
+	if !z.exists(name) {
+		if w := z.rrset(wildcard(parent(name)), qtype); len(w) > 0 {
+			// Wildcard expansion - signed as the wildcard, with the denial
+			// of the name itself
+			signed := z.sign(w)
+			for _, rr := range signed {
+				rr = dns.Copy(rr)
+				rr.Header().Name = name
+				out.Answer = append(out.Answer, rr)
+			}
+			out.Ns = append(out.Ns, z.denial()...)
+			return
+		}
+		out.Rcode = dns.RcodeNameError
+	}
+	out.Ns = append(out.Ns, z.sign(z.rrset(z.Apex, dns.TypeSOA))...)
+	out.Ns = append(out.Ns, z.denial()...)
+}
+
+func (z *TestZone) rrset(name string, qtype uint16) []dns.RR {
+	var out []dns.RR
+	for _, rr := range z.rrs {
+		if h := rr.Header(); dns.CanonicalName(h.Name) == name && h.Rrtype == qtype {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// exists reports whether name has records or is an empty non-terminal.
+func (z *TestZone) exists(name string) bool {
+	for _, rr := range z.rrs {
+		if dns.IsSubDomain(name, rr.Header().Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (z *TestZone) sign(rrs []dns.RR) []dns.RR {
+	if z.key == nil || len(rrs) == 0 {
+		return rrs
+	}
+	now := timeNow()
+	sig := &dns.RRSIG{
+		Algorithm:  z.key.Algorithm,
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.Apex,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	sig.Hdr.Ttl = rrs[0].Header().Ttl
+	if err := sig.Sign(z.signer, rrs); err != nil {
+		panic(err)
+	}
+	return append(rrs, sig)
+}
+
+// denial returns the (signed) NSEC or NSEC3 chain of the zone.
+func (z *TestZone) denial() []dns.RR {
+	if z.key == nil {
+		return nil
+	}
+	types := make(map[string][]uint16)
+	for _, rr := range z.rrs {
+		name := dns.CanonicalName(rr.Header().Name)
+		types[name] = append(types[name], rr.Header().Rrtype)
+	}
+	var out []dns.RR
+	if z.nsec3 {
+		hashes := make([]string, 0, len(types))
+		bitmaps := make(map[string][]uint16)
+		for name, t := range types {
+			hash := dns.HashName(name, dns.SHA1, 0, "")
+			hashes = append(hashes, hash)
+			bitmaps[hash] = bitmap(append(t, dns.TypeRRSIG))
+		}
+		sort.Strings(hashes)
+		for i, hash := range hashes {
+			out = append(out, z.sign([]dns.RR{&dns.NSEC3{
+				Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + "." + z.Apex, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+				Hash:       dns.SHA1,
+				NextDomain: hashes[(i+1)%len(hashes)],
+				HashLength: 20,
+				TypeBitMap: bitmaps[hash],
+			}})...)
+		}
+		return out
+	}
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return canonicalCompare(names[i], names[j]) < 0 })
+	for i, name := range names {
+		out = append(out, z.sign([]dns.RR{&dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: bitmap(append(types[name], dns.TypeRRSIG, dns.TypeNSEC)),
+		}})...)
+	}
+	return out
+}
+
+// bitmap returns the sorted unique types.
+func bitmap(types []uint16) []uint16 {
+	types = slices.Clone(types)
+	slices.Sort(types)
+	return slices.Compact(types)
+}
@@ -0,0 +1,635 @@
+// Package dnssec validates upstream responses against a chain of trust built
+// from configured trust anchors (RFC 4033-4035, NSEC3 RFC 5155).
+package dnssec
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RootAnchors are the DS records of the IANA root zone KSKs
+// (https://data.iana.org/root-anchors/root-anchors.xml).
+var RootAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	// maxCacheTTL bounds the time validated keys and delegations are cached
+	maxCacheTTL = time.Hour
+
+	// maxCache is the number of cached zones (or delegations) above which
+	// expired entries are swept
+	maxCache = 10000
+)
+
+// Allow mocking of time in tests
+var timeNow = time.Now
+
+// Supported DNSKEY algorithms and DS digest types. Zones signed only with
+// other algorithms are treated as insecure (RFC 4035 5.2).
+var (
+	supportedAlgorithms = map[uint8]bool{
+		dns.RSASHA1: true, dns.RSASHA1NSEC3SHA1: true, dns.RSASHA256: true, dns.RSASHA512: true,
+		dns.ECDSAP256SHA256: true, dns.ECDSAP384SHA384: true, dns.ED25519: true,
+	}
+	supportedDigests = map[uint8]bool{dns.SHA1: true, dns.SHA256: true, dns.SHA384: true}
+)
+
+// ExchangeFunc sends a query upstream. The validator uses it to look up the
+// DNSKEY and DS records of the chain of trust.
+type ExchangeFunc func(ctx context.Context, q *dns.Msg) (*dns.Msg, error)
+
+// Error is a validation failure (a bogus response). Code is the extended DNS
+// error (RFC 8914) returned to the client.
+type Error struct {
+	Code   uint16
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("DNSSEC %s: %s", dns.ExtendedErrorCodeToString[e.Code], e.Reason)
+}
+
+func bogus(code uint16, format string, args ...any) *Error {
+	return &Error{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// delegation is the DNSSEC status of a name in its parent zone
+type delegation int
+
+const (
+	delegationSecure   delegation = iota // validated DS records
+	delegationInsecure                   // provably unsigned
+	delegationNone                       // not a zone cut (name is inside a signed zone)
+)
+
+type keyEntry struct {
+	keys    []*dns.DNSKEY // nil if the zone is insecure
+	expires time.Time
+}
+
+type dsEntry struct {
+	ds      []*dns.DS
+	state   delegation
+	expires time.Time
+}
+
+// Validator validates responses from a chain of trust starting at its trust
+// anchors. Validated zone keys and delegations are cached for their TTL
+// (bounded by maxCacheTTL). Names with no trust anchor above them are
+// insecure.
+type Validator struct {
+	anchors map[string][]dns.RR // DS or DNSKEY records by zone
+
+	mu   sync.Mutex
+	keys map[string]*keyEntry // validated DNSKEYs by (lower case) zone
+	ds   map[string]*dsEntry  // delegation status by (lower case) name
+}
+
+// NewValidator returns a validator for the trust anchors (DS or DNSKEY
+// records).
+func NewValidator(anchors []dns.RR) (*Validator, error) {
+	v := &Validator{
+		anchors: make(map[string][]dns.RR),
+		keys:    make(map[string]*keyEntry),
+		ds:      make(map[string]*dsEntry),
+	}
+	for _, rr := range anchors {
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+		default:
+			return nil, fmt.Errorf("Invalid trust anchor (%s): must be DS or DNSKEY", rr)
+		}
+		zone := dns.CanonicalName(rr.Header().Name)
+		v.anchors[zone] = append(v.anchors[zone], rr)
+	}
+	return v, nil
+}
+
+// Validate checks msg, the response to a query sent with the DO and CD bits
+// set, and reports whether it is secure. An insecure response (from an
+// unsigned zone or one with no trust anchor) returns false with no error and
+// a bogus response returns an *Error. Other errors are lookup failures.
+func (v *Validator) Validate(ctx context.Context, exchange ExchangeFunc, msg *dns.Msg) (bool, error) {
+	if len(msg.Question) != 1 || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return false, nil
+	}
+	question := msg.Question[0]
+
+	// Answer RRsets (synthesised DNAME CNAMEs are not signed)
+	secure := true
+	var wildcards []*rrset
+	for _, set := range rrsets(msg.Answer) {
+		if set.rrtype == dns.TypeCNAME && underDname(msg.Answer, set.name) {
+			continue
+		}
+		ok, sig, err := v.verifySet(ctx, exchange, set)
+		if err != nil {
+			return false, err
+		}
+		secure = secure && ok
+		if ok && int(sig.Labels) < dns.CountLabel(set.name) {
+			set.labels = int(sig.Labels)
+			wildcards = append(wildcards, set)
+		}
+	}
+
+	// The answer (or denial) is for the end of any CNAME chain
+	target := question.Name
+	if question.Qtype != dns.TypeCNAME {
+		target = chainTarget(msg.Answer, target)
+	}
+	nodata := msg.Rcode == dns.RcodeSuccess && !hasAnswer(msg.Answer, target, question.Qtype)
+	if msg.Rcode != dns.RcodeNameError && !nodata && len(wildcards) == 0 {
+		return secure, nil
+	}
+
+	// Denial of existence - also required for wildcard answers to prove that
+	// the name itself does not exist
+	nsec, nsec3, ok, err := v.denial(ctx, exchange, msg.Ns, target)
+	if err != nil || !ok {
+		return false, err
+	}
+	for _, set := range wildcards {
+		nextCloser := suffix(set.name, set.labels+1)
+		if coveringNSEC(nsec, set.name) == nil && coveringNSEC3(nsec3, nextCloser) == nil {
+			return false, bogus(dns.ExtendedErrorCodeNSECMissing, "%s: no proof for wildcard answer", set.name)
+		}
+	}
+	switch {
+	case msg.Rcode == dns.RcodeNameError:
+		if !nsecNameError(nsec, target) && !nsec3NameError(nsec3, target) {
+			return false, bogus(dns.ExtendedErrorCodeNSECMissing, "%s: no proof of non-existence", target)
+		}
+	case nodata:
+		if !nsecNoData(nsec, target, question.Qtype) && !nsec3NoData(nsec3, target, question.Qtype) {
+			return false, bogus(dns.ExtendedErrorCodeNSECMissing, "%s %s: no proof of non-existence", target, dns.TypeToString[question.Qtype])
+		}
+	}
+	return secure, nil
+}
+
+// verifySet validates an RRset, returning the signature that verified it.
+// An unsigned RRset is insecure if its name is below an insecure delegation
+// and bogus otherwise.
+func (v *Validator) verifySet(ctx context.Context, exchange ExchangeFunc, set *rrset) (bool, *dns.RRSIG, error) {
+	if len(set.sigs) == 0 {
+		insecure, err := v.insecure(ctx, exchange, set.name)
+		if err == nil && !insecure {
+			err = bogus(dns.ExtendedErrorCodeRRSIGsMissing, "%s %s: missing signature", set.name, dns.TypeToString[set.rrtype])
+		}
+		return false, nil, err
+	}
+	signer := dns.CanonicalName(set.sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, set.name) {
+		return false, nil, bogus(dns.ExtendedErrorCodeDNSBogus, "%s %s: signer %s is not a parent", set.name, dns.TypeToString[set.rrtype], signer)
+	}
+	keys, err := v.zoneKeys(ctx, exchange, signer)
+	if err != nil || keys == nil {
+		return false, nil, err
+	}
+	sig, err := verifyRRset(set.rrs, set.sigs, keys)
+	return err == nil, sig, err
+}
+
+// denial returns the validated NSEC/NSEC3 records of the authority section.
+// secure is false if they are from an insecure zone, use too many NSEC3
+// iterations (or there are none and target is below an insecure delegation).
+func (v *Validator) denial(ctx context.Context, exchange ExchangeFunc, authority []dns.RR, target string) (nsec []*dns.NSEC, nsec3 []*dns.NSEC3, secure bool, err error) {
+	for _, set := range rrsets(authority) {
+		if set.rrtype != dns.TypeNSEC && set.rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		ok, _, err := v.verifySet(ctx, exchange, set)
+		if err != nil || !ok {
+			return nil, nil, false, err
+		}
+		for _, rr := range set.rrs {
+			switch r := rr.(type) {
+			case *dns.NSEC:
+				nsec = append(nsec, r)
+			case *dns.NSEC3:
+				nsec3 = append(nsec3, r)
+			}
+		}
+	}
+	if nsec3Excessive(nsec3) {
+		return nil, nil, false, nil
+	}
+	if len(nsec) == 0 && len(nsec3) == 0 {
+		insecure, err := v.insecure(ctx, exchange, target)
+		if err == nil && !insecure {
+			err = bogus(dns.ExtendedErrorCodeNSECMissing, "%s: missing NSEC records", target)
+		}
+		return nil, nil, false, err
+	}
+	return nsec, nsec3, true, nil
+}
+
+// insecure reports whether name is in an unsigned zone (below an insecure
+// delegation or a zone with no supported algorithm).
+func (v *Validator) insecure(ctx context.Context, exchange ExchangeFunc, name string) (bool, error) {
+	_, state, err := v.delegation(ctx, exchange, name)
+	if err != nil {
+		return false, err
+	}
+	switch state {
+	case delegationInsecure:
+		return true, nil
+	case delegationNone:
+		return false, nil
+	}
+	keys, err := v.zoneKeys(ctx, exchange, name)
+	return keys == nil, err
+}
+
+// zoneKeys returns the validated DNSKEYs of zone (nil if it is insecure).
+func (v *Validator) zoneKeys(ctx context.Context, exchange ExchangeFunc, zone string) ([]*dns.DNSKEY, error) {
+	zone = dns.CanonicalName(zone)
+	v.mu.Lock()
+	entry, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok && timeNow().Before(entry.expires) {
+		return entry.keys, nil
+	}
+
+	// Trust anchors, or the DS records from the parent
+	var ds []*dns.DS
+	var trusted []*dns.DNSKEY
+	if anchors, ok := v.anchors[zone]; ok {
+		for _, rr := range anchors {
+			switch a := rr.(type) {
+			case *dns.DS:
+				ds = append(ds, a)
+			case *dns.DNSKEY:
+				trusted = append(trusted, a)
+			}
+		}
+	} else if zone == "." {
+		v.storeKeys(zone, nil, maxCacheTTL)
+		return nil, nil
+	} else {
+		parentDS, state, err := v.delegation(ctx, exchange, zone)
+		if err != nil {
+			return nil, err
+		}
+		switch state {
+		case delegationInsecure:
+			v.storeKeys(zone, nil, maxCacheTTL)
+			return nil, nil
+		case delegationNone:
+			return nil, bogus(dns.ExtendedErrorCodeDNSKEYMissing, "%s: signer is not a zone", zone)
+		}
+		ds = parentDS
+	}
+	supported := ds[:0:0]
+	for _, d := range ds {
+		if supportedAlgorithms[d.Algorithm] && supportedDigests[d.DigestType] {
+			supported = append(supported, d)
+		}
+	}
+	if len(supported) == 0 && len(trusted) == 0 {
+		v.storeKeys(zone, nil, maxCacheTTL)
+		return nil, nil
+	}
+
+	// DNSKEY RRset, self-signed by a key matching the DS records or anchors
+	resp, err := v.query(ctx, exchange, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var set *rrset
+	for _, s := range rrsets(resp.Answer) {
+		if s.rrtype == dns.TypeDNSKEY && s.name == zone {
+			set = s
+		}
+	}
+	if set == nil {
+		return nil, bogus(dns.ExtendedErrorCodeDNSKEYMissing, "%s: no DNSKEY records", zone)
+	}
+	var all, keys []*dns.DNSKEY
+	for _, rr := range set.rrs {
+		key := rr.(*dns.DNSKEY)
+		all = append(all, key)
+		if matchDS(key, supported) || matchKey(key, trusted) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, bogus(dns.ExtendedErrorCodeDNSKEYMissing, "%s: no DNSKEY matches the DS records", zone)
+	}
+	if _, err := verifyRRset(set.rrs, set.sigs, keys); err != nil {
+		return nil, err
+	}
+	v.storeKeys(zone, all, minTTL(set.rrs))
+	return all, nil
+}
+
+// delegation returns the DNSSEC status of name in its parent zone, from the
+// (validated) DS records or their denial.
+func (v *Validator) delegation(ctx context.Context, exchange ExchangeFunc, name string) ([]*dns.DS, delegation, error) {
+	name = dns.CanonicalName(name)
+	v.mu.Lock()
+	entry, ok := v.ds[name]
+	v.mu.Unlock()
+	if ok && timeNow().Before(entry.expires) {
+		return entry.ds, entry.state, nil
+	}
+
+	resp, err := v.query(ctx, exchange, name, dns.TypeDS)
+	if err != nil {
+		return nil, 0, err
+	}
+	var ds []*dns.DS
+	var state delegation
+	ttl := maxCacheTTL
+	signer := signerName(resp)
+	if signer == "" || signer == name || !dns.IsSubDomain(signer, name) {
+		// Unsigned - only valid if the parent is itself insecure
+		if name == "." {
+			return nil, 0, bogus(dns.ExtendedErrorCodeRRSIGsMissing, "%s DS: missing signature", name)
+		}
+		insecure, err := v.insecure(ctx, exchange, parent(name))
+		if err != nil {
+			return nil, 0, err
+		}
+		if !insecure {
+			return nil, 0, bogus(dns.ExtendedErrorCodeRRSIGsMissing, "%s DS: missing signature", name)
+		}
+		state = delegationInsecure
+	} else {
+		keys, err := v.zoneKeys(ctx, exchange, signer)
+		if err != nil {
+			return nil, 0, err
+		}
+		state = delegationInsecure
+		if keys != nil {
+			if state, ds, ttl, err = delegationProof(resp, name, keys); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	v.mu.Lock()
+	if len(v.ds) > maxCache {
+		sweep(v.ds, func(e *dsEntry) bool { return timeNow().After(e.expires) })
+	}
+	v.ds[name] = &dsEntry{ds: ds, state: state, expires: timeNow().Add(ttl)}
+	v.mu.Unlock()
+	return ds, state, nil
+}
+
+// delegationProof validates the response to a DS query for name with the
+// keys of the parent zone.
+func delegationProof(resp *dns.Msg, name string, keys []*dns.DNSKEY) (delegation, []*dns.DS, time.Duration, error) {
+	var nsec []*dns.NSEC
+	var nsec3 []*dns.NSEC3
+	for _, set := range rrsets(append(resp.Answer, resp.Ns...)) {
+		switch set.rrtype {
+		case dns.TypeDS:
+			if set.name != name {
+				continue
+			}
+			if _, err := verifyRRset(set.rrs, set.sigs, keys); err != nil {
+				return 0, nil, 0, err
+			}
+			ds := make([]*dns.DS, 0, len(set.rrs))
+			for _, rr := range set.rrs {
+				ds = append(ds, rr.(*dns.DS))
+			}
+			return delegationSecure, ds, minTTL(set.rrs), nil
+		case dns.TypeNSEC, dns.TypeNSEC3:
+			if _, err := verifyRRset(set.rrs, set.sigs, keys); err != nil {
+				return 0, nil, 0, err
+			}
+			for _, rr := range set.rrs {
+				switch r := rr.(type) {
+				case *dns.NSEC:
+					nsec = append(nsec, r)
+				case *dns.NSEC3:
+					nsec3 = append(nsec3, r)
+				}
+			}
+		}
+	}
+	if nsec3Excessive(nsec3) {
+		return delegationInsecure, nil, minTTL(append(resp.Answer, resp.Ns...)), nil
+	}
+	state, ok := nsecDelegation(nsec, name)
+	if !ok {
+		state, ok = nsec3Delegation(nsec3, name)
+	}
+	if !ok {
+		return 0, nil, 0, bogus(dns.ExtendedErrorCodeNSECMissing, "%s DS: no proof of non-existence", name)
+	}
+	return state, nil, minTTL(append(resp.Answer, resp.Ns...)), nil
+}
+
+// query looks up name/qtype with DNSSEC records.
+func (v *Validator) query(ctx context.Context, exchange ExchangeFunc, name string, qtype uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.SetEdns0(dns.DefaultMsgSize, true)
+	q.CheckingDisabled = true
+	resp, err := exchange(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("DNSSEC lookup error (%s %s): %s", name, dns.TypeToString[qtype], err)
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("DNSSEC lookup error (%s %s): %s", name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+func (v *Validator) storeKeys(zone string, keys []*dns.DNSKEY, ttl time.Duration) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.keys) > maxCache {
+		sweep(v.keys, func(e *keyEntry) bool { return timeNow().After(e.expires) })
+	}
+	v.keys[zone] = &keyEntry{keys: keys, expires: timeNow().Add(ttl)}
+}
+
+// verifyRRset checks that one of sigs is a currently valid signature of rrs
+// by one of keys, returning the signature.
+func verifyRRset(rrs []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) (*dns.RRSIG, error) {
+	h := rrs[0].Header()
+	err := bogus(dns.ExtendedErrorCodeRRSIGsMissing, "%s %s: no signature by a zone key", h.Name, dns.TypeToString[h.Rrtype])
+	now := timeNow()
+	for _, sig := range sigs {
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if e := sig.Verify(key, rrs); e != nil {
+				err = bogus(dns.ExtendedErrorCodeDNSBogus, "%s %s: %s", h.Name, dns.TypeToString[h.Rrtype], e)
+				continue
+			}
+			if !sig.ValidityPeriod(now) {
+				if int32(uint32(now.Unix())-sig.Inception) < 0 {
+					err = bogus(dns.ExtendedErrorCodeSignatureNotYetValid, "%s %s: signature not yet valid", h.Name, dns.TypeToString[h.Rrtype])
+				} else {
+					err = bogus(dns.ExtendedErrorCodeSignatureExpired, "%s %s: signature expired", h.Name, dns.TypeToString[h.Rrtype])
+				}
+				continue
+			}
+			return sig, nil
+		}
+	}
+	return nil, err
+}
+
+func matchDS(key *dns.DNSKEY, ds []*dns.DS) bool {
+	for _, d := range ds {
+		if d.KeyTag != key.KeyTag() || d.Algorithm != key.Algorithm {
+			continue
+		}
+		if digest := key.ToDS(d.DigestType); digest != nil && strings.EqualFold(digest.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchKey(key *dns.DNSKEY, trusted []*dns.DNSKEY) bool {
+	for _, t := range trusted {
+		if t.Algorithm == key.Algorithm && t.Flags == key.Flags && t.PublicKey == key.PublicKey {
+			return true
+		}
+	}
+	return false
+}
+
+// rrset is an RRset of a message section with its signatures
+type rrset struct {
+	name   string // lower case
+	rrtype uint16
+	rrs    []dns.RR
+	sigs   []*dns.RRSIG
+	labels int // RRSIG labels of a wildcard expansion
+}
+
+// rrsets groups the records of a section (other than RRSIG and OPT) into
+// RRsets in order of appearance.
+func rrsets(section []dns.RR) []*rrset {
+	var out []*rrset
+	index := make(map[string]*rrset)
+	for _, rr := range section {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		name := dns.CanonicalName(h.Name)
+		key := fmt.Sprintf("%s %d", name, h.Rrtype)
+		set, ok := index[key]
+		if !ok {
+			set = &rrset{name: name, rrtype: h.Rrtype}
+			index[key] = set
+			out = append(out, set)
+		}
+		set.rrs = append(set.rrs, rr)
+	}
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := fmt.Sprintf("%s %d", dns.CanonicalName(sig.Hdr.Name), sig.TypeCovered)
+			if set, ok := index[key]; ok {
+				set.sigs = append(set.sigs, sig)
+			}
+		}
+	}
+	return out
+}
+
+// signerName returns the signer of the first signature in the answer or
+// authority section of msg ("" if unsigned).
+func signerName(msg *dns.Msg) string {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				return dns.CanonicalName(sig.SignerName)
+			}
+		}
+	}
+	return ""
+}
+
+// chainTarget follows CNAME records from name in answer.
+func chainTarget(answer []dns.RR, name string) string {
+	for range answer {
+		found := false
+		for _, rr := range answer {
+			if v, ok := rr.(*dns.CNAME); ok && strings.EqualFold(v.Hdr.Name, name) {
+				name, found = v.Target, true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return name
+}
+
+// hasAnswer reports whether answer has a qtype record (any record for ANY)
+// for name.
+func hasAnswer(answer []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range answer {
+		h := rr.Header()
+		if strings.EqualFold(h.Name, name) && (h.Rrtype == qtype || qtype == dns.TypeANY) {
+			return true
+		}
+	}
+	return false
+}
+
+// underDname reports whether name is below the owner of a DNAME in answer.
+func underDname(answer []dns.RR, name string) bool {
+	for _, rr := range answer {
+		if v, ok := rr.(*dns.DNAME); ok && dns.IsSubDomain(v.Hdr.Name, name) && !strings.EqualFold(v.Hdr.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// minTTL returns the lowest TTL of rrs, bounded by maxCacheTTL.
+func minTTL(rrs []dns.RR) time.Duration {
+	ttl := maxCacheTTL
+	for _, rr := range rrs {
+		if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+			ttl = min(ttl, time.Duration(h.Ttl)*time.Second)
+		}
+	}
+	return ttl
+}
+
+// parent returns the parent of (non-root) name.
+func parent(name string) string {
+	if next, end := dns.NextLabel(name, 0); !end {
+		return name[next:]
+	}
+	return "."
+}
+
+// suffix returns the last n labels of name.
+func suffix(name string, n int) string {
+	labels := dns.SplitDomainName(name)
+	if n >= len(labels) {
+		return dns.Fqdn(name)
+	}
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// sweep deletes the entries of m for which expired returns true.
+func sweep[T any](m map[string]T, expired func(T) bool) {
+	for k, v := range m {
+		if expired(v) {
+			delete(m, k)
+		}
+	}
+}
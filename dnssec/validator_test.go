@@ -0,0 +1,165 @@
+package dnssec
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZones returns a signed root (the trust anchor) delegating to a signed
+// NSEC zone (example.), a signed NSEC3 zone (n3.) and an unsigned zone
+// (insecure.).
+func testZones(t *testing.T) (root *TestZone, zones []*TestZone) {
+	example := NewTestZone(t, "example.", true, false,
+		"www.example. 300 IN A 192.0.2.1",
+		"alias.example. 300 IN CNAME www.example.",
+		"*.wild.example. 300 IN A 192.0.2.2",
+	)
+	n3 := NewTestZone(t, "n3.", true, true, "a.n3. 300 IN A 192.0.2.3")
+	insecure := NewTestZone(t, "insecure.", false, false, "host.insecure. 300 IN A 192.0.2.4")
+	root = NewTestZone(t, ".", true, false,
+		"example. 3600 IN NS ns.example.", example.DS().String(),
+		"n3. 3600 IN NS ns.n3.", n3.DS().String(),
+		"insecure. 3600 IN NS ns.insecure.",
+	)
+	return root, []*TestZone{root, example, n3, insecure}
+}
+
+func testQuery(name string, qtype uint16) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.SetEdns0(dns.DefaultMsgSize, true)
+	q.CheckingDisabled = true
+	return q
+}
+
+func TestValidate(t *testing.T) {
+
+	root, zones := testZones(t)
+	exchange := TestExchange(zones...)
+
+	for _, tc := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		secure bool
+	}{
+		{"www.example.", dns.TypeA, dns.RcodeSuccess, true},
+		{"alias.example.", dns.TypeA, dns.RcodeSuccess, true},
+		{"nx.example.", dns.TypeA, dns.RcodeNameError, true},
+		{"www.example.", dns.TypeTXT, dns.RcodeSuccess, true},
+		{"wild.example.", dns.TypeA, dns.RcodeSuccess, true},
+		{"foo.wild.example.", dns.TypeA, dns.RcodeSuccess, true},
+		{"example.", dns.TypeDNSKEY, dns.RcodeSuccess, true},
+		{"example.", dns.TypeDS, dns.RcodeSuccess, true},
+		{"a.n3.", dns.TypeA, dns.RcodeSuccess, true},
+		{"b.n3.", dns.TypeA, dns.RcodeNameError, true},
+		{"a.n3.", dns.TypeTXT, dns.RcodeSuccess, true},
+		{"nx.", dns.TypeA, dns.RcodeNameError, true},
+		{"host.insecure.", dns.TypeA, dns.RcodeSuccess, false},
+		{"nx.insecure.", dns.TypeA, dns.RcodeNameError, false},
+		{"insecure.", dns.TypeDS, dns.RcodeSuccess, true},
+	} {
+		t.Run(tc.name+dns.TypeToString[tc.qtype], func(t *testing.T) {
+			v, _ := NewValidator([]dns.RR{root.DS()})
+			out, _ := exchange(context.Background(), testQuery(tc.name, tc.qtype))
+			if out.Rcode != tc.rcode {
+				t.Fatalf("Stand-in rcode: %s", dns.RcodeToString[out.Rcode])
+			}
+			secure, err := v.Validate(context.Background(), exchange, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if secure != tc.secure {
+				t.Errorf("Secure: %t (expected %t)", secure, tc.secure)
+			}
+		})
+	}
+}
+
+func TestValidateBogus(t *testing.T) {
+
+	root, zones := testZones(t)
+	exchange := TestExchange(zones...)
+
+	without := func(section []dns.RR, rrtype uint16) []dns.RR {
+		var out []dns.RR
+		for _, rr := range section {
+			if rr.Header().Rrtype != rrtype {
+				out = append(out, rr)
+			}
+		}
+		return out
+	}
+
+	for _, tc := range []struct {
+		test   string
+		name   string
+		tamper func(*dns.Msg)
+		code   uint16
+	}{
+		{"data", "www.example.", func(m *dns.Msg) { m.Answer[0].(*dns.A).A[3] = 99 }, dns.ExtendedErrorCodeDNSBogus},
+		{"unsigned", "www.example.", func(m *dns.Msg) { m.Answer = without(m.Answer, dns.TypeRRSIG) }, dns.ExtendedErrorCodeRRSIGsMissing},
+		{"no-nsec", "nx.example.", func(m *dns.Msg) { m.Ns = without(m.Ns, dns.TypeNSEC) }, dns.ExtendedErrorCodeNSECMissing},
+		{"no-nsec3", "b.n3.", func(m *dns.Msg) { m.Ns = without(m.Ns, dns.TypeNSEC3) }, dns.ExtendedErrorCodeNSECMissing},
+		{"wildcard", "foo.wild.example.", func(m *dns.Msg) { m.Ns = nil }, dns.ExtendedErrorCodeNSECMissing},
+		{"nxdomain", "www.example.", func(m *dns.Msg) { m.Rcode, m.Answer = dns.RcodeNameError, nil }, dns.ExtendedErrorCodeNSECMissing},
+	} {
+		t.Run(tc.test, func(t *testing.T) {
+			v, _ := NewValidator([]dns.RR{root.DS()})
+			out, _ := exchange(context.Background(), testQuery(tc.name, dns.TypeA))
+			tc.tamper(out)
+			_, err := v.Validate(context.Background(), exchange, out)
+			var e *Error
+			if !errors.As(err, &e) || e.Code != tc.code {
+				t.Errorf("Expected %s: %v", dns.ExtendedErrorCodeToString[tc.code], err)
+			}
+		})
+	}
+
+	// Expired signatures
+	out, _ := exchange(context.Background(), testQuery("www.example.", dns.TypeA))
+	timeNow = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	defer func() { timeNow = time.Now }()
+	v, _ := NewValidator([]dns.RR{root.DS()})
+	_, err := v.Validate(context.Background(), exchange, out)
+	var e *Error
+	if !errors.As(err, &e) || e.Code != dns.ExtendedErrorCodeSignatureExpired {
+		t.Errorf("Expected Signature Expired: %v", err)
+	}
+}
+
+func TestValidateAnchors(t *testing.T) {
+
+	_, zones := testZones(t)
+	exchange := TestExchange(zones...)
+	out, _ := exchange(context.Background(), testQuery("www.example.", dns.TypeA))
+
+	// Wrong root key
+	other := NewTestZone(t, ".", true, false)
+	v, _ := NewValidator([]dns.RR{other.DS()})
+	_, err := v.Validate(context.Background(), exchange, out)
+	var e *Error
+	if !errors.As(err, &e) || e.Code != dns.ExtendedErrorCodeDNSKEYMissing {
+		t.Errorf("Expected DNSKEY Missing: %v", err)
+	}
+
+	// DNSKEY anchor for the zone itself
+	v, _ = NewValidator([]dns.RR{zones[1].key})
+	if secure, err := v.Validate(context.Background(), exchange, out); !secure || err != nil {
+		t.Errorf("Expected secure with zone anchor: %t %v", secure, err)
+	}
+
+	// No anchor - everything is insecure
+	v, _ = NewValidator(nil)
+	if secure, err := v.Validate(context.Background(), exchange, out); secure || err != nil {
+		t.Errorf("Expected insecure without anchor: %t %v", secure, err)
+	}
+
+	if _, err := NewValidator([]dns.RR{out.Answer[0]}); err == nil {
+		t.Errorf("Expected error for A record anchor")
+	}
+}
@@ -51,7 +51,7 @@ func (w *dohResponseWriter) Hijack()                     {}
 // supported. All proxy logic (blocklist, cache, ACL, DNS64) applies exactly
 // as it does for UDP/TCP clients.
 func MakeDoHHandler(proxyConfig *config.ProxyConfig) http.Handler {
-	dnsHandler := proxy.MakeHandler(proxyConfig)
+	dnsHandler := proxy.MakeContextHandler(proxyConfig)
 	path := proxyConfig.DohPath
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -102,7 +102,8 @@ func MakeDoHHandler(proxyConfig *config.ProxyConfig) http.Handler {
 			local:  dohAddr{"tcp", r.Host},
 			remote: dohAddr{"tcp", r.RemoteAddr},
 		}
-		dnsHandler(dohW, q)
+		// The request context is cancelled if the client disconnects
+		dnsHandler(r.Context(), dohW, q)
 
 		if dohW.msg == nil {
 			// Proxy dropped the request (e.g. ACL rejection).
@@ -7,14 +7,16 @@ require (
 	github.com/gorilla/rpc v1.2.1
 	github.com/lpar/gzipped v1.1.0
 	github.com/miekg/dns v1.1.72
+	github.com/quic-go/quic-go v0.61.0
+	golang.org/x/crypto v0.54.0
 	golang.org/x/exp v0.0.0-20221004215720-b9f4876ce741
-	golang.org/x/sys v0.46.0
+	golang.org/x/net v0.56.0
+	golang.org/x/sys v0.47.0
 )
 
 require (
 	github.com/golang/gddo v0.0.0-20210115222349-20d68f94ee1f // indirect
 	golang.org/x/mod v0.37.0 // indirect
-	golang.org/x/net v0.56.0 // indirect
-	golang.org/x/sync v0.21.0 // indirect
+	golang.org/x/sync v0.22.0 // indirect
 	golang.org/x/tools v0.47.0 // indirect
 )
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/config"
+)
+
+// dnssecQuery returns the query to send upstream when validating (q itself if
+// DNSSEC is disabled): with the DO bit set for signatures and denial records,
+// and the CD bit so that validating upstreams return bogus data for us to
+// check. Forward zones are not validated so keep the client CD bit.
+func dnssecQuery(cfg *config.ProxyConfig, q *dns.Msg) *dns.Msg {
+	if cfg.Dnssec == nil {
+		return q
+	}
+	q = q.Copy()
+	if opt := q.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		q.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	if !cfg.Forwarded(q.Question[0].Name) {
+		q.CheckingDisabled = true
+	}
+	return q
+}
+
+// validate checks out with the DNSSEC validator (if enabled) and sets the AD
+// bit on secure answers. Names in forward zones are not validated as these
+// are usually private with no chain of trust. DNSKEY and DS lookups go
+// straight to the upstreams, bypassing the cache, within what is left of
+// the query deadline.
+func validate(ctx context.Context, cfg *config.ProxyConfig, out *dns.Msg) error {
+	if cfg.Dnssec == nil {
+		return nil
+	}
+	out.AuthenticatedData = false
+	if cfg.Forwarded(out.Question[0].Name) {
+		return nil
+	}
+	secure, err := cfg.Dnssec.Validate(ctx, func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+		out, _, err := exchange(ctx, cfg, q)
+		return out, err
+	}, out)
+	if err != nil {
+		cfg.Log.Debugf("DNSSEC: <%s %s> %s", out.Question[0].Name, dns.TypeToString[out.Question[0].Qtype], err)
+		return err
+	}
+	out.AuthenticatedData = secure
+	return nil
+}
+
+// validationError is a DNSSEC validation failure, with the unvalidated
+// answer for clients that set CD.
+type validationError struct {
+	err error
+	out *dns.Msg
+}
+
+func (e *validationError) Error() string { return e.err.Error() }
+func (e *validationError) Unwrap() error { return e.err }
+
+// unvalidated returns the answer that failed validation with err if the
+// client query q set CD (RFC 4035 3.2.2), otherwise err. These answers are
+// not cached, so are never returned to clients without CD.
+func unvalidated(q *dns.Msg, err error) (*dns.Msg, error) {
+	var v *validationError
+	if !q.CheckingDisabled || !errors.As(err, &v) {
+		return nil, err
+	}
+	out := v.out.Copy()
+	out.Id = q.Id
+	return out, nil
+}
+
+// dnssecResponse adapts out (the response to the query from dnssecQuery) for
+// the client query q. DNSSEC records are only returned if the client set DO,
+// the AD bit only if it set DO or AD (RFC 6840 5.7), and the OPT record is
+// removed if the client did not use EDNS.
+func dnssecResponse(cfg *config.ProxyConfig, q *dns.Msg, out *dns.Msg) {
+	if cfg.Dnssec == nil {
+		return
+	}
+	opt := q.IsEdns0()
+	if opt == nil || !opt.Do() {
+		qtype := q.Question[0].Qtype
+		out.Answer = stripDnssec(out.Answer, qtype)
+		out.Ns = stripDnssec(out.Ns, qtype)
+		out.Extra = stripDnssec(out.Extra, qtype)
+		out.AuthenticatedData = out.AuthenticatedData && q.AuthenticatedData
+		if o := out.IsEdns0(); o != nil {
+			o.SetDo(false)
+		}
+	}
+	if opt == nil {
+		removeOpt(out)
+	}
+}
+
+// stripDnssec removes RRSIG, NSEC and NSEC3 records (other than of qtype)
+// from rrs.
+func stripDnssec(rrs []dns.RR, qtype uint16) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if t != qtype {
+				continue
+			}
+		}
+		out = append(out, rr)
+	}
+	return out
+}
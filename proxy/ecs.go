@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/config"
+)
+
+// findEcs returns the EDNS Client Subnet option of msg (nil if none).
+func findEcs(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// removeEcs removes any EDNS Client Subnet option from msg.
+func removeEcs(msg *dns.Msg) {
+	if opt := msg.IsEdns0(); opt != nil {
+		options := opt.Option[:0]
+		for _, o := range opt.Option {
+			if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+				options = append(options, o)
+			}
+		}
+		opt.Option = options
+	}
+}
+
+// removeOpt removes the OPT record from msg.
+func removeOpt(msg *dns.Msg) {
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+}
+
+// ecsQuery applies the ECS policy to q from clientIP and returns the query to
+// send upstream (q itself if unchanged). Subnets are only synthesised for
+// public client addresses.
+func ecsQuery(cfg *config.ProxyConfig, q *dns.Msg, clientIP net.IP) *dns.Msg {
+	client := findEcs(q)
+	switch cfg.Ecs {
+	case config.EcsStrip:
+		if client == nil {
+			return q
+		}
+		q = q.Copy()
+		removeEcs(q)
+		return q
+	case config.EcsAdd:
+		var address net.IP
+		var source int
+		switch {
+		case client != nil:
+			address, source = client.Address, int(client.SourceNetmask)
+		case clientIP != nil && clientIP.IsGlobalUnicast() && !clientIP.IsPrivate():
+			address, source = clientIP, 128
+		default:
+			return q
+		}
+		family, bits, prefix := uint16(2), 128, cfg.EcsPrefix6
+		if ip4 := address.To4(); ip4 != nil {
+			address, family, bits, prefix = ip4, 1, 32, cfg.EcsPrefix4
+		}
+		q = q.Copy()
+		removeEcs(q)
+		if prefix == 0 {
+			return q
+		}
+		source = min(source, prefix)
+		if q.IsEdns0() == nil {
+			q.SetEdns0(dns.DefaultMsgSize, false)
+		}
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        family,
+			SourceNetmask: uint8(source),
+			Address:       address.Mask(net.CIDRMask(source, bits)),
+		})
+		return q
+	}
+	return q
+}
+
+// ecsResponse rewrites the ECS option in out (the response to the upstream
+// query) for the client query q: the client's own option is echoed with the
+// upstream scope, and an OPT record is removed if the client did not use EDNS.
+func ecsResponse(q *dns.Msg, out *dns.Msg) {
+	upstream := findEcs(out)
+	if upstream == nil && findEcs(q) == nil {
+		return
+	}
+	removeEcs(out)
+	if q.IsEdns0() == nil {
+		removeOpt(out)
+		return
+	}
+	if client := findEcs(q); client != nil {
+		echo := *client
+		echo.SourceScope = 0
+		if upstream != nil {
+			echo.SourceScope = upstream.SourceScope
+		}
+		if opt := out.IsEdns0(); opt != nil {
+			opt.Option = append(opt.Option, &echo)
+		}
+	}
+}
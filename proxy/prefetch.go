@@ -0,0 +1,21 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/config"
+)
+
+// prefetchUpstream resolves q upstream in the background to replace a popular
+// cache entry before it expires (client queries for the same name meanwhile
+// join the request).
+func prefetchUpstream(config *config.ProxyConfig, q *dns.Msg) {
+	config.Log.Debugf("Prefetch: <%s %s>", q.Question[0].Name, dns.TypeToString[q.Question[0].Qtype])
+	_, _, _, err := config.Coalescer.Do(context.Background(), q, func(ctx context.Context) (*dns.Msg, string, error) {
+		return resolveUpstream(ctx, config, q)
+	})
+	if err != nil {
+		config.Log.Debugf("Prefetch: <%s %s> failed: %s", q.Question[0].Name, dns.TypeToString[q.Question[0].Qtype], err)
+	}
+}
@@ -1,15 +1,17 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"regexp"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/paulc/dinosaur-dns/config"
+	"github.com/paulc/dinosaur-dns/dnssec"
 	"github.com/paulc/dinosaur-dns/logger"
 	"github.com/paulc/dinosaur-dns/resolver"
 	"github.com/paulc/dinosaur-dns/statshandler"
@@ -35,6 +37,23 @@ func dnsErrorResponse(r *dns.Msg, rcode int, err error) *dns.Msg {
 	return m
 }
 
+// upstreamErrorResponse returns the SERVFAIL response for a failed upstream
+// query, with an extended DNS error (RFC 8914) for a DNSSEC validation failure
+// if the client uses EDNS.
+func upstreamErrorResponse(q *dns.Msg, err error) *dns.Msg {
+	var bogus *dnssec.Error
+	if !errors.As(err, &bogus) {
+		return dnsErrorResponse(q, dns.RcodeServerFailure, errors.New("Upstream error"))
+	}
+	out := dnsErrorResponse(q, dns.RcodeServerFailure, bogus)
+	if opt := q.IsEdns0(); opt != nil {
+		out.SetEdns0(opt.UDPSize(), opt.Do())
+		ede := out.IsEdns0()
+		ede.Option = append(ede.Option, &dns.EDNS0_EDE{InfoCode: bogus.Code, ExtraText: bogus.Reason})
+	}
+	return out
+}
+
 func checkAcl(acl []net.IPNet, client net.IP) bool {
 
 	// Default to permit all if no ACL set
@@ -51,66 +70,251 @@ func checkAcl(acl []net.IPNet, client net.IP) bool {
 
 }
 
-func resolve(config *config.ProxyConfig, q *dns.Msg) (out *dns.Msg, err error, cached bool) {
+// rcodeError is the error for a response with an rcode in
+// config.FailureRcodes. The response is kept as a fallback answer.
+type rcodeError struct {
+	out      *dns.Msg
+	upstream resolver.Resolver
+}
+
+func (e *rcodeError) Error() string {
+	return fmt.Sprintf("Upstream response: %s", dns.RcodeToString[e.out.Rcode])
+}
+
+// rcodeRank orders failed responses for config.FailureBestAnswer (lower is
+// better): answers, then NXDOMAIN, then SERVFAIL, then refusals and other
+// errors.
+func rcodeRank(rcode int) int {
+	switch rcode {
+	case dns.RcodeSuccess:
+		return 0
+	case dns.RcodeNameError:
+		return 1
+	case dns.RcodeServerFailure:
+		return 2
+	}
+	return 3
+}
+
+// betterRcodeError returns the better of the failed responses a and b (either
+// may be nil).
+func betterRcodeError(a, b *rcodeError) *rcodeError {
+	if a == nil || (b != nil && rcodeRank(b.out.Rcode) < rcodeRank(a.out.Rcode)) {
+		return b
+	}
+	return a
+}
 
+// query sends q to a single upstream and reports the outcome to the strategy,
+// health checker and metrics (unless the query was cancelled, which is not
+// the upstream's fault). A response with an rcode in config.FailureRcodes is
+// returned as an *rcodeError.
+func query(ctx context.Context, config *config.ProxyConfig, strategy resolver.Strategy, r resolver.Resolver, q *dns.Msg) (*dns.Msg, error) {
 	log := config.Log
+	start := time.Now()
+	out, err := r.Resolve(ctx, log, q)
+	if ctx.Err() == context.Canceled {
+		return nil, ctx.Err()
+	}
+	rtt := time.Since(start)
+	// Metrics count the response (and its rcode) as answered
+	config.Metrics.Report(r, rtt, out, err, ctx.Err() == context.DeadlineExceeded)
+	if err == nil && config.FailureRcodes[out.Rcode] {
+		out, err = nil, &rcodeError{out: out, upstream: r}
+	}
+	strategy.Report(log, r, rtt, err)
+	config.Health.Report(log, r, err)
+	if err != nil {
+		log.Debugf("Upstream error <%s>: %s", r, err)
+	}
+	return out, err
+}
 
-	// Check cache
-	out, found := config.Cache.Get(q)
+// race sends q to all upstreams in batch concurrently and returns the first
+// successful response and the upstream that sent it (or, if all fail, the
+// best *rcodeError or the last error). Slower upstreams are left to complete in the background (bounded by
+// the deadline of ctx but not its cancellation) so their results still reach
+// the strategy.
+func race(ctx context.Context, config *config.ProxyConfig, strategy resolver.Strategy, batch []resolver.Resolver, q *dns.Msg) (out *dns.Msg, upstream resolver.Resolver, err error) {
+	if len(batch) == 1 {
+		out, err = query(ctx, config, strategy, batch[0], q)
+		return out, batch[0], err
+	}
+	type result struct {
+		out      *dns.Msg
+		upstream resolver.Resolver
+		err      error
+	}
+	background, cancel := context.WithoutCancel(ctx), context.CancelFunc(func() {})
+	if deadline, ok := ctx.Deadline(); ok {
+		background, cancel = context.WithDeadline(background, deadline)
+	}
+	wg := sync.WaitGroup{}
+	results := make(chan result, len(batch))
+	for _, r := range batch {
+		wg.Add(1)
+		go func(r resolver.Resolver, q *dns.Msg) {
+			defer wg.Done()
+			out, err := query(background, config, strategy, r, q)
+			results <- result{out, r, err}
+		}(r, q.Copy())
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+	}()
+	var best *rcodeError
+	for range batch {
+		var res result
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			if best != nil {
+				return nil, nil, best
+			}
+			return nil, nil, ctx.Err()
+		}
+		if res.err == nil {
+			return res.out, res.upstream, nil
+		}
+		if e, ok := res.err.(*rcodeError); ok {
+			best = betterRcodeError(best, e)
+		}
+		err = res.err
+	}
+	if best != nil {
+		return nil, nil, best
+	}
+	return nil, nil, err
+}
+
+// resolve answers q from the cache or the upstreams. Identical concurrent
+// cache misses share a single upstream request (see resolver.Coalescer).
+// upstream is the resolver that answered (empty if cached).
+func resolve(ctx context.Context, config *config.ProxyConfig, q *dns.Msg) (out *dns.Msg, err error, cached bool, upstream string) {
+
+	// Check cache (refreshing popular entries before they expire)
+	out, found, prefetch := config.Cache.GetPrefetch(q)
 	if found {
+		if prefetch {
+			go prefetchUpstream(config, q)
+		}
 		cached = true
 		return
 	}
 
-	// Snapshot the upstream list to avoid data races with concurrent rotation.
-	config.RLock()
-	upstreams := append(config.Upstream[:0:0], config.Upstream...)
-	config.RUnlock()
+	// If a stale answer has been served because the upstreams failed, serve
+	// it again without waiting for them (refreshing it in the background at
+	// most every cache.StaleRecheck)
+	if stale, found := config.Cache.GetStale(q, true); found {
+		if config.Cache.StaleRefresh(q) {
+			go refresh(config, q)
+		}
+		return staleAnswer(q, stale), nil, true, ""
+	}
+
+	out, upstream, _, err = config.Coalescer.Do(ctx, q, func(ctx context.Context) (*dns.Msg, string, error) {
+		return resolveUpstream(ctx, config, q)
+	})
+	if err != nil {
+		// Serve stale (RFC 8767) if an expired answer is still in the cache
+		if stale, found := config.Cache.GetStale(q, false); found {
+			config.Log.Debugf("Stale: <%s %s> serving stale answer (%s)", q.Question[0].Name, dns.TypeToString[q.Question[0].Qtype], err)
+			return staleAnswer(q, stale), nil, true, ""
+		}
+	}
+	return
+}
+
+// resolveUpstream sends q to the upstreams (see exchange), validates the
+// response if DNSSEC is enabled, applies rebinding protection and caches it.
+// The whole query, including any DNSSEC chain lookups, is bounded by
+// config.UpstreamTimeout. If every upstream fails and
+// config.FailureBestAnswer is set, the best response with a failure rcode is
+// returned (uncached) instead of an error.
+func resolveUpstream(ctx context.Context, config *config.ProxyConfig, q *dns.Msg) (*dns.Msg, string, error) {
+
+	log := config.Log
+
+	ctx, cancel := context.WithTimeout(ctx, config.UpstreamTimeout)
+	defer cancel()
+
+	out, r, err := exchange(ctx, config, q)
+	if best, ok := err.(*rcodeError); ok && config.FailureBestAnswer {
+		log.Debugf("Upstream: returning %s response from <%s>", dns.RcodeToString[best.out.Rcode], best.upstream)
+		return rebindFilter(config, best.out), best.upstream.String(), nil
+	}
+	if err != nil {
+		// None of the resolvers worked
+		return nil, "", fmt.Errorf("Unable to resolve host - all upstream resolvers failed")
+	}
+
+	if err := validate(ctx, config, out); err != nil {
+		return nil, r.String(), &validationError{err, rebindFilter(config, out)}
+	}
+	out = rebindFilter(config, out)
 
-	// Try each resolver
-	for i, r := range upstreams {
+	// Cache response
+	config.Cache.Add(out)
+	return out, r.String(), nil
+}
 
-		out, err = r.Resolve(log, q)
+// exchange sends q to the upstreams for its name and returns the first
+// successful response. The time left before the ctx deadline (set by
+// resolveUpstream) is split evenly over the upstream batches still to be
+// tried, so that a hung upstream leaves time for failover. If every upstream
+// fails the best *rcodeError is returned (if any).
+func exchange(ctx context.Context, config *config.ProxyConfig, q *dns.Msg) (*dns.Msg, resolver.Resolver, error) {
 
+	log := config.Log
+
+	// Select upstream set (most specific forward zone or default)
+	upstreams, strategy := config.UpstreamSet(q.Question[0].Name)
+	// Try resolvers in the order chosen by the strategy (with unhealthy
+	// upstreams moved to the end), fanout at a time
+	order := config.Health.Filter(log, strategy.Order(upstreams))
+	fanout := strategy.Fanout()
+	deadline, _ := ctx.Deadline()
+	batches := (len(order) + fanout - 1) / fanout
+	var best *rcodeError
+	err := errors.New("No upstream resolvers")
+	for i, n := 0, 0; i < len(order); i, n = i+fanout, n+1 {
+		budget := time.Until(deadline) / time.Duration(batches-n)
+		attempt, cancelAttempt := context.WithTimeout(ctx, budget)
+		var out *dns.Msg
+		var r resolver.Resolver
+		out, r, err = race(attempt, config, strategy, order[i:min(i+fanout, len(order))], q)
+		cancelAttempt()
 		if err == nil {
-			// If this is the first upstream clear the error count
-			if i == 0 {
-				config.Lock()
-				config.UpstreamErr = 0
-				config.Unlock()
-			}
-			// Cache response
-			config.Cache.Add(out)
-			// Return
-			return
+			return out, r, nil
 		}
-
-		// Upstream error - if this is the first upstream we count errors and try to switch if threshold exceeded
-		if i == 0 {
-			config.Lock()
-			config.UpstreamErr++
-			if config.UpstreamErr > 3 {
-				// Demote upstream
-				config.Upstream = append(config.Upstream[1:], config.Upstream[0])
-				config.UpstreamErr = 0
-				demoted := config.Upstream
-				config.Unlock()
-				log.Printf("Error threshold exceeded - demoting upstream: %s", demoted)
-			} else {
-				config.Unlock()
-			}
+		if e, ok := err.(*rcodeError); ok {
+			best = betterRcodeError(best, e)
+		}
+		if ctx.Err() != nil {
+			break
 		}
-		log.Debugf("Upstream error <%s>: %s", r, err)
 	}
-
-	// None of the resolvers worked
-	err = fmt.Errorf("Unable to resolve host - all upstream resolvers failed")
-	return
+	if best != nil {
+		return nil, nil, best
+	}
+	return nil, nil, err
 }
 
+// MakeHandler returns a dns.HandlerFunc for queries with no enclosing
+// context (see MakeContextHandler).
 func MakeHandler(config *config.ProxyConfig) func(dns.ResponseWriter, *dns.Msg) {
-
+	handler := MakeContextHandler(config)
 	return func(w dns.ResponseWriter, q *dns.Msg) {
+		handler(context.Background(), w, q)
+	}
+}
+
+// MakeContextHandler returns the query handler. Upstream queries are
+// cancelled when ctx is done (server shutdown or DoH client disconnect).
+func MakeContextHandler(config *config.ProxyConfig) func(context.Context, dns.ResponseWriter, *dns.Msg) {
+
+	return func(ctx context.Context, w dns.ResponseWriter, q *dns.Msg) {
 
 		// Always close connection
 		defer w.Close()
@@ -173,11 +377,19 @@ func MakeHandler(config *config.ProxyConfig) func(dns.ResponseWriter, *dns.Msg)
 			return
 		}
 
+		// Apply the EDNS Client Subnet policy to the upstream query
+		uq := ecsQuery(config, q, clientIP)
+		// Request signatures if validating
+		uq = dnssecQuery(config, uq)
+
 		// Resolve address
-		out, err, cached := resolve(config, q)
+		out, err, cached, upstream := resolve(ctx, config, uq)
+		if err != nil {
+			out, err = unvalidated(q, err)
+		}
 		if err != nil {
 			log.Debugf("Connection: %s/%s <%s %s> [upstream error]", clientHost, clientNet, qname, dns.TypeToString[qtype])
-			w.WriteMsg(dnsErrorResponse(q, dns.RcodeServerFailure, errors.New("Upstream error")))
+			w.WriteMsg(upstreamErrorResponse(q, err))
 			logItem.Error = true
 			return
 		}
@@ -185,12 +397,15 @@ func MakeHandler(config *config.ProxyConfig) func(dns.ResponseWriter, *dns.Msg)
 		// If we get an empty answer for a AAAA request and DNS64 is configured, synthesise from A records
 		if config.Dns64 && qtype == dns.TypeAAAA && len(out.Answer) == 0 {
 			// Try DNS64 lookup — use a copy so the original q (TypeAAAA) is preserved for error responses
-			q4 := q.Copy()
+			q4 := uq.Copy()
 			q4.Question[0].Qtype = dns.TypeA
-			dns64_out, err, cached := resolve(config, q4)
+			dns64_out, err, cached, upstream := resolve(ctx, config, q4)
+			if err != nil {
+				dns64_out, err = unvalidated(q, err)
+			}
 			if err != nil {
 				log.Debugf("DNS64: %s/%s <%s %s> [upstream error]", clientHost, clientNet, qname, dns.TypeToString[qtype])
-				w.WriteMsg(dnsErrorResponse(q, dns.RcodeServerFailure, errors.New("Upstream error")))
+				w.WriteMsg(upstreamErrorResponse(q, err))
 				logItem.Error = true
 				return
 			}
@@ -214,6 +429,11 @@ func MakeHandler(config *config.ProxyConfig) func(dns.ResponseWriter, *dns.Msg)
 					}
 				}
 			}
+			// Synthesised records are not signed
+			if config.Dnssec != nil {
+				dns64_out.Answer = stripDnssec(dns64_out.Answer, 0)
+				dns64_out.AuthenticatedData = false
+			}
 			if cached {
 				log.Debugf("Connection: %s/%s <%s %s> [dns64 cached]", clientHost, clientNet, qname, dns.TypeToString[qtype])
 			} else {
@@ -221,6 +441,9 @@ func MakeHandler(config *config.ProxyConfig) func(dns.ResponseWriter, *dns.Msg)
 			}
 			logItem.Rcode = dns64_out.Rcode
 			logItem.Cached = cached
+			logItem.Upstream = upstream
+			ecsResponse(q, dns64_out)
+			dnssecResponse(config, q, dns64_out)
 			w.WriteMsg(dns64_out)
 			return
 		}
@@ -233,28 +456,26 @@ func MakeHandler(config *config.ProxyConfig) func(dns.ResponseWriter, *dns.Msg)
 		}
 		logItem.Rcode = out.Rcode
 		logItem.Cached = cached
+		logItem.Upstream = upstream
+		ecsResponse(q, out)
+		dnssecResponse(config, q, out)
 		w.WriteMsg(out)
 	}
 }
 
 // CheckUpstream probes a single upstream resolver and returns an error if it
 // does not respond to a root NS query within the configured timeout.
-// Handles all three resolver types: plain UDP (host:port), DoT (tls://...),
-// and DoH (https://...).
+// Handles all resolver types: plain UDP (host:port), DoT (tls://...),
+// DoQ (quic://...) and DoH (https://...).
 func CheckUpstream(upstream string) error {
-	var r resolver.Resolver
-	switch {
-	case strings.HasPrefix(upstream, "https://"):
-		r = resolver.NewDohResolver(upstream)
-	case strings.HasPrefix(upstream, "tls://"):
-		r = resolver.NewDotResolver(upstream)
-	default:
-		r = resolver.NewUdpResolver(upstream)
+	r, err := resolver.NewResolver(upstream, nil)
+	if err != nil {
+		return err
 	}
 	log := logger.New(logger.NewDiscard(true))
 	q := new(dns.Msg)
 	q.SetQuestion(".", dns.TypeNS)
-	if _, err := r.Resolve(log, q); err != nil {
+	if _, err := r.Resolve(context.Background(), log, q); err != nil {
 		return fmt.Errorf("Invalid resolver: %s (%s)", upstream, err)
 	}
 	return nil
@@ -2,12 +2,19 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/paulc/dinosaur-dns/config"
+	"github.com/paulc/dinosaur-dns/dnssec"
+	"github.com/paulc/dinosaur-dns/logger"
+	"github.com/paulc/dinosaur-dns/resolver"
 	"github.com/paulc/dinosaur-dns/util"
 )
 
@@ -444,3 +451,265 @@ func TestHandlerDns64Prefix(t *testing.T) {
 	handler(rw, q)
 	util.CheckResponse(t, q, rw.outmsg, "1111::7f00:1")
 }
+
+func TestHandlerEcs(t *testing.T) {
+
+	// Upstream answers with scope 24 for queries with ECS and records the
+	// subnet received (answers have EDNS if the query did)
+	received := make(chan string, 10)
+	addr := util.StartTestServer(t, func(w dns.ResponseWriter, q *dns.Msg) {
+		out := new(dns.Msg)
+		out.SetReply(q)
+		rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 1.2.3.4")
+		out.Answer = append(out.Answer, rr)
+		subnet := ""
+		if q.IsEdns0() != nil {
+			out.SetEdns0(1232, false)
+		}
+		if e := findEcs(q); e != nil {
+			subnet = fmt.Sprintf("%s/%d", e.Address, e.SourceNetmask)
+			echo := *e
+			echo.SourceScope = 24
+			out.IsEdns0().Option = append(out.IsEdns0().Option, &echo)
+		}
+		received <- subnet
+		w.WriteMsg(out)
+	})
+
+	clientEcs := func(q *dns.Msg, subnet string) *dns.Msg {
+		_, cidr, _ := net.ParseCIDR(subnet)
+		ones, _ := cidr.Mask.Size()
+		q.SetEdns0(1232, false)
+		q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: cidr.IP,
+		})
+		return q
+	}
+
+	for _, v := range []struct {
+		ecs      string
+		client   net.IP
+		subnet   string // client ECS option
+		expected string // subnet sent upstream
+	}{
+		{"forward", net.IPv4(203, 0, 113, 5), "198.51.100.0/24", "198.51.100.0/24"},
+		{"forward", net.IPv4(203, 0, 113, 5), "", ""},
+		{"strip", net.IPv4(203, 0, 113, 5), "198.51.100.0/24", ""},
+		{"add", net.IPv4(203, 0, 113, 5), "", "203.0.113.0/24"},
+		{"add:16,48", net.IPv4(203, 0, 113, 5), "198.51.100.0/24", "198.51.0.0/16"},
+		{"add", net.ParseIP("2001:db8:1234:5678::1"), "", "2001:db8:1234:5600::/56"},
+		{"add:24,0", net.ParseIP("2001:db8:1234:5678::1"), "", ""},
+		{"add", net.IPv4(192, 168, 1, 5), "", ""}, // private address
+	} {
+		handler, _ := getTestHandler(t, `{
+			"upstream": [ "`+addr+`" ],
+			"ecs": "`+v.ecs+`",
+			"discard": true
+		}`)
+		rw := NewTestResponseWriter()
+		rw.remote = &net.UDPAddr{IP: v.client, Port: 9999}
+		q := util.CreateQuery("ecs.example.com.", "A")
+		if v.subnet != "" {
+			clientEcs(q, v.subnet)
+		}
+		handler(rw, q)
+		util.CheckResponse(t, q, rw.outmsg, "1.2.3.4")
+		if subnet := <-received; subnet != v.expected {
+			t.Errorf("%s %s: upstream received %q, expected %q", v.ecs, v.client, subnet, v.expected)
+		}
+
+		// The client sees its own ECS option (or none)
+		e := findEcs(rw.outmsg)
+		if v.subnet == "" && (e != nil || rw.outmsg.IsEdns0() != nil) {
+			t.Errorf("%s %s: unexpected EDNS in response", v.ecs, v.client)
+		}
+		if v.subnet != "" && (e == nil || fmt.Sprintf("%s/%d", e.Address.To4(), e.SourceNetmask) != v.subnet) {
+			t.Errorf("%s %s: client ECS not echoed: %v", v.ecs, v.client, e)
+		}
+	}
+}
+
+func TestHandlerEcsCache(t *testing.T) {
+
+	var queries atomic.Int32
+	addr := util.StartTestServer(t, func(w dns.ResponseWriter, q *dns.Msg) {
+		queries.Add(1)
+		out := new(dns.Msg)
+		out.SetReply(q)
+		rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 1.2.3.4")
+		out.Answer = append(out.Answer, rr)
+		if e := findEcs(q); e != nil {
+			echo := *e
+			echo.SourceScope = e.SourceNetmask
+			out.SetEdns0(1232, false)
+			out.IsEdns0().Option = append(out.IsEdns0().Option, &echo)
+		}
+		w.WriteMsg(out)
+	})
+	handler, c := getTestHandler(t, `{
+		"upstream": [ "`+addr+`" ],
+		"ecs": "add",
+		"discard": true
+	}`)
+
+	// Scoped answers are cached per client subnet
+	rw := NewTestResponseWriter()
+	for _, client := range []net.IP{net.IPv4(203, 0, 113, 5), net.IPv4(203, 0, 113, 6), net.IPv4(198, 51, 100, 5)} {
+		rw.Reset()
+		rw.remote = &net.UDPAddr{IP: client, Port: 9999}
+		q := util.CreateQuery("cache.example.com.", "A")
+		handler(rw, q)
+		util.CheckResponse(t, q, rw.outmsg, "1.2.3.4")
+	}
+	if queries.Load() != 2 || len(c.Cache.Cache) != 2 {
+		t.Errorf("expected 2 upstream queries and cache entries, got %d/%d", queries.Load(), len(c.Cache.Cache))
+	}
+}
+
+// zoneResolver answers from signed test zones (see dnssec.TestExchange),
+// changing A records to 6.6.6.6 if tamper is set, after delay.
+type zoneResolver struct {
+	exchange dnssec.ExchangeFunc
+	tamper   bool
+	delay    time.Duration
+}
+
+func (r *zoneResolver) Resolve(ctx context.Context, log *logger.Logger, q *dns.Msg) (*dns.Msg, error) {
+	select {
+	case <-time.After(r.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	out, err := r.exchange(ctx, q)
+	if err == nil && r.tamper {
+		out = out.Copy()
+		for _, rr := range out.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				a.A = net.IPv4(6, 6, 6, 6)
+			}
+		}
+	}
+	return out, err
+}
+
+func (r *zoneResolver) String() string { return "zones" }
+
+func TestHandlerDnssec(t *testing.T) {
+
+	example := dnssec.NewTestZone(t, "example.", true, false, "www.example. 300 IN A 192.0.2.1")
+	insecure := dnssec.NewTestZone(t, "insecure.", false, false, "www.insecure. 300 IN A 192.0.2.2")
+	root := dnssec.NewTestZone(t, ".", true, false,
+		"example. 3600 IN NS ns.example.", example.DS().String(),
+		"insecure. 3600 IN NS ns.insecure.",
+	)
+	zones := &zoneResolver{exchange: dnssec.TestExchange(root, example, insecure)}
+
+	handler, c := getTestHandler(t, `{
+		"dnssec": true,
+		"discard": true
+	}`)
+	c.Dnssec, _ = dnssec.NewValidator([]dns.RR{root.DS()})
+	c.Upstream = []resolver.Resolver{zones}
+
+	query := func(name, qtype string, edns, do, ad bool) *dns.Msg {
+		q := util.CreateQuery(name, qtype)
+		if edns {
+			q.SetEdns0(1232, do)
+		}
+		q.AuthenticatedData = ad
+		rw := NewTestResponseWriter()
+		handler(rw, q)
+		return rw.outmsg
+	}
+	signed := func(out *dns.Msg) bool {
+		for _, rr := range append(out.Answer, out.Ns...) {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, v := range []struct {
+		name          string
+		edns, do, ad  bool
+		rcode         int
+		secure, rrsig bool
+	}{
+		{"www.example.", true, true, false, dns.RcodeSuccess, true, true},
+		{"www.example.", false, false, false, dns.RcodeSuccess, false, false}, // cached
+		{"www.example.", true, false, true, dns.RcodeSuccess, true, false},
+		{"nx.example.", true, true, false, dns.RcodeNameError, true, true},
+		{"www.insecure.", true, true, false, dns.RcodeSuccess, false, false},
+	} {
+		out := query(v.name, "A", v.edns, v.do, v.ad)
+		if out.Rcode != v.rcode || out.AuthenticatedData != v.secure || signed(out) != v.rrsig {
+			t.Errorf("%s (edns=%t do=%t ad=%t): rcode=%s ad=%t rrsig=%t", v.name, v.edns, v.do, v.ad,
+				dns.RcodeToString[out.Rcode], out.AuthenticatedData, signed(out))
+		}
+		if !v.edns && out.IsEdns0() != nil {
+			t.Errorf("%s: unexpected EDNS in response", v.name)
+		}
+	}
+
+	// Bogus answers are SERVFAIL with an extended error (and not cached)
+	zones.tamper = true
+	c.Cache.DeleteName("www.example.", "A", false)
+	out := query("www.example.", "A", true, false, false)
+	if out.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Expected SERVFAIL: %s", dns.RcodeToString[out.Rcode])
+	}
+	var ede *dns.EDNS0_EDE
+	for _, o := range out.IsEdns0().Option {
+		ede, _ = o.(*dns.EDNS0_EDE)
+	}
+	if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeDNSBogus {
+		t.Errorf("Expected DNSSEC Bogus EDE: %v", out.IsEdns0())
+	}
+	if _, found := c.Cache.GetName("www.example.", "A"); found {
+		t.Errorf("Bogus answer cached")
+	}
+
+	// Clients setting CD get the unvalidated answer (still not cached)
+	q := util.CreateQuery("www.example.", "A")
+	q.SetEdns0(1232, true)
+	q.CheckingDisabled = true
+	rw := NewTestResponseWriter()
+	handler(rw, q)
+	if out := rw.outmsg; out.Rcode != dns.RcodeSuccess || out.AuthenticatedData || len(out.Answer) == 0 {
+		t.Errorf("Expected unvalidated answer with CD: rcode=%s ad=%t answer=%v",
+			dns.RcodeToString[out.Rcode], out.AuthenticatedData, out.Answer)
+	}
+	if _, found := c.Cache.GetName("www.example.", "A"); found {
+		t.Errorf("Unvalidated answer cached")
+	}
+}
+
+func TestHandlerDnssecTimeout(t *testing.T) {
+
+	example := dnssec.NewTestZone(t, "example.", true, false, "www.example. 300 IN A 192.0.2.1")
+	root := dnssec.NewTestZone(t, ".", true, false, "example. 3600 IN NS ns.example.", example.DS().String())
+	zones := &zoneResolver{exchange: dnssec.TestExchange(root, example), delay: 100 * time.Millisecond}
+
+	handler, c := getTestHandler(t, `{
+		"dnssec": true,
+		"discard": true
+	}`)
+	c.Dnssec, _ = dnssec.NewValidator([]dns.RR{root.DS()})
+	c.Upstream = []resolver.Resolver{zones}
+
+	// Each lookup is within the timeout but the answer and chain lookups
+	// together are not
+	c.UpstreamTimeout = 250 * time.Millisecond
+	q := util.CreateQuery("www.example.", "A")
+	q.SetEdns0(1232, true)
+	rw := NewTestResponseWriter()
+	start := time.Now()
+	handler(rw, q)
+	if rw.outmsg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL: %s", dns.RcodeToString[rw.outmsg.Rcode])
+	}
+	if elapsed := time.Since(start); elapsed > 350*time.Millisecond {
+		t.Errorf("Validation exceeded query deadline: %s", elapsed)
+	}
+}
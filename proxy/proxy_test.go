@@ -1,14 +1,57 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/cache"
 	"github.com/paulc/dinosaur-dns/config"
 	"github.com/paulc/dinosaur-dns/logger"
 	"github.com/paulc/dinosaur-dns/resolver"
 	"github.com/paulc/dinosaur-dns/util"
 )
 
+// stubResolver answers every query with a single A record (or an empty
+// response with rcode if set) after delay (or when the context is done), or
+// fails with err if set. Calls are counted.
+type stubResolver struct {
+	name  string
+	addr  string
+	rcode int
+	delay time.Duration
+	err   error
+	calls atomic.Int32
+}
+
+func (r *stubResolver) Resolve(ctx context.Context, log *logger.Logger, q *dns.Msg) (*dns.Msg, error) {
+	r.calls.Add(1)
+	select {
+	case <-time.After(r.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	out := new(dns.Msg)
+	out.SetReply(q)
+	if r.rcode != dns.RcodeSuccess {
+		out.Rcode = r.rcode
+		return out, nil
+	}
+	rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A " + r.addr)
+	out.Answer = append(out.Answer, rr)
+	return out, nil
+}
+
+func (r *stubResolver) String() string { return r.name }
+
 func TestCheckUpstreamUdp(t *testing.T) {
 	if err := CheckUpstream("1.1.1.1:53"); err != nil {
 		t.Fatal(err)
@@ -43,7 +86,7 @@ func TestResolve(t *testing.T) {
 	c.Log = logger.New(logger.NewDiscard(false))
 
 	q := util.CreateQuery("127.0.0.1.nip.io.", "A")
-	out, err, cached := resolve(c, q)
+	out, err, cached, _ := resolve(context.Background(), c, q)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -61,12 +104,12 @@ func TestResolveCached(t *testing.T) {
 	c.Log = logger.New(logger.NewDiscard(false))
 
 	q := util.CreateQuery("127.0.0.1.nip.io.", "A")
-	_, err, _ := resolve(c, q)
+	_, err, _, _ := resolve(context.Background(), c, q)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	out, err, cached := resolve(c, q)
+	out, err, cached, _ := resolve(context.Background(), c, q)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -85,7 +128,7 @@ func TestResolveInvalidUpstream(t *testing.T) {
 	c.Log = logger.New(logger.NewDiscard(false))
 
 	q := util.CreateQuery("127.0.0.1.nip.io.", "A")
-	out, err, cached := resolve(c, q)
+	out, err, cached, _ := resolve(context.Background(), c, q)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -98,11 +141,543 @@ func TestResolveInvalidUpstream(t *testing.T) {
 	}
 
 	// Check demotion
-	resolve(c, util.CreateQuery("127.0.0.2.nip.io.", "A")) // Avoid cache
-	resolve(c, util.CreateQuery("127.0.0.3.nip.io.", "A"))
-	resolve(c, util.CreateQuery("127.0.0.4.nip.io.", "A"))
+	resolve(context.Background(), c, util.CreateQuery("127.0.0.2.nip.io.", "A")) // Avoid cache
+	resolve(context.Background(), c, util.CreateQuery("127.0.0.3.nip.io.", "A"))
+	resolve(context.Background(), c, util.CreateQuery("127.0.0.4.nip.io.", "A"))
+
+	if c.Health.State(c.Upstream[0]) != resolver.HealthOpen {
+		t.Errorf("Error: Should have opened circuit for invalid upstream")
+	}
+}
+
+func TestResolveStubFailover(t *testing.T) {
+
+	bad := &stubResolver{name: "bad", addr: "1.2.3.4", err: errors.New("fail")}
+	good := &stubResolver{name: "good", addr: "1.2.3.4"}
+
+	c := config.NewProxyConfig()
+	c.Upstream = []resolver.Resolver{bad, good}
+	c.Log = logger.New(logger.NewDiscard(false))
+
+	for _, v := range []string{"a", "b", "c"} {
+		q := util.CreateQuery(v+".example.com.", "A")
+		out, err, _, _ := resolve(context.Background(), c, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		util.CheckResponse(t, q, out, "1.2.3.4")
+	}
+
+	if c.Health.State(bad) != resolver.HealthOpen {
+		t.Errorf("Error: Should have opened circuit for failing upstream")
+	}
+
+	// Unhealthy upstream is skipped
+	resolve(context.Background(), c, util.CreateQuery("d.example.com.", "A"))
+	if n := bad.calls.Load(); n != 3 {
+		t.Errorf("Unhealthy upstream called %d times (expected 3)", n)
+	}
+
+	// Recovery (via probes) restores the configured order
+	bad.err = nil
+	for i := 0; i < resolver.DefaultHealthRecovery; i++ {
+		c.Health.Probe(context.Background(), c.Log, c.Upstream)
+	}
+	if c.Health.State(bad) != resolver.HealthClosed {
+		t.Fatalf("Error: Should have closed circuit after recovery")
+	}
+	resolve(context.Background(), c, util.CreateQuery("e.example.com.", "A"))
+	if n := bad.calls.Load(); n != 3+resolver.DefaultHealthRecovery+1 {
+		t.Errorf("Recovered upstream not tried first (%d calls)", n)
+	}
+}
+
+func TestResolveRcodeFailover(t *testing.T) {
+
+	refused := &stubResolver{name: "refused", rcode: dns.RcodeRefused}
+	servfail := &stubResolver{name: "servfail", rcode: dns.RcodeServerFailure}
+	good := &stubResolver{name: "good", addr: "1.2.3.4"}
+
+	c := config.NewProxyConfig()
+	c.Upstream = []resolver.Resolver{refused, servfail, good}
+	c.Log = logger.New(logger.NewDiscard(false))
+
+	for _, v := range []string{"a", "b", "c"} {
+		q := util.CreateQuery(v+".example.com.", "A")
+		out, err, _, upstream := resolve(context.Background(), c, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		util.CheckResponse(t, q, out, "1.2.3.4")
+		if upstream != "good" {
+			t.Errorf("Upstream: %s (expected good)", upstream)
+		}
+	}
+
+	// Failure rcodes count against the upstream's health but are still
+	// recorded in its metrics
+	for _, r := range []resolver.Resolver{refused, servfail} {
+		if c.Health.State(r) != resolver.HealthOpen {
+			t.Errorf("Error: Should have opened circuit for %s", r)
+		}
+	}
+	m := c.Metrics.Status([]resolver.Resolver{refused})[0]
+	if m.Rcodes["REFUSED"] != 3 {
+		t.Errorf("Metrics rcodes: %v", m.Rcodes)
+	}
+
+	// With no failure rcodes the first response is returned
+	c = config.NewProxyConfig()
+	c.Upstream = []resolver.Resolver{refused, good}
+	c.FailureRcodes = map[int]bool{}
+	c.Log = logger.New(logger.NewDiscard(false))
+	out, err, _, upstream := resolve(context.Background(), c, util.CreateQuery("d.example.com.", "A"))
+	if err != nil || out.Rcode != dns.RcodeRefused || upstream != "refused" {
+		t.Errorf("Expected REFUSED from refused: %v %v %s", out, err, upstream)
+	}
+}
+
+func TestResolveRcodeBestAnswer(t *testing.T) {
+
+	refused := &stubResolver{name: "refused", rcode: dns.RcodeRefused}
+	servfail := &stubResolver{name: "servfail", rcode: dns.RcodeServerFailure}
+	nxdomain := &stubResolver{name: "nxdomain", rcode: dns.RcodeNameError}
+
+	c := config.NewProxyConfig()
+	c.Upstream = []resolver.Resolver{refused, servfail}
+	c.Log = logger.New(logger.NewDiscard(false))
+
+	q := util.CreateQuery("best.example.com.", "A")
+	if _, err, _, _ := resolve(context.Background(), c, q); err == nil {
+		t.Fatal("Expected error when all upstreams fail")
+	}
+
+	// Best failed response is returned (and not cached)
+	c.FailureBestAnswer = true
+	out, err, _, upstream := resolve(context.Background(), c, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Rcode != dns.RcodeServerFailure || upstream != "servfail" {
+		t.Errorf("Expected SERVFAIL from servfail: %s %s", dns.RcodeToString[out.Rcode], upstream)
+	}
+	if _, found := c.Cache.Get(q); found {
+		t.Errorf("Failed response should not be cached")
+	}
+
+	// NXDOMAIN ranks above SERVFAIL and REFUSED (racing upstreams)
+	c = config.NewProxyConfig()
+	c.Upstream = []resolver.Resolver{refused, nxdomain, servfail}
+	c.Strategy = resolver.NewRaceStrategy(3)
+	c.FailureRcodes = map[int]bool{dns.RcodeServerFailure: true, dns.RcodeRefused: true, dns.RcodeNameError: true}
+	c.FailureBestAnswer = true
+	c.Log = logger.New(logger.NewDiscard(false))
+	out, err, _, upstream = resolve(context.Background(), c, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Rcode != dns.RcodeNameError || upstream != "nxdomain" {
+		t.Errorf("Expected NXDOMAIN from nxdomain: %s %s", dns.RcodeToString[out.Rcode], upstream)
+	}
+}
+
+func TestResolveRace(t *testing.T) {
+
+	slow := &stubResolver{name: "slow", addr: "1.1.1.1", delay: 500 * time.Millisecond}
+	fast := &stubResolver{name: "fast", addr: "2.2.2.2"}
+
+	c := config.NewProxyConfig()
+	c.Upstream = []resolver.Resolver{slow, fast}
+	c.Strategy = resolver.NewRaceStrategy(2)
+	c.Log = logger.New(logger.NewDiscard(false))
+
+	q := util.CreateQuery("race.example.com.", "A")
+	start := time.Now()
+	out, err, _, _ := resolve(context.Background(), c, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "2.2.2.2")
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("race waited for slow upstream: %s", elapsed)
+	}
+	// Slow upstream is queried concurrently (its goroutine may not have been scheduled yet)
+	for i := 0; i < 100 && slow.calls.Load() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if slow.calls.Load() != 1 || fast.calls.Load() != 1 {
+		t.Errorf("expected both upstreams queried: slow=%d fast=%d", slow.calls.Load(), fast.calls.Load())
+	}
+}
 
-	if c.Upstream[0].String() != "1.1.1.1:53" {
-		t.Errorf("Error: Should have demoted invalid upstream")
+func TestResolveRaceFallthrough(t *testing.T) {
+
+	bad1 := &stubResolver{name: "bad1", err: errors.New("fail")}
+	bad2 := &stubResolver{name: "bad2", err: errors.New("fail")}
+	good := &stubResolver{name: "good", addr: "1.2.3.4"}
+
+	c := config.NewProxyConfig()
+	c.Upstream = []resolver.Resolver{bad1, bad2, good}
+	c.Strategy = resolver.NewRaceStrategy(2)
+	c.Log = logger.New(logger.NewDiscard(false))
+
+	// First batch fails - second batch (good) should answer
+	q := util.CreateQuery("race.example.com.", "A")
+	out, err, _, _ := resolve(context.Background(), c, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "1.2.3.4")
+}
+
+func TestResolveBudget(t *testing.T) {
+
+	hung := &stubResolver{name: "hung", addr: "1.1.1.1", delay: time.Hour}
+	good := &stubResolver{name: "good", addr: "2.2.2.2"}
+
+	c := config.NewProxyConfig()
+	c.Upstream = []resolver.Resolver{hung, good}
+	c.UpstreamTimeout = 400 * time.Millisecond
+	c.Log = logger.New(logger.NewDiscard(false))
+
+	// The hung upstream gets half the budget, leaving time for failover
+	q := util.CreateQuery("budget.example.com.", "A")
+	start := time.Now()
+	out, err, _, upstream := resolve(context.Background(), c, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "2.2.2.2")
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 350*time.Millisecond {
+		t.Errorf("unexpected failover time: %s", elapsed)
+	}
+	if upstream != "good" {
+		t.Errorf("unexpected upstream: %q", upstream)
+	}
+	metrics := c.Metrics.Status(c.Upstream)
+	if metrics[0].Timeouts != 1 || metrics[0].Successes != 0 || metrics[1].Successes != 1 {
+		t.Errorf("unexpected metrics: %+v", metrics)
+	}
+
+	// Overall deadline applies when every upstream hangs
+	c.Upstream = []resolver.Resolver{hung}
+	start = time.Now()
+	if _, err, _, _ := resolve(context.Background(), c, util.CreateQuery("hung.example.com.", "A")); err == nil {
+		t.Error("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Errorf("query exceeded budget: %s", elapsed)
+	}
+}
+
+func TestResolveCancel(t *testing.T) {
+
+	hung := &stubResolver{name: "hung", addr: "1.1.1.1", delay: time.Hour}
+
+	c := config.NewProxyConfig()
+	c.Upstream = []resolver.Resolver{hung}
+	c.Log = logger.New(logger.NewDiscard(false))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err, _, _ := resolve(ctx, c, util.CreateQuery("cancel.example.com.", "A")); err == nil {
+		t.Error("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled query not abandoned: %s", elapsed)
+	}
+
+	// Cancellation is not counted against the upstream
+	if s := c.Health.Status(c.Upstream); s[0].Failures != 0 {
+		t.Errorf("cancelled query reported as upstream failure")
+	}
+}
+
+func TestResolveCoalesced(t *testing.T) {
+
+	slow := &stubResolver{name: "slow", addr: "1.2.3.4", delay: 100 * time.Millisecond}
+
+	c := config.NewProxyConfig()
+	c.Upstream = []resolver.Resolver{slow}
+	c.Log = logger.New(logger.NewDiscard(false))
+
+	// Concurrent cache misses for the same name share one upstream query
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := util.CreateQuery("popular.example.com.", "A")
+			out, err, _, _ := resolve(context.Background(), c, q)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			util.CheckResponse(t, q, out, "1.2.3.4")
+		}()
+	}
+	wg.Wait()
+	if slow.calls.Load() != 1 {
+		t.Errorf("expected 1 upstream query, got %d", slow.calls.Load())
+	}
+	if s := c.Coalescer.Stats(); s.Queries != 5 || s.Coalesced != 4 {
+		t.Errorf("unexpected coalescer stats: %+v", s)
+	}
+}
+
+func TestResolveForward(t *testing.T) {
+
+	def := &stubResolver{name: "default", addr: "1.1.1.1"}
+	corp := &stubResolver{name: "corp", addr: "10.0.0.1"}
+	dev := &stubResolver{name: "dev", addr: "10.0.0.2"}
+
+	c := config.NewProxyConfig()
+	c.Upstream = []resolver.Resolver{def}
+	c.Forward = []config.ForwardZone{
+		{Domain: "dev.corp.example.", Upstream: []resolver.Resolver{dev}, Strategy: resolver.NewFailoverStrategy()},
+		{Domain: "corp.example.", Upstream: []resolver.Resolver{corp}, Strategy: resolver.NewFailoverStrategy()},
+	}
+	c.Log = logger.New(logger.NewDiscard(false))
+
+	for qname, expected := range map[string]string{
+		"www.example.com.":       "1.1.1.1",
+		"host.corp.example.":     "10.0.0.1",
+		"host.dev.corp.example.": "10.0.0.2",
+		"HOST.Dev.Corp.Example.": "10.0.0.2",
+	} {
+		q := util.CreateQuery(qname, "A")
+		out, err, _, _ := resolve(context.Background(), c, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		util.CheckResponse(t, q, out, expected)
+	}
+}
+
+func TestResolveTruncatedCached(t *testing.T) {
+
+	// UDP answers are truncated, TCP answers complete
+	addr := util.StartTestServer(t, func(w dns.ResponseWriter, q *dns.Msg) {
+		out := new(dns.Msg)
+		out.SetReply(q)
+		if util.IsTCP(w) {
+			rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN TXT \"large\"")
+			out.Answer = append(out.Answer, rr)
+		} else {
+			out.Truncated = true
+		}
+		w.WriteMsg(out)
+	})
+
+	c := config.NewProxyConfig()
+	c.Upstream = []resolver.Resolver{resolver.NewUdpResolver(addr)}
+	c.Log = logger.New(logger.NewDiscard(false))
+
+	q := util.CreateQuery("large.example.com.", "TXT")
+	if _, err, _, _ := resolve(context.Background(), c, q); err != nil {
+		t.Fatal(err)
+	}
+	out, found := c.Cache.Get(q)
+	if !found {
+		t.Fatal("Error: TCP fallback response not cached")
+	}
+	if out.Truncated || len(out.Answer) != 1 {
+		t.Errorf("Error: unexpected cached response: %s", out)
+	}
+}
+
+func TestResolveRebind(t *testing.T) {
+
+	for _, v := range []struct {
+		rebind  string
+		addr    string
+		qname   string
+		rcode   int
+		answers int
+	}{
+		{config.RebindOff, "192.168.1.1", "a.example.com.", dns.RcodeSuccess, 1},
+		{config.RebindDrop, "1.2.3.4", "a.example.com.", dns.RcodeSuccess, 1},
+		{config.RebindDrop, "192.168.1.1", "a.example.com.", dns.RcodeSuccess, 0},
+		{config.RebindDrop, "127.0.0.1", "a.example.com.", dns.RcodeSuccess, 0},
+		{config.RebindDrop, "169.254.1.1", "a.example.com.", dns.RcodeSuccess, 0},
+		{config.RebindNxdomain, "10.0.0.1", "a.example.com.", dns.RcodeNameError, 0},
+		{config.RebindNxdomain, "10.0.0.1", "nas.home.arpa.", dns.RcodeSuccess, 1},
+	} {
+		c := config.NewProxyConfig()
+		c.Upstream = []resolver.Resolver{&stubResolver{name: "stub", addr: v.addr}}
+		c.Rebind = v.rebind
+		c.RebindAllow = []string{"home.arpa."}
+		c.Log = logger.New(logger.NewDiscard(false))
+
+		out, err, _, _ := resolve(context.Background(), c, util.CreateQuery(v.qname, "A"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Rcode != v.rcode || len(out.Answer) != v.answers {
+			t.Errorf("%s %s %s: rcode=%s answers=%d", v.rebind, v.addr, v.qname, dns.RcodeToString[out.Rcode], len(out.Answer))
+		}
+	}
+
+	for addr, expected := range map[string]bool{
+		"1.2.3.4":              false,
+		"0.0.0.0":              true,
+		"0.1.2.3":              true,
+		"100.64.0.1":           true,
+		"100.127.255.254":      true,
+		"100.128.0.1":          false,
+		"::1":                  true,
+		"fe80::1":              true,
+		"fd00::1":              true,
+		"2001:db8::1":          false,
+		"::ffff:10.0.0.1":      true,
+		"::ffff:127.0.0.1":     true,
+		"::ffff:1.2.3.4":       false,
+		"64:ff9b::192.168.1.1": true,
+		"64:ff9b::100.64.0.1":  true,
+		"64:ff9b::1.2.3.4":     false,
+	} {
+		if got := rebindAddress(net.ParseIP(addr)); got != expected {
+			t.Errorf("rebindAddress(%s): expected %t", addr, expected)
+		}
+	}
+
+	// Local records are exempt
+	c := config.NewProxyConfig()
+	c.Upstream = []resolver.Resolver{&stubResolver{name: "stub", addr: "192.168.1.1"}}
+	c.Rebind = config.RebindNxdomain
+	c.Log = logger.New(logger.NewDiscard(false))
+	if err := c.Cache.AddRRString("router.lan. 60 IN A 192.168.1.1", true, false); err != nil {
+		t.Fatal(err)
+	}
+	q := util.CreateQuery("router.lan.", "A")
+	out, err, cached, _ := resolve(context.Background(), c, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "192.168.1.1")
+	if !cached {
+		t.Errorf("Error: local record not cached")
+	}
+}
+
+func TestResolveStale(t *testing.T) {
+
+	stub := &stubResolver{name: "stub", addr: "1.2.3.4"}
+	c := config.NewProxyConfig()
+	c.Upstream = []resolver.Resolver{stub}
+	c.Cache.StaleWindow = time.Hour
+	c.Log = logger.New(logger.NewDiscard(false))
+
+	q := util.CreateQuery("stale.example.com.", "A")
+	q.SetEdns0(dns.DefaultMsgSize, false)
+	if _, err, _, _ := resolve(context.Background(), c, q); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expire the entry and fail the upstream
+	for k, v := range c.Cache.Cache {
+		v.Expires = time.Now().Add(-time.Second)
+		c.Cache.Cache[k] = v
+	}
+	stub.err = errors.New("unreachable")
+
+	out, err, cached, _ := resolve(context.Background(), c, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "1.2.3.4")
+	if !cached || out.Answer[0].Header().Ttl != cache.StaleTTL {
+		t.Errorf("Invalid stale answer: cached=%t ttl=%d", cached, out.Answer[0].Header().Ttl)
+	}
+	ede, ok := out.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+	if !ok || ede.InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Errorf("Expected Stale Answer EDE: %v", out.IsEdns0())
+	}
+
+	// Served again without waiting for the upstream, which is not retried
+	// until cache.StaleRecheck has passed
+	calls := stub.calls.Load()
+	for i := 0; i < 3; i++ {
+		if _, err, cached, _ := resolve(context.Background(), c, q); err != nil || !cached {
+			t.Errorf("Expected stale answer: %v", err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if stub.calls.Load() != calls {
+		t.Errorf("Upstream retried before recheck: %d", stub.calls.Load()-calls)
+	}
+
+	// and then refreshed in the background
+	c.Cache.Lock()
+	for k, v := range c.Cache.Cache {
+		v.Stale = v.Stale.Add(-cache.StaleRecheck)
+		c.Cache.Cache[k] = v
+	}
+	c.Cache.Unlock()
+	if _, err, cached, _ := resolve(context.Background(), c, q); err != nil || !cached {
+		t.Errorf("Expected stale answer: %v", err)
+	}
+	for i := 0; stub.calls.Load() == calls; i++ {
+		if i == 100 {
+			t.Fatal("No background refresh")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// No stale answer without a cache entry
+	if _, err, _, _ := resolve(context.Background(), c, util.CreateQuery("other.example.com.", "A")); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+func TestResolvePrefetch(t *testing.T) {
+
+	stub := &stubResolver{name: "stub", addr: "1.2.3.4"}
+	c := config.NewProxyConfig()
+	c.Upstream = []resolver.Resolver{stub}
+	c.Cache.Prefetch = 0.1
+	c.Log = logger.New(logger.NewDiscard(false))
+
+	q := util.CreateQuery("prefetch.example.com.", "A")
+	if _, err, _, _ := resolve(context.Background(), c, q); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the entry to the last 10% of its TTL
+	c.Cache.Lock()
+	for k, v := range c.Cache.Cache {
+		v.Inserted, v.Expires = time.Now().Add(-57*time.Second), time.Now().Add(3*time.Second)
+		c.Cache.Cache[k] = v
+	}
+	c.Cache.Unlock()
+
+	for i := 0; i < cache.DefaultPrefetchHits; i++ {
+		out, err, cached, _ := resolve(context.Background(), c, q)
+		if err != nil || !cached {
+			t.Fatalf("Expected cached answer: %v", err)
+		}
+		util.CheckResponse(t, q, out, "1.2.3.4")
+	}
+
+	// Refreshed in the background
+	for i := 0; stub.calls.Load() != 2 || c.Cache.Stats().Prefetches != 1; i++ {
+		if i == 100 {
+			t.Fatalf("No prefetch: calls=%d", stub.calls.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; ; i++ {
+		out, _, _, _ := resolve(context.Background(), c, q)
+		if out.Answer[0].Header().Ttl > 3 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Entry not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stub.calls.Load() != 2 {
+		t.Errorf("Unexpected upstream calls: %d", stub.calls.Load())
 	}
 }
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/config"
+)
+
+var (
+	// Address space not covered by the netip.Addr predicates: "this network"
+	// (which browsers route to localhost) and shared CGNAT space
+	rebindPrefixes = []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/8"),
+		netip.MustParsePrefix("100.64.0.0/10"),
+	}
+	// NAT64 well-known prefix (RFC 6052), embedding an IPv4 address
+	nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+)
+
+// rebindAddress reports whether ip is in private, loopback, link-local,
+// unspecified or CGNAT address space (which public names should not resolve
+// to). IPv4 addresses embedded in IPv4-mapped and NAT64 IPv6 addresses are
+// checked as IPv4.
+func rebindAddress(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	if nat64Prefix.Contains(addr) {
+		b := addr.As16()
+		addr = netip.AddrFrom4([4]byte(b[12:]))
+	}
+	if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range rebindPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// rebindFilter applies the DNS rebinding protection policy to out, an
+// upstream response, and returns the response to use (out itself if
+// unchanged). Names under cfg.RebindAllow are exempt. Local records never
+// pass through here as they are answered from the cache.
+func rebindFilter(cfg *config.ProxyConfig, out *dns.Msg) *dns.Msg {
+	if cfg.Rebind == config.RebindOff || out.Rcode != dns.RcodeSuccess {
+		return out
+	}
+	qname := out.Question[0].Name
+	if matchDomain(cfg.RebindAllow, qname) {
+		return out
+	}
+	answer := make([]dns.RR, 0, len(out.Answer))
+	for _, rr := range out.Answer {
+		switch v := rr.(type) {
+		case *dns.A:
+			if rebindAddress(v.A) {
+				continue
+			}
+		case *dns.AAAA:
+			if rebindAddress(v.AAAA) {
+				continue
+			}
+		}
+		answer = append(answer, rr)
+	}
+	if len(answer) == len(out.Answer) {
+		return out
+	}
+	cfg.Log.Debugf("Rebind: <%s %s> private address in answer [%s]", qname, dns.TypeToString[out.Question[0].Qtype], cfg.Rebind)
+	if cfg.Rebind == config.RebindNxdomain {
+		m := new(dns.Msg)
+		m.SetRcode(out, dns.RcodeNameError)
+		m.RecursionAvailable = out.RecursionAvailable
+		return m
+	}
+	// Drop the signatures over the changed RRsets too
+	out.Answer = answer[:0]
+	for _, rr := range answer {
+		if sig, ok := rr.(*dns.RRSIG); ok && (sig.TypeCovered == dns.TypeA || sig.TypeCovered == dns.TypeAAAA) {
+			continue
+		}
+		out.Answer = append(out.Answer, rr)
+	}
+	out.AuthenticatedData = false
+	return out
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/config"
+)
+
+// staleAnswer marks out, an expired cache entry answering q, as stale with an
+// extended DNS error (RFC 8914) if q uses EDNS.
+func staleAnswer(q *dns.Msg, out *dns.Msg) *dns.Msg {
+	if opt := q.IsEdns0(); opt != nil {
+		if out.IsEdns0() == nil {
+			out.SetEdns0(opt.UDPSize(), opt.Do())
+		}
+		ede := out.IsEdns0()
+		ede.Option = append(ede.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+	}
+	return out
+}
+
+// refresh resolves q upstream in the background after a stale answer was
+// served, so that the cache entry is replaced once the upstreams recover
+// (concurrent refreshes are coalesced).
+func refresh(config *config.ProxyConfig, q *dns.Msg) {
+	_, _, _, err := config.Coalescer.Do(context.Background(), q, func(ctx context.Context) (*dns.Msg, string, error) {
+		return resolveUpstream(ctx, config, q)
+	})
+	if err != nil {
+		config.Log.Debugf("Stale: <%s %s> refresh failed: %s", q.Question[0].Name, dns.TypeToString[q.Question[0].Qtype], err)
+		return
+	}
+	// Drop the stale entry if the new answer was not cached
+	config.Cache.DeleteStale(q)
+}
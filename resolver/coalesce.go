@@ -0,0 +1,113 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// CoalescerStats are the query counters of a Coalescer.
+type CoalescerStats struct {
+	Queries   uint64 `json:"queries"`   // queries passed to Do
+	Coalesced uint64 `json:"coalesced"` // queries that joined a flight already in progress
+	InFlight  int    `json:"inflight"`  // distinct queries currently in progress
+}
+
+type flight struct {
+	done     chan struct{}
+	cancel   context.CancelFunc
+	waiters  int
+	out      *dns.Msg
+	upstream string
+	err      error
+}
+
+// Coalescer shares a single upstream request between identical concurrent
+// queries (same name, type, class, DO bit and ECS subnet).
+type Coalescer struct {
+	sync.Mutex
+	flights   map[string]*flight
+	queries   uint64
+	coalesced uint64
+}
+
+func NewCoalescer() *Coalescer {
+	return &Coalescer{flights: make(map[string]*flight)}
+}
+
+func coalesceKey(q *dns.Msg) string {
+	question := q.Question[0]
+	do, ecs := false, ""
+	if opt := q.IsEdns0(); opt != nil {
+		do = opt.Do()
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+				ecs = e.String()
+			}
+		}
+	}
+	return fmt.Sprintf("%s %d %d %t %s", dns.CanonicalName(question.Name), question.Qtype, question.Qclass, do, ecs)
+}
+
+// Do calls fn for q unless an identical query is already in flight, in which
+// case it waits for that result instead (shared is true). Each caller gets
+// its own copy of the response with its query ID. fn runs detached from the
+// caller's cancellation and is only cancelled when every caller waiting for
+// it has given up.
+func (c *Coalescer) Do(ctx context.Context, q *dns.Msg, fn func(context.Context) (*dns.Msg, string, error)) (out *dns.Msg, upstream string, shared bool, err error) {
+	key := coalesceKey(q)
+
+	c.Lock()
+	c.queries++
+	f, shared := c.flights[key]
+	if shared {
+		c.coalesced++
+	} else {
+		fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		c.flights[key] = f
+		go func() {
+			f.out, f.upstream, f.err = fn(fctx)
+			c.Lock()
+			if c.flights[key] == f {
+				delete(c.flights, key)
+			}
+			c.Unlock()
+			cancel()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	c.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		c.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// Nobody is waiting - abandon the flight
+			f.cancel()
+			if c.flights[key] == f {
+				delete(c.flights, key)
+			}
+		}
+		c.Unlock()
+		return nil, "", shared, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, "", shared, f.err
+	}
+	out = f.out.Copy()
+	out.Id = q.Id
+	return out, f.upstream, shared, nil
+}
+
+// Stats returns the query counters.
+func (c *Coalescer) Stats() CoalescerStats {
+	c.Lock()
+	defer c.Unlock()
+	return CoalescerStats{Queries: c.queries, Coalesced: c.coalesced, InFlight: len(c.flights)}
+}
@@ -0,0 +1,107 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/util"
+)
+
+func TestCoalescer(t *testing.T) {
+	c := NewCoalescer()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (*dns.Msg, string, error) {
+		calls.Add(1)
+		<-release
+		return answerA(util.CreateQuery("example.com.", "A")), "upstream", nil
+	}
+
+	// Identical queries share one call; each gets its own message ID
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := util.CreateQuery("Example.com.", "A")
+			out, upstream, _, err := c.Do(context.Background(), q, fn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if out.Id != q.Id || upstream != "upstream" {
+				t.Errorf("unexpected response: id %d (expected %d) upstream %q", out.Id, q.Id, upstream)
+			}
+		}()
+	}
+	for c.Stats().Queries != 10 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Errorf("expected 1 call, got %d", calls.Load())
+	}
+	if s := c.Stats(); s.Coalesced != 9 || s.InFlight != 0 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	// Different qtype or DO bit are separate flights
+	q := util.CreateQuery("example.com.", "AAAA")
+	c.Do(context.Background(), q, fn)
+	q = util.CreateQuery("example.com.", "A")
+	q.SetEdns0(1232, true)
+	c.Do(context.Background(), q, fn)
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 calls, got %d", calls.Load())
+	}
+}
+
+func TestCoalescerCancel(t *testing.T) {
+	c := NewCoalescer()
+	cancelled := make(chan struct{})
+	fn := func(ctx context.Context) (*dns.Msg, string, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, "", ctx.Err()
+	}
+
+	// The flight continues while anyone is waiting for it
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	for _, ctx := range []context.Context{ctx1, ctx2} {
+		go func() {
+			_, _, _, err := c.Do(ctx, util.CreateQuery("example.com.", "A"), fn)
+			errs <- err
+		}()
+	}
+	for c.Stats().Queries != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel1()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("unexpected error: %v", err)
+	}
+	select {
+	case <-cancelled:
+		t.Fatal("flight cancelled with a caller still waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// ... and is cancelled when the last caller gives up
+	cancel2()
+	<-errs
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("flight not cancelled")
+	}
+	if s := c.Stats(); s.InFlight != 0 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
@@ -0,0 +1,342 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/logger"
+	"golang.org/x/net/proxy"
+)
+
+// Dialer opens the transport connections of TCP, DoT, DoQ and DoH upstreams.
+// If Bootstrap is set upstream hostnames are resolved through it rather than
+// the system resolver (which may be dinosaur itself). If Proxy is set TCP
+// connections are tunnelled through a SOCKS5 or HTTP CONNECT proxy, which
+// also resolves the upstream hostname. A nil *Dialer dials directly.
+type Dialer struct {
+	Bootstrap *Bootstrap
+	Proxy     *url.URL
+}
+
+// ParseProxy parses a proxy URL (socks5://[user:pass@]host:port or
+// http://[user:pass@]host:port).
+func ParseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy (%s): %s", proxy, err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, fmt.Errorf("Invalid proxy (%s): scheme must be socks5 or http", proxy)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("Invalid proxy (%s): host:port required", proxy)
+	}
+	return u, nil
+}
+
+// proxied reports whether connections are made through a proxy.
+func (d *Dialer) proxied() bool {
+	return d != nil && d.Proxy != nil
+}
+
+// direct returns d without its proxy (keeping the bootstrap resolvers).
+func (d *Dialer) direct() *Dialer {
+	if !d.proxied() {
+		return d
+	}
+	return &Dialer{Bootstrap: d.Bootstrap}
+}
+
+// withOptions returns the dialer to use for an upstream, applying the
+// per-upstream 'proxy' option ('proxy=none' connects directly), and the
+// options it did not consume. The global proxy only applies to TCP-based
+// transports (tcp set); other upstreams connect directly unless the option
+// names a proxy, which they reject.
+func (d *Dialer) withOptions(options url.Values, tcp bool) (*Dialer, url.Values, error) {
+	if !options.Has("proxy") {
+		if !tcp {
+			return d.direct(), options, nil
+		}
+		return d, options, nil
+	}
+	rest := url.Values{}
+	for k, v := range options {
+		if k != "proxy" {
+			rest[k] = v
+		}
+	}
+	if options.Get("proxy") == "none" {
+		return d.direct(), rest, nil
+	}
+	proxy, err := ParseProxy(options.Get("proxy"))
+	if err != nil {
+		return nil, nil, err
+	}
+	out := &Dialer{Proxy: proxy}
+	if d != nil {
+		out.Bootstrap = d.Bootstrap
+	}
+	return out, rest, nil
+}
+
+// lookup returns the addresses to try for a host:port address.
+func (d *Dialer) lookup(ctx context.Context, address string) ([]string, error) {
+	if d == nil || d.Bootstrap == nil {
+		return []string{address}, nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.Bootstrap.Lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	return addrs, nil
+}
+
+// attemptContext returns ctx bounded by an even share of the time left
+// before its deadline for attempt i of n, so that an address that hangs
+// leaves time for the rest. The last attempt gets all of the time left.
+func attemptContext(ctx context.Context, i, n int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || i >= n-1 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(n-i))
+}
+
+// DialContext connects to address through the proxy, or directly trying each
+// bootstrap address in turn (see attemptContext).
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.proxied() {
+		return d.dialProxy(ctx, network, address)
+	}
+	addrs, err := d.lookup(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{KeepAlive: 30 * time.Second}
+	for i, addr := range addrs {
+		attempt, cancel := attemptContext(ctx, i, len(addrs))
+		var conn net.Conn
+		conn, err = dialer.DialContext(attempt, network, addr)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// dialProxy opens a tunnel to address through the proxy. The upstream
+// hostname is passed to the proxy unresolved.
+func (d *Dialer) dialProxy(ctx context.Context, network, address string) (net.Conn, error) {
+	forward := &net.Dialer{KeepAlive: 30 * time.Second}
+	switch d.Proxy.Scheme {
+	case "socks5":
+		var auth *proxy.Auth
+		if d.Proxy.User != nil {
+			password, _ := d.Proxy.User.Password()
+			auth = &proxy.Auth{User: d.Proxy.User.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", d.Proxy.Host, auth, forward)
+		if err != nil {
+			return nil, fmt.Errorf("SOCKS5 proxy: %s", err)
+		}
+		conn, err := socks.(proxy.ContextDialer).DialContext(ctx, network, address)
+		if err != nil {
+			return nil, fmt.Errorf("SOCKS5 proxy: %s", err)
+		}
+		return conn, nil
+	default:
+		conn, err := forward.DialContext(ctx, "tcp", d.Proxy.Host)
+		if err != nil {
+			return nil, fmt.Errorf("HTTP proxy: %s", err)
+		}
+		if err := httpConnect(ctx, conn, d.Proxy, address); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("HTTP proxy: %s", err)
+		}
+		return conn, nil
+	}
+}
+
+// httpConnect sends an HTTP CONNECT request for address over conn and reads
+// the proxy response.
+func httpConnect(ctx context.Context, conn net.Conn, proxy *url.URL, address string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		return err
+	}
+	// Read the response byte-wise from conn so that nothing after the header
+	// is consumed (the tunnel carries the upstream protocol from here on)
+	resp, err := http.ReadResponse(bufio.NewReader(oneByteReader{conn}), request)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT %s: %s", address, resp.Status)
+	}
+	return nil
+}
+
+// oneByteReader limits each Read to a single byte.
+type oneByteReader struct {
+	io.Reader
+}
+
+func (r oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.Reader.Read(p)
+}
+
+// ── Bootstrap ─────────────────────────────────────────────────────────────────
+
+const (
+	// Bounds on the time a bootstrap lookup is cached, regardless of TTL
+	bootstrapMinTTL = 10 * time.Second
+	bootstrapMaxTTL = 24 * time.Hour
+)
+
+type bootstrapHost struct {
+	addrs   []string
+	expires time.Time
+}
+
+// Bootstrap resolves upstream hostnames (A and AAAA) through a list of plain
+// IP resolvers, tried in order. Results are cached for the minimum TTL of
+// the answer; if re-resolution fails the expired addresses are used rather
+// than failing the upstream.
+type Bootstrap struct {
+	sync.Mutex
+	servers []Resolver
+	hosts   map[string]*bootstrapHost
+	log     *logger.Logger
+}
+
+func NewBootstrap(servers []string) (*Bootstrap, error) {
+	b := &Bootstrap{
+		hosts: make(map[string]*bootstrapHost),
+		log:   logger.New(logger.NewDiscard(false)),
+	}
+	for _, v := range servers {
+		host, _, err := net.SplitHostPort(v)
+		if err != nil {
+			host = v
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("Invalid bootstrap resolver (%s): must be an IP address", v)
+		}
+		b.servers = append(b.servers, NewUdpResolver(withPort(v, "53")))
+	}
+	if len(b.servers) == 0 {
+		return nil, errors.New("Invalid bootstrap: no resolvers")
+	}
+	return b, nil
+}
+
+// Lookup returns the addresses of host (IPv4 first). IP addresses are
+// returned unchanged.
+func (b *Bootstrap) Lookup(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	name := dns.Fqdn(host)
+
+	b.Lock()
+	cached, ok := b.hosts[name]
+	b.Unlock()
+	if ok && timeNow().Before(cached.expires) {
+		return cached.addrs, nil
+	}
+
+	addrs, ttl, err := b.resolve(ctx, name)
+	if err != nil {
+		if ok {
+			return cached.addrs, nil
+		}
+		return nil, fmt.Errorf("Bootstrap lookup (%s): %s", host, err)
+	}
+	b.Lock()
+	b.hosts[name] = &bootstrapHost{addrs: addrs, expires: timeNow().Add(ttl)}
+	b.Unlock()
+	return addrs, nil
+}
+
+// resolve queries each bootstrap server in turn for the A and AAAA records
+// of name, returning the addresses and the time they may be cached for.
+func (b *Bootstrap) resolve(ctx context.Context, name string) ([]string, time.Duration, error) {
+	err := errors.New("no servers")
+	for _, server := range b.servers {
+		addrs := make([]string, 0)
+		ttl := bootstrapMaxTTL
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
+			q := new(dns.Msg)
+			q.SetQuestion(name, qtype)
+			var out *dns.Msg
+			if out, err = server.Resolve(ctx, b.log, q); err != nil {
+				break
+			}
+			if out.Rcode != dns.RcodeSuccess {
+				err = fmt.Errorf("%s", dns.RcodeToString[out.Rcode])
+				break
+			}
+			for _, rr := range out.Answer {
+				switch v := rr.(type) {
+				case *dns.A:
+					addrs = append(addrs, v.A.String())
+				case *dns.AAAA:
+					addrs = append(addrs, v.AAAA.String())
+				default:
+					continue
+				}
+				ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+			}
+		}
+		if err == nil {
+			if len(addrs) == 0 {
+				return nil, 0, errors.New("no addresses")
+			}
+			return addrs, max(ttl, bootstrapMinTTL), nil
+		}
+	}
+	return nil, 0, err
+}
@@ -0,0 +1,454 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/logger"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// DNSCrypt v2 (https://dnscrypt.info/protocol) with the
+// X25519-XSalsa20Poly1305 construction.
+
+const (
+	dnscryptCertMagic     = "DNSC"
+	dnscryptResolverMagic = "r6fnvWj8"
+
+	// es-version of the X25519-XSalsa20Poly1305 construction
+	dnscryptXSalsa20Poly1305 = 1
+
+	// dnscryptCertRefresh is how often the certificate is re-fetched so that
+	// a rotated resolver key is picked up before the old one expires.
+	dnscryptCertRefresh = time.Hour
+
+	// dnscryptCertRetry is the minimum interval between certificate fetches
+	// after one has failed.
+	dnscryptCertRetry = 10 * time.Second
+
+	// Queries are padded to a multiple of dnscryptPadBlock, and sent over UDP
+	// padded to at least dnscryptMinUDPQuery
+	dnscryptPadBlock    = 64
+	dnscryptMinUDPQuery = 256
+
+	dnscryptNonceSize     = 24
+	dnscryptHalfNonceSize = dnscryptNonceSize / 2
+)
+
+// DnscryptStamp is a decoded sdns:// DNSCrypt server stamp.
+type DnscryptStamp struct {
+	Props        uint64 // DNSSEC (1), no logs (2), no filter (4)
+	Address      string // host:port (default port 443)
+	ProviderKey  ed25519.PublicKey
+	ProviderName string // e.g. 2.dnscrypt-cert.example.com.
+}
+
+// ParseDnscryptStamp decodes an sdns:// stamp for a DNSCrypt server:
+//
+//	0x01 | props (8 LE) | LP(addr) | LP(provider pk) | LP(provider name)
+func ParseDnscryptStamp(stamp string) (*DnscryptStamp, error) {
+	encoded, ok := strings.CutPrefix(stamp, "sdns://")
+	if !ok {
+		return nil, fmt.Errorf("Invalid DNSCrypt stamp (%s): expected sdns://", stamp)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid DNSCrypt stamp (%s): %s", stamp, err)
+	}
+	if len(b) < 9 || b[0] != 0x01 {
+		return nil, fmt.Errorf("Invalid DNSCrypt stamp (%s): not a DNSCrypt stamp", stamp)
+	}
+	s := &DnscryptStamp{Props: binary.LittleEndian.Uint64(b[1:9])}
+	b = b[9:]
+	fields := make([][]byte, 3)
+	for i := range fields {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return nil, fmt.Errorf("Invalid DNSCrypt stamp (%s): truncated", stamp)
+		}
+		fields[i], b = b[1:1+int(b[0])], b[1+int(b[0]):]
+	}
+	if len(fields[1]) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Invalid DNSCrypt stamp (%s): invalid provider public key", stamp)
+	}
+	s.ProviderKey = ed25519.PublicKey(fields[1])
+	s.ProviderName = dns.Fqdn(string(fields[2]))
+	if _, ok := dns.IsDomainName(s.ProviderName); !ok || len(fields[2]) == 0 {
+		return nil, fmt.Errorf("Invalid DNSCrypt stamp (%s): invalid provider name", stamp)
+	}
+	s.Address = string(fields[0])
+	if _, _, err := net.SplitHostPort(s.Address); err != nil {
+		s.Address = net.JoinHostPort(strings.Trim(s.Address, "[]"), "443")
+	}
+	return s, nil
+}
+
+// dnscryptCert is a validated resolver certificate together with the shared
+// key derived from it.
+type dnscryptCert struct {
+	serial      uint32
+	clientMagic [8]byte
+	notBefore   time.Time
+	notAfter    time.Time
+	sharedKey   [32]byte
+}
+
+// DnscryptResolver sends queries to a DNSCrypt v2 server identified by an
+// sdns:// stamp. The resolver certificate is fetched (plain TXT query for
+// the provider name), its Ed25519 signature checked against the provider key
+// from the stamp, and re-fetched every dnscryptCertRefresh or on expiry so
+// that key rotation is followed. Queries go over UDP with a TCP retry if the
+// response is truncated. A client key pair is generated per resolver.
+type DnscryptResolver struct {
+	upstream  string
+	stamp     *DnscryptStamp
+	publicKey *[32]byte
+	secretKey *[32]byte
+
+	mu       sync.Mutex
+	cert     *dnscryptCert
+	fetched  time.Time
+	failed   time.Time     // time of the last failed fetch
+	fetchErr error         // error from the last failed fetch
+	fetching chan struct{} // closed when the in-flight fetch completes
+}
+
+func NewDnscryptResolver(upstream string) (*DnscryptResolver, error) {
+	stamp, err := ParseDnscryptStamp(upstream)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating DNSCrypt key: %s", err)
+	}
+	return &DnscryptResolver{
+		upstream:  upstream,
+		stamp:     stamp,
+		publicKey: publicKey,
+		secretKey: secretKey,
+	}, nil
+}
+
+func (r *DnscryptResolver) String() string { return r.upstream }
+
+func (r *DnscryptResolver) configure(dialer *Dialer, options url.Values) error {
+	dialer, options, err := dialer.withOptions(options, false)
+	if err != nil {
+		return err
+	}
+	if dialer.proxied() {
+		return fmt.Errorf("Invalid upstream (%s): DNSCrypt cannot be sent through a TCP proxy", r.upstream)
+	}
+	return unknownOption(r.upstream, options)
+}
+
+func (r *DnscryptResolver) Resolve(ctx context.Context, log *logger.Logger, q *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	cert, err := r.getCert(ctx, log)
+	if err != nil {
+		return nil, err
+	}
+	out, err := r.exchange(ctx, cert, q, "udp")
+	if err != nil {
+		return nil, fmt.Errorf("DNSCrypt Query Error: %s", err)
+	}
+	if out.Truncated {
+		log.Debugf("Truncated DNSCrypt response from %s - retrying over TCP", r.stamp.Address)
+		if out, err = r.exchange(ctx, cert, q, "tcp"); err != nil {
+			return nil, fmt.Errorf("DNSCrypt Query Error (TCP fallback): %s", err)
+		}
+	}
+	return out, nil
+}
+
+// getCert returns the current certificate, fetching a new one if there is
+// none, it has expired or dnscryptCertRefresh has elapsed. If a refresh
+// fails the current certificate is used until it expires. Only one fetch is
+// in flight at a time (queries without a valid certificate wait for it) and
+// a failed fetch is not retried for dnscryptCertRetry.
+func (r *DnscryptResolver) getCert(ctx context.Context, log *logger.Logger) (*dnscryptCert, error) {
+	r.mu.Lock()
+	for {
+		now := timeNow()
+		valid := r.cert != nil && now.Before(r.cert.notAfter)
+		if valid && now.Sub(r.fetched) < dnscryptCertRefresh {
+			r.mu.Unlock()
+			return r.cert, nil
+		}
+		if !r.failed.IsZero() && now.Sub(r.failed) < dnscryptCertRetry {
+			r.mu.Unlock()
+			if valid {
+				return r.cert, nil
+			}
+			return nil, r.fetchErr
+		}
+		if r.fetching == nil {
+			break
+		}
+		if valid {
+			r.mu.Unlock()
+			return r.cert, nil
+		}
+		fetching := r.fetching
+		r.mu.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		r.mu.Lock()
+	}
+
+	fetching := make(chan struct{})
+	r.fetching = fetching
+	r.mu.Unlock()
+
+	now := timeNow()
+	cert, err := r.fetchCert(ctx, now)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fetching = nil
+	close(fetching)
+	if err != nil {
+		// Don't back off if the query was cancelled
+		if ctx.Err() == nil {
+			r.failed = now
+			r.fetchErr = err
+		}
+		if r.cert != nil && now.Before(r.cert.notAfter) {
+			log.Printf("DNSCrypt certificate refresh failed (%s): %s", r.stamp.ProviderName, err)
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil && cert.serial != r.cert.serial {
+		log.Printf("DNSCrypt certificate rotated (%s): serial %d -> %d", r.stamp.ProviderName, r.cert.serial, cert.serial)
+	}
+	r.cert = cert
+	r.fetched = now
+	r.failed = time.Time{}
+	r.fetchErr = nil
+	return cert, nil
+}
+
+// fetchCert queries the provider name for TXT certificates and returns the
+// valid one with the highest serial.
+func (r *DnscryptResolver) fetchCert(ctx context.Context, now time.Time) (*dnscryptCert, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(r.stamp.ProviderName, dns.TypeTXT)
+	client := dns.Client{Timeout: clientTimeout}
+	out, err := exchangeAddr(ctx, &client, q, r.stamp.Address)
+	if err == nil && out.Truncated {
+		client.Net = "tcp"
+		out, err = exchangeAddr(ctx, &client, q, r.stamp.Address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DNSCrypt certificate query: %s", err)
+	}
+
+	var best *dnscryptCert
+	err = errors.New("no certificates")
+	for _, rr := range out.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		var b []byte
+		if b, err = txtBytes(txt); err != nil {
+			continue
+		}
+		var cert *dnscryptCert
+		if cert, err = r.parseCert(b, now); err != nil {
+			continue
+		}
+		if best == nil || cert.serial > best.serial {
+			best = cert
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("DNSCrypt certificate (%s): %s", r.stamp.ProviderName, err)
+	}
+	return best, nil
+}
+
+// parseCert validates a binary certificate:
+//
+//	"DNSC" | es-version (2) | minor (2) | signature (64) |
+//	resolver-pk (32) | client-magic (8) | serial (4) | ts-start (4) | ts-end (4) | extensions
+func (r *DnscryptResolver) parseCert(b []byte, now time.Time) (*dnscryptCert, error) {
+	if len(b) < 124 || string(b[:4]) != dnscryptCertMagic {
+		return nil, errors.New("invalid certificate")
+	}
+	if binary.BigEndian.Uint16(b[4:6]) != dnscryptXSalsa20Poly1305 {
+		return nil, errors.New("unsupported encryption system")
+	}
+	if !ed25519.Verify(r.stamp.ProviderKey, b[72:], b[8:72]) {
+		return nil, errors.New("invalid certificate signature")
+	}
+	cert := &dnscryptCert{
+		serial:    binary.BigEndian.Uint32(b[112:116]),
+		notBefore: time.Unix(int64(binary.BigEndian.Uint32(b[116:120])), 0),
+		notAfter:  time.Unix(int64(binary.BigEndian.Uint32(b[120:124])), 0),
+	}
+	if now.Before(cert.notBefore) || !now.Before(cert.notAfter) {
+		return nil, errors.New("certificate not valid at current time")
+	}
+	copy(cert.clientMagic[:], b[104:112])
+	var resolverKey [32]byte
+	copy(resolverKey[:], b[72:104])
+	box.Precompute(&cert.sharedKey, &resolverKey, r.secretKey)
+	return cert, nil
+}
+
+// exchange encrypts q, sends it over network ("udp" or "tcp") and decrypts
+// the response:
+//
+//	query:    client-magic | client-pk | client-nonce (12) | box(padded query)
+//	response: "r6fnvWj8" | client-nonce (12) | server-nonce (12) | box(padded response)
+func (r *DnscryptResolver) exchange(ctx context.Context, cert *dnscryptCert, q *dns.Msg, network string) (*dns.Msg, error) {
+	query, err := q.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("Error packing record: %s", err)
+	}
+	minSize := 0
+	if network == "udp" {
+		minSize = dnscryptMinUDPQuery
+	}
+	var nonce [dnscryptNonceSize]byte
+	if _, err := rand.Read(nonce[:dnscryptHalfNonceSize]); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, 0, 8+32+dnscryptHalfNonceSize+len(query)+box.Overhead+dnscryptPadBlock+minSize)
+	packet = append(packet, cert.clientMagic[:]...)
+	packet = append(packet, r.publicKey[:]...)
+	packet = append(packet, nonce[:dnscryptHalfNonceSize]...)
+	packet = box.SealAfterPrecomputation(packet, dnscryptPad(query, minSize), &nonce, &cert.sharedKey)
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, r.stamp.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	var response []byte
+	if network == "udp" {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		response = buf[:n]
+	} else {
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(packet)))); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		response = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return nil, err
+		}
+	}
+
+	header := len(dnscryptResolverMagic) + dnscryptNonceSize
+	if len(response) < header+box.Overhead || string(response[:len(dnscryptResolverMagic)]) != dnscryptResolverMagic {
+		return nil, errors.New("invalid response")
+	}
+	var responseNonce [dnscryptNonceSize]byte
+	copy(responseNonce[:], response[len(dnscryptResolverMagic):header])
+	if !bytes.Equal(responseNonce[:dnscryptHalfNonceSize], nonce[:dnscryptHalfNonceSize]) {
+		return nil, errors.New("response nonce mismatch")
+	}
+	plain, ok := box.OpenAfterPrecomputation(nil, response[header:], &responseNonce, &cert.sharedKey)
+	if !ok {
+		return nil, errors.New("response decryption failed")
+	}
+	if plain, err = dnscryptUnpad(plain); err != nil {
+		return nil, err
+	}
+	out := new(dns.Msg)
+	if err := out.Unpack(plain); err != nil {
+		return nil, fmt.Errorf("Error parsing DNS response: %s", err)
+	}
+	if out.Id != q.Id {
+		return nil, errors.New("response ID mismatch")
+	}
+	return out, nil
+}
+
+// dnscryptPad appends 0x80 and zero bytes to b up to a multiple of
+// dnscryptPadBlock (and at least minSize).
+func dnscryptPad(b []byte, minSize int) []byte {
+	size := (len(b) + 1 + dnscryptPadBlock - 1) / dnscryptPadBlock * dnscryptPadBlock
+	size = max(size, minSize)
+	out := make([]byte, size)
+	copy(out, b)
+	out[len(b)] = 0x80
+	return out
+}
+
+// dnscryptUnpad removes padding added by dnscryptPad.
+func dnscryptUnpad(b []byte) ([]byte, error) {
+	i := len(b) - 1
+	for i >= 0 && b[i] == 0 {
+		i--
+	}
+	if i < 0 || b[i] != 0x80 {
+		return nil, errors.New("invalid padding")
+	}
+	return b[:i], nil
+}
+
+// txtBytes returns the raw concatenated character-strings of a TXT record
+// (TXT.Txt holds them in escaped presentation form).
+func txtBytes(txt *dns.TXT) ([]byte, error) {
+	buf := make([]byte, dns.Len(txt))
+	off, err := dns.PackRR(txt, buf, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	// Header is the uncompressed owner name + type, class, ttl, rdlength
+	nameEnd, err := dns.PackDomainName(txt.Hdr.Name, make([]byte, 256), 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	rdata := buf[nameEnd+10 : off]
+	out := make([]byte, 0, len(rdata))
+	for len(rdata) > 0 {
+		n := int(rdata[0])
+		if len(rdata) < 1+n {
+			return nil, errors.New("invalid TXT record")
+		}
+		out = append(out, rdata[1:1+n]...)
+		rdata = rdata[1+n:]
+	}
+	return out, nil
+}
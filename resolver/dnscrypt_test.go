@@ -0,0 +1,383 @@
+package resolver
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/util"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// dnscryptServer is an in-process DNSCrypt v2 stand-in serving UDP and TCP on
+// the same port. All certificates added with addCert are returned in the TXT
+// response; encrypted queries are answered by answerA.
+type dnscryptServer struct {
+	addr         string
+	providerName string
+	providerKey  ed25519.PrivateKey
+
+	mu       sync.Mutex
+	certs    []string              // certificates as escaped TXT strings
+	keys     map[[8]byte]*[32]byte // client-magic -> resolver secret key
+	magics   [][8]byte             // client-magic of each encrypted query
+	truncate bool                  // truncate UDP responses
+
+	certQueries atomic.Int32
+	tcpQueries  atomic.Int32 // encrypted queries received over TCP
+}
+
+func startDnscryptServer(t *testing.T) *dnscryptServer {
+	t.Helper()
+	_, providerKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnscryptServer{
+		providerName: "2.dnscrypt-cert.example.com.",
+		providerKey:  providerKey,
+		keys:         make(map[[8]byte]*[32]byte),
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close(); l.Close() })
+	s.addr = pc.LocalAddr().String()
+
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if out := s.handle(buf[:n], false); out != nil {
+				pc.WriteTo(out, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				packet := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, packet); err != nil {
+					return
+				}
+				if out := s.handle(packet, true); out != nil {
+					conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(out))))
+					conn.Write(out)
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+// addCert generates a resolver key pair and adds a signed certificate for it.
+func (s *dnscryptServer) addCert(t *testing.T, serial uint32, notBefore, notAfter time.Time) {
+	t.Helper()
+	resolverPublic, resolverSecret, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var magic [8]byte
+	rand.Read(magic[:])
+	signed := append([]byte{}, resolverPublic[:]...)
+	signed = append(signed, magic[:]...)
+	signed = binary.BigEndian.AppendUint32(signed, serial)
+	signed = binary.BigEndian.AppendUint32(signed, uint32(notBefore.Unix()))
+	signed = binary.BigEndian.AppendUint32(signed, uint32(notAfter.Unix()))
+	cert := []byte("DNSC\x00\x01\x00\x00")
+	cert = append(cert, ed25519.Sign(s.providerKey, signed)...)
+	cert = append(cert, signed...)
+
+	// Escape as a TXT character-string
+	escaped := strings.Builder{}
+	for _, b := range cert {
+		if b < 0x20 || b > 0x7e || b == '"' || b == '\\' {
+			fmt.Fprintf(&escaped, "\\%03d", b)
+		} else {
+			escaped.WriteByte(b)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certs = append(s.certs, escaped.String())
+	s.keys[magic] = resolverSecret
+}
+
+// stamp returns the sdns:// stamp for the server, signed by providerKey.
+func (s *dnscryptServer) stamp(providerKey ed25519.PublicKey) string {
+	b := []byte{0x01}
+	b = binary.LittleEndian.AppendUint64(b, 1)
+	for _, v := range [][]byte{[]byte(s.addr), providerKey, []byte(strings.TrimSuffix(s.providerName, "."))} {
+		b = append(b, byte(len(v)))
+		b = append(b, v...)
+	}
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *dnscryptServer) handle(packet []byte, tcp bool) []byte {
+	var magic [8]byte
+	copy(magic[:], packet)
+	s.mu.Lock()
+	resolverSecret, encrypted := s.keys[magic]
+	s.mu.Unlock()
+
+	if !encrypted {
+		// Plain certificate query
+		q := new(dns.Msg)
+		if err := q.Unpack(packet); err != nil || q.Question[0].Name != s.providerName {
+			return nil
+		}
+		s.certQueries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(q)
+		s.mu.Lock()
+		for _, cert := range s.certs {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: s.providerName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{cert},
+			})
+		}
+		s.mu.Unlock()
+		out, _ := m.Pack()
+		return out
+	}
+
+	if tcp {
+		s.tcpQueries.Add(1)
+	}
+	s.mu.Lock()
+	s.magics = append(s.magics, magic)
+	truncate := s.truncate && !tcp
+	s.mu.Unlock()
+
+	var clientPublic, shared [32]byte
+	var nonce [24]byte
+	copy(clientPublic[:], packet[8:40])
+	copy(nonce[:12], packet[40:52])
+	box.Precompute(&shared, &clientPublic, resolverSecret)
+	plain, ok := box.OpenAfterPrecomputation(nil, packet[52:], &nonce, &shared)
+	if !ok {
+		return nil
+	}
+	if !tcp && len(plain) < dnscryptMinUDPQuery {
+		return nil
+	}
+	plain, err := dnscryptUnpad(plain)
+	if err != nil {
+		return nil
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(plain); err != nil {
+		return nil
+	}
+	m := answerA(q)
+	if truncate {
+		m.Answer = nil
+		m.Truncated = true
+	}
+	response, _ := m.Pack()
+	rand.Read(nonce[12:])
+	out := append([]byte(dnscryptResolverMagic), nonce[:]...)
+	return box.SealAfterPrecomputation(out, dnscryptPad(response, 0), &nonce, &shared)
+}
+
+func TestParseDnscryptStamp(t *testing.T) {
+	s := &dnscryptServer{addr: "192.0.2.1", providerName: "2.dnscrypt-cert.example.com."}
+	key := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	stamp, err := ParseDnscryptStamp(s.stamp(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stamp.Address != "192.0.2.1:443" || stamp.ProviderName != s.providerName || stamp.Props != 1 {
+		t.Errorf("unexpected stamp: %+v", stamp)
+	}
+	s.addr = "[2001:db8::1]:5443"
+	if stamp, err = ParseDnscryptStamp(s.stamp(key)); err != nil || stamp.Address != "[2001:db8::1]:5443" {
+		t.Errorf("unexpected stamp: %+v %v", stamp, err)
+	}
+
+	for _, v := range []string{
+		"https://example.com",
+		"sdns://!!!",
+		"sdns://" + base64.RawURLEncoding.EncodeToString([]byte{0x02, 0, 0, 0, 0, 0, 0, 0, 0}), // DoH stamp
+		"sdns://" + base64.RawURLEncoding.EncodeToString([]byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0, 4, '1'}),
+		s.stamp(key[:16]),
+	} {
+		if _, err := ParseDnscryptStamp(v); err == nil {
+			t.Errorf("%s: expected error", v)
+		}
+	}
+}
+
+func TestDnscryptResolver(t *testing.T) {
+	s := startDnscryptServer(t)
+	s.addCert(t, 1, time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+
+	r, err := NewResolver(s.stamp(s.providerKey.Public().(ed25519.PublicKey)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := discardLog()
+	for i := 0; i < 3; i++ {
+		q := util.CreateQuery(fmt.Sprintf("test%d.example.com.", i), "A")
+		out, err := r.Resolve(context.Background(), log, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		util.CheckResponse(t, q, out, "1.2.3.4")
+	}
+	if got := s.certQueries.Load(); got != 1 {
+		t.Errorf("expected certificate to be fetched once, got %d", got)
+	}
+
+	// Truncated UDP responses are retried over TCP
+	s.mu.Lock()
+	s.truncate = true
+	s.mu.Unlock()
+	q := util.CreateQuery("large.example.com.", "A")
+	out, err := r.Resolve(context.Background(), log, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "1.2.3.4")
+	if s.tcpQueries.Load() != 1 {
+		t.Error("expected TCP retry after truncated response")
+	}
+}
+
+func TestDnscryptResolverRotation(t *testing.T) {
+
+	// Use mock time.Now
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	s := startDnscryptServer(t)
+	s.addCert(t, 1, now.Add(-time.Hour), now.Add(2*time.Hour))
+	r, err := NewResolver(s.stamp(s.providerKey.Public().(ed25519.PublicKey)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := discardLog()
+	if _, err := r.Resolve(context.Background(), log, util.CreateQuery("example.com.", "A")); err != nil {
+		t.Fatal(err)
+	}
+
+	// New certificate published - picked up on the next refresh
+	s.addCert(t, 2, now, now.Add(24*time.Hour))
+	now = now.Add(dnscryptCertRefresh + time.Minute)
+	if _, err := r.Resolve(context.Background(), log, util.CreateQuery("example.com.", "A")); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.certQueries.Load(); got != 2 {
+		t.Errorf("expected certificate refresh, got %d certificate queries", got)
+	}
+	s.mu.Lock()
+	if len(s.magics) != 2 || s.magics[0] == s.magics[1] {
+		t.Error("query not sent with rotated certificate")
+	}
+	s.mu.Unlock()
+
+	// Only expired certificates available
+	now = now.Add(48 * time.Hour)
+	if _, err := r.Resolve(context.Background(), log, util.CreateQuery("example.com.", "A")); err == nil {
+		t.Error("expected error with expired certificates")
+	}
+
+	// Failed fetches are not retried until dnscryptCertRetry has elapsed
+	queries := s.certQueries.Load()
+	if _, err := r.Resolve(context.Background(), log, util.CreateQuery("example.com.", "A")); err == nil {
+		t.Error("expected error with expired certificates")
+	}
+	if got := s.certQueries.Load(); got != queries {
+		t.Errorf("expected no certificate query during backoff, got %d", got-queries)
+	}
+	s.mu.Lock()
+	s.certs = nil
+	s.mu.Unlock()
+	s.addCert(t, 3, now, now.Add(24*time.Hour))
+	now = now.Add(dnscryptCertRetry)
+	if _, err := r.Resolve(context.Background(), log, util.CreateQuery("example.com.", "A")); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.certQueries.Load(); got != queries+1 {
+		t.Errorf("expected certificate query after backoff, got %d", got-queries)
+	}
+}
+
+func TestDnscryptResolverConcurrent(t *testing.T) {
+	s := startDnscryptServer(t)
+	s.addCert(t, 1, time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+
+	r, err := NewResolver(s.stamp(s.providerKey.Public().(ed25519.PublicKey)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := discardLog()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := util.CreateQuery(fmt.Sprintf("test%d.example.com.", i), "A")
+			out, err := r.Resolve(context.Background(), log, q)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			util.CheckResponse(t, q, out, "1.2.3.4")
+		}()
+	}
+	wg.Wait()
+	if got := s.certQueries.Load(); got != 1 {
+		t.Errorf("expected certificate to be fetched once, got %d", got)
+	}
+}
+
+func TestDnscryptResolverInvalidCert(t *testing.T) {
+	s := startDnscryptServer(t)
+	s.addCert(t, 1, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+
+	// Stamp with a different provider key - certificate signature is invalid
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	r, err := NewResolver(s.stamp(other), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Resolve(context.Background(), discardLog(), util.CreateQuery("example.com.", "A")); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("expected signature error, got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package resolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// JSON DoH API as implemented by Google (https://dns.google/resolve) and
+// Cloudflare (https://cloudflare-dns.com/dns-query). Only the question name,
+// type and the DO/CD flags are sent; the response is translated back into a
+// dns.Msg so the rest of the pipeline (cache, DNS64) is unchanged.
+
+type dohJSONResponse struct {
+	Status     int
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Answer     []dohJSONRecord
+	Authority  []dohJSONRecord
+	Additional []dohJSONRecord
+}
+
+type dohJSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// rr parses the record from its presentation-format data.
+func (rec dohJSONRecord) rr() (dns.RR, error) {
+	t, ok := dns.TypeToString[rec.Type]
+	if !ok {
+		t = fmt.Sprintf("TYPE%d", rec.Type)
+	}
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(rec.Name), rec.TTL, t, rec.Data))
+	if err != nil {
+		return nil, err
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("empty record")
+	}
+	return rr, nil
+}
+
+func newDohJSONRequest(ctx context.Context, upstream string, q *dns.Msg) (*http.Request, error) {
+	if len(q.Question) != 1 {
+		return nil, fmt.Errorf("Error creating HTTP request: JSON API requires a single question")
+	}
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating HTTP request: %s", err)
+	}
+	params := u.Query()
+	params.Set("name", q.Question[0].Name)
+	params.Set("type", strconv.Itoa(int(q.Question[0].Qtype)))
+	if opt := q.IsEdns0(); opt != nil && opt.Do() {
+		params.Set("do", "1")
+	}
+	if q.CheckingDisabled {
+		params.Set("cd", "1")
+	}
+	u.RawQuery = params.Encode()
+	request, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating HTTP request: %s", err)
+	}
+	request.Header.Set("Accept", "application/dns-json")
+	return request, nil
+}
+
+// parseDohJSON translates a JSON API response body into a reply to q.
+func parseDohJSON(q *dns.Msg, body []byte) (*dns.Msg, error) {
+	resp := dohJSONResponse{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("Error parsing JSON response: %s", err)
+	}
+
+	out := new(dns.Msg)
+	out.SetReply(q)
+	out.Rcode = resp.Status
+	out.Truncated = resp.TC
+	out.RecursionDesired = resp.RD
+	out.RecursionAvailable = resp.RA
+	out.AuthenticatedData = resp.AD
+	out.CheckingDisabled = resp.CD
+
+	sections := []struct {
+		records []dohJSONRecord
+		rrs     *[]dns.RR
+	}{
+		{resp.Answer, &out.Answer},
+		{resp.Authority, &out.Ns},
+		{resp.Additional, &out.Extra},
+	}
+	for _, s := range sections {
+		for _, rec := range s.records {
+			rr, err := rec.rr()
+			if err != nil {
+				// Fail the query rather than cache a partial answer
+				return nil, fmt.Errorf("Error parsing JSON record (%s %d %s): %s", rec.Name, rec.Type, rec.Data, err)
+			}
+			*s.rrs = append(*s.rrs, rr)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,182 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dotConn is a DoT connection shared by concurrent queries (RFC 7766 §6.2.1.1
+// pipelining). Each query is sent with a message ID that is unique on the
+// connection and a reader goroutine matches responses to queries by ID, so
+// responses may arrive in any order. When the connection fails (including the
+// server closing it, or sending nothing for dotReadTimeout while queries are
+// outstanding) every outstanding query gets the error.
+type dotConn struct {
+	conn net.Conn
+	wmu  sync.Mutex // serialises writes
+
+	mu       sync.Mutex
+	pending  map[uint16]*dotQuery // outstanding queries by wire ID
+	deadline time.Time            // read deadline (zero if none pending)
+	err      error                // set once the connection has failed
+	done     chan struct{}        // closed when err is set
+}
+
+type dotQuery struct {
+	question dns.Question
+	response chan *dns.Msg
+}
+
+func newDotConn(conn net.Conn) *dotConn {
+	c := &dotConn{conn: conn, pending: make(map[uint16]*dotQuery), done: make(chan struct{})}
+	go c.read()
+	return c
+}
+
+// fail closes the connection and records err for outstanding and later
+// queries (the first error wins).
+func (c *dotConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.conn.Close()
+	close(c.done)
+}
+
+// status returns the number of outstanding queries and whether the
+// connection can take new ones.
+func (c *dotConn) status() (pending int, alive bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending), c.err == nil
+}
+
+// read delivers responses to the waiting queries until the connection fails.
+// Responses to abandoned queries, or with no matching query, are discarded.
+func (c *dotConn) read() {
+	var length [2]byte
+	for {
+		if _, err := io.ReadFull(c.conn, length[:]); err != nil {
+			c.fail(fmt.Errorf("DoT connection closed: %w", err))
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(c.conn, buf); err != nil {
+			c.fail(fmt.Errorf("DoT connection closed: %w", err))
+			return
+		}
+		out := new(dns.Msg)
+		if err := out.Unpack(buf); err != nil || len(out.Question) != 1 {
+			continue
+		}
+		c.mu.Lock()
+		query, ok := c.pending[out.Id]
+		if ok && matchQuestion(query.question, out.Question[0]) {
+			delete(c.pending, out.Id)
+		} else {
+			ok = false
+		}
+		c.setReadDeadline(true)
+		c.mu.Unlock()
+		if ok {
+			query.response <- out
+		}
+	}
+}
+
+// setReadDeadline allows dotReadTimeout from now for the next response if
+// there are outstanding queries and restart is set (or no deadline is set),
+// or clears the deadline if there are none (called with c.mu held).
+func (c *dotConn) setReadDeadline(restart bool) {
+	switch {
+	case len(c.pending) == 0:
+		c.deadline = time.Time{}
+	case restart || c.deadline.IsZero():
+		c.deadline = timeNow().Add(dotReadTimeout)
+	default:
+		return
+	}
+	c.conn.SetReadDeadline(c.deadline)
+}
+
+func matchQuestion(q, r dns.Question) bool {
+	return strings.EqualFold(q.Name, r.Name) && q.Qtype == r.Qtype && q.Qclass == r.Qclass
+}
+
+// exchange sends q on the connection and waits for the matching response.
+func (c *dotConn) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		return nil, errors.New("DoT query must have a single question")
+	}
+	wire := q.Copy()
+	query := &dotQuery{question: q.Question[0], response: make(chan *dns.Msg, 1)}
+
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	if len(c.pending) >= dotMaxQueries {
+		c.mu.Unlock()
+		return nil, errors.New("DoT connection busy")
+	}
+	for {
+		wire.Id = dns.Id()
+		if _, used := c.pending[wire.Id]; !used {
+			break
+		}
+	}
+	c.pending[wire.Id] = query
+	c.setReadDeadline(false)
+	c.mu.Unlock()
+
+	pack, err := wire.Pack()
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, wire.Id)
+		c.setReadDeadline(false)
+		c.mu.Unlock()
+		return nil, fmt.Errorf("Error packing record: %s", err)
+	}
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(pack)), uint16(len(pack)))
+	buf = append(buf, pack...)
+
+	// A partial write leaves the stream unusable, so any write error fails
+	// the connection
+	c.wmu.Lock()
+	deadline, _ := ctx.Deadline()
+	c.conn.SetWriteDeadline(deadline)
+	_, err = c.conn.Write(buf)
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(fmt.Errorf("DoT write: %w", err))
+		return nil, err
+	}
+
+	select {
+	case out := <-query.response:
+		out.Id = q.Id
+		return out, nil
+	case <-c.done:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return nil, c.err
+	case <-ctx.Done():
+		// The query stays outstanding until its response arrives so that a
+		// peer that has stopped answering is detected by the read deadline
+		return nil, ctx.Err()
+	}
+}
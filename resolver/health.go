@@ -0,0 +1,244 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/logger"
+)
+
+// For testing
+var timeNow = time.Now
+
+// HealthState is the circuit-breaker state of a single upstream.
+type HealthState int
+
+const (
+	// HealthClosed - upstream is healthy and used normally
+	HealthClosed HealthState = iota
+	// HealthOpen - upstream has failed repeatedly and is skipped
+	HealthOpen
+	// HealthHalfOpen - upstream is on trial; successes close the circuit again
+	HealthHalfOpen
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case HealthOpen:
+		return "open"
+	case HealthHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+const (
+	// Defaults for NewHealthChecker
+	DefaultHealthFailures = 3
+	DefaultHealthRecovery = 2
+	DefaultHealthCooldown = 60 * time.Second
+)
+
+type upstreamHealth struct {
+	state      HealthState
+	failures   int       // consecutive failures
+	successes  int       // consecutive successes while half-open
+	trial      time.Time // start of outstanding half-open trial (zero = none)
+	lastChange time.Time
+	lastCheck  time.Time
+	lastError  string
+}
+
+// HealthStatus is a snapshot of the health of a single upstream.
+type HealthStatus struct {
+	Upstream   string    `json:"upstream"`
+	State      string    `json:"state"`
+	Failures   int       `json:"failures"`
+	LastError  string    `json:"last_error"`
+	LastChange time.Time `json:"last_change"`
+	LastCheck  time.Time `json:"last_check"`
+}
+
+// HealthChecker implements a per-upstream circuit breaker fed by both query
+// results (Report) and active probes (Probe):
+//
+//	closed    --(Failures consecutive errors)--> open
+//	open      --(Cooldown elapsed or probe ok)--> half-open
+//	half-open --(Recovery consecutive successes)--> closed
+//	half-open --(any error)--> open
+//
+// Filter moves upstreams with an open circuit to the end of the try order so
+// they are only used as a last resort. While half-open a single query at a
+// time is allowed through as a trial.
+type HealthChecker struct {
+	sync.Mutex
+	Failures int
+	Recovery int
+	Cooldown time.Duration
+	upstream map[Resolver]*upstreamHealth
+}
+
+func NewHealthChecker() *HealthChecker {
+	return &HealthChecker{
+		Failures: DefaultHealthFailures,
+		Recovery: DefaultHealthRecovery,
+		Cooldown: DefaultHealthCooldown,
+		upstream: make(map[Resolver]*upstreamHealth),
+	}
+}
+
+// get returns the entry for r, creating it if necessary. Caller holds lock.
+func (h *HealthChecker) get(r Resolver) *upstreamHealth {
+	u, ok := h.upstream[r]
+	if !ok {
+		u = &upstreamHealth{lastChange: timeNow()}
+		h.upstream[r] = u
+	}
+	return u
+}
+
+// setState changes state and logs the transition. Caller holds lock.
+func (h *HealthChecker) setState(log *logger.Logger, r Resolver, u *upstreamHealth, state HealthState) {
+	if u.state == state {
+		return
+	}
+	log.Printf("Upstream %s: %s -> %s", r, u.state, state)
+	u.state = state
+	u.lastChange = timeNow()
+	u.failures = 0
+	u.successes = 0
+	u.trial = time.Time{}
+}
+
+// Report records the result of a query or probe sent to r.
+func (h *HealthChecker) Report(log *logger.Logger, r Resolver, err error) {
+	h.Lock()
+	defer h.Unlock()
+	u := h.get(r)
+	u.trial = time.Time{}
+	if err == nil {
+		u.failures = 0
+		switch u.state {
+		case HealthOpen:
+			h.setState(log, r, u, HealthHalfOpen)
+			u.successes = 1
+		case HealthHalfOpen:
+			u.successes++
+		}
+		if u.state == HealthHalfOpen && u.successes >= h.Recovery {
+			h.setState(log, r, u, HealthClosed)
+		}
+		return
+	}
+	u.lastError = err.Error()
+	u.failures++
+	switch u.state {
+	case HealthClosed:
+		if u.failures >= h.Failures {
+			h.setState(log, r, u, HealthOpen)
+		}
+	case HealthHalfOpen:
+		h.setState(log, r, u, HealthOpen)
+	case HealthOpen:
+		// Restart cooldown
+		u.lastChange = timeNow()
+	}
+}
+
+// available reports whether r may be used for a query, moving it from open
+// to half-open once the cooldown has elapsed and granting half-open trials
+// one at a time. Caller holds lock.
+func (h *HealthChecker) available(log *logger.Logger, r Resolver) bool {
+	u := h.get(r)
+	if u.state == HealthOpen && timeNow().Sub(u.lastChange) >= h.Cooldown {
+		h.setState(log, r, u, HealthHalfOpen)
+	}
+	switch u.state {
+	case HealthClosed:
+		return true
+	case HealthHalfOpen:
+		// A trial that was granted but never reported (e.g. an earlier
+		// upstream answered first) lapses after DefaultTimeout
+		if u.trial.IsZero() || timeNow().Sub(u.trial) > DefaultTimeout {
+			u.trial = timeNow()
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns order with unavailable upstreams moved to the end, keeping
+// the relative order of each group. Unavailable upstreams are still returned
+// so that a query can be answered if every upstream is unhealthy.
+func (h *HealthChecker) Filter(log *logger.Logger, order []Resolver) []Resolver {
+	h.Lock()
+	defer h.Unlock()
+	out := make([]Resolver, 0, len(order))
+	skipped := make([]Resolver, 0)
+	for _, r := range order {
+		if h.available(log, r) {
+			out = append(out, r)
+		} else {
+			skipped = append(skipped, r)
+		}
+	}
+	return append(out, skipped...)
+}
+
+// State returns the current circuit state of r.
+func (h *HealthChecker) State(r Resolver) HealthState {
+	h.Lock()
+	defer h.Unlock()
+	return h.get(r).state
+}
+
+// Probe sends the root NS query to every upstream concurrently and records
+// the results. It returns when all probes have completed (each is bounded by
+// DefaultTimeout) or ctx is done.
+func (h *HealthChecker) Probe(ctx context.Context, log *logger.Logger, upstreams []Resolver) {
+	wg := sync.WaitGroup{}
+	for _, r := range upstreams {
+		wg.Add(1)
+		go func(r Resolver) {
+			defer wg.Done()
+			q := new(dns.Msg)
+			q.SetQuestion(".", dns.TypeNS)
+			ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+			defer cancel()
+			_, err := r.Resolve(ctx, log, q)
+			if ctx.Err() == context.Canceled {
+				return // shutting down - not the upstream's fault
+			}
+			if err != nil {
+				log.Debugf("Health check <%s>: %s", r, err)
+			}
+			h.Lock()
+			h.get(r).lastCheck = timeNow()
+			h.Unlock()
+			h.Report(log, r, err)
+		}(r)
+	}
+	wg.Wait()
+}
+
+// Status returns a snapshot of the health of each upstream.
+func (h *HealthChecker) Status(upstreams []Resolver) []HealthStatus {
+	h.Lock()
+	defer h.Unlock()
+	out := make([]HealthStatus, 0, len(upstreams))
+	for _, r := range upstreams {
+		u := h.get(r)
+		out = append(out, HealthStatus{
+			Upstream:   r.String(),
+			State:      u.state.String(),
+			Failures:   u.failures,
+			LastError:  u.lastError,
+			LastChange: u.lastChange,
+			LastCheck:  u.lastCheck,
+		})
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package resolver
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthCircuitBreaker(t *testing.T) {
+
+	// Use mock time.Now
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	h := NewHealthChecker()
+	log := discardLog()
+	upstreams := testUpstreams("a", "b", "c")
+	a := upstreams[0]
+	fail := errors.New("fail")
+
+	// Below threshold - still closed
+	for i := 0; i < h.Failures-1; i++ {
+		h.Report(log, a, fail)
+	}
+	if h.State(a) != HealthClosed {
+		t.Fatalf("expected closed, got %s", h.State(a))
+	}
+
+	// Success resets the count
+	h.Report(log, a, nil)
+	h.Report(log, a, fail)
+	if h.State(a) != HealthClosed {
+		t.Fatalf("expected closed, got %s", h.State(a))
+	}
+
+	// Threshold reached - open and moved to the end
+	for i := 0; i < h.Failures; i++ {
+		h.Report(log, a, fail)
+	}
+	if h.State(a) != HealthOpen {
+		t.Fatalf("expected open, got %s", h.State(a))
+	}
+	if got := orderString(h.Filter(log, upstreams)); got != "bca" {
+		t.Fatalf("expected bca, got %s", got)
+	}
+
+	// Cooldown elapsed - half-open, single trial granted
+	now = now.Add(h.Cooldown)
+	if got := orderString(h.Filter(log, upstreams)); got != "abc" {
+		t.Fatalf("expected abc (trial), got %s", got)
+	}
+	if h.State(a) != HealthHalfOpen {
+		t.Fatalf("expected half-open, got %s", h.State(a))
+	}
+	if got := orderString(h.Filter(log, upstreams)); got != "bca" {
+		t.Fatalf("expected bca (trial outstanding), got %s", got)
+	}
+
+	// Failed trial - open again
+	h.Report(log, a, fail)
+	if h.State(a) != HealthOpen {
+		t.Fatalf("expected open, got %s", h.State(a))
+	}
+
+	// Successes (e.g. probes) close the circuit and restore configured order
+	for i := 0; i < h.Recovery; i++ {
+		h.Report(log, a, nil)
+	}
+	if h.State(a) != HealthClosed {
+		t.Fatalf("expected closed, got %s", h.State(a))
+	}
+	if got := orderString(h.Filter(log, upstreams)); got != "abc" {
+		t.Fatalf("expected abc, got %s", got)
+	}
+}
+
+func TestHealthTrialLapses(t *testing.T) {
+
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	h := NewHealthChecker()
+	log := discardLog()
+	upstreams := testUpstreams("a", "b")
+	for i := 0; i < h.Failures; i++ {
+		h.Report(log, upstreams[0], errors.New("fail"))
+	}
+	now = now.Add(h.Cooldown)
+	h.Filter(log, upstreams) // trial granted but never reported
+
+	now = now.Add(DefaultTimeout + time.Second)
+	if got := orderString(h.Filter(log, upstreams)); got != "ab" {
+		t.Errorf("expected lapsed trial to be re-granted, got %s", got)
+	}
+}
+
+func TestHealthStatus(t *testing.T) {
+	h := NewHealthChecker()
+	upstreams := testUpstreams("a", "b")
+	h.Report(discardLog(), upstreams[1], errors.New("timeout"))
+
+	status := h.Status(upstreams)
+	if len(status) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(status))
+	}
+	if status[1].Upstream != "b" || status[1].State != "closed" || status[1].Failures != 1 || status[1].LastError != "timeout" {
+		t.Errorf("unexpected status: %+v", status[1])
+	}
+}
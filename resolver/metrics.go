@@ -0,0 +1,141 @@
+package resolver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// latencyBuckets are the upper bounds of the latency histogram buckets (a
+// final bucket counts everything slower).
+var latencyBuckets = []time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second,
+}
+
+type upstreamMetrics struct {
+	queries    uint64
+	successes  uint64
+	timeouts   uint64
+	errors     uint64
+	rcodes     map[int]uint64
+	latency    []uint64 // per bucket, len(latencyBuckets)+1
+	latencySum time.Duration
+}
+
+// LatencyBucket is the number of responses with latency in the bucket
+// (above the previous bucket's bound, up to LE).
+type LatencyBucket struct {
+	LE    string `json:"le"` // upper bound ("+Inf" for the last bucket)
+	Count uint64 `json:"count"`
+}
+
+// PoolStats are the connection counters of a DoT upstream.
+type PoolStats struct {
+	Dials  uint64 `json:"dials"`  // new connections opened
+	Reuses uint64 `json:"reuses"` // queries sent on an already open connection
+	Dead   uint64 `json:"dead"`   // connections found closed (by the server or on error)
+}
+
+// UpstreamMetrics is a snapshot of the query metrics of a single upstream.
+// Successes are queries answered (with any rcode); failed queries are
+// counted as Timeouts or (transport) Errors. Latency covers successes only.
+type UpstreamMetrics struct {
+	Upstream   string            `json:"upstream"`
+	Queries    uint64            `json:"queries"`
+	Successes  uint64            `json:"successes"`
+	Timeouts   uint64            `json:"timeouts"`
+	Errors     uint64            `json:"errors"`
+	Rcodes     map[string]uint64 `json:"rcodes"`
+	LatencyAvg float64           `json:"latency_avg_ms"`
+	Latency    []LatencyBucket   `json:"latency"`
+	Pool       *PoolStats        `json:"pool,omitempty"`
+}
+
+// Metrics counts queries, outcomes and latency for each upstream.
+type Metrics struct {
+	sync.Mutex
+	upstream map[Resolver]*upstreamMetrics
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{upstream: make(map[Resolver]*upstreamMetrics)}
+}
+
+// get returns the entry for r, creating it if necessary. Caller holds lock.
+func (m *Metrics) get(r Resolver) *upstreamMetrics {
+	u, ok := m.upstream[r]
+	if !ok {
+		u = &upstreamMetrics{
+			rcodes:  make(map[int]uint64),
+			latency: make([]uint64, len(latencyBuckets)+1),
+		}
+		m.upstream[r] = u
+	}
+	return u
+}
+
+// Report records the outcome of a query sent to r. timeout marks an error
+// caused by the query deadline expiring.
+func (m *Metrics) Report(r Resolver, rtt time.Duration, out *dns.Msg, err error, timeout bool) {
+	m.Lock()
+	defer m.Unlock()
+	u := m.get(r)
+	u.queries++
+	switch {
+	case err == nil:
+		u.successes++
+		u.rcodes[out.Rcode]++
+		u.latencySum += rtt
+		i := 0
+		for i < len(latencyBuckets) && rtt > latencyBuckets[i] {
+			i++
+		}
+		u.latency[i]++
+	case timeout:
+		u.timeouts++
+	default:
+		u.errors++
+	}
+}
+
+// Status returns a snapshot of the metrics of each upstream.
+func (m *Metrics) Status(upstreams []Resolver) []UpstreamMetrics {
+	m.Lock()
+	defer m.Unlock()
+	out := make([]UpstreamMetrics, 0, len(upstreams))
+	for _, r := range upstreams {
+		u := m.get(r)
+		s := UpstreamMetrics{
+			Upstream:  r.String(),
+			Queries:   u.queries,
+			Successes: u.successes,
+			Timeouts:  u.timeouts,
+			Errors:    u.errors,
+			Rcodes:    make(map[string]uint64),
+			Latency:   make([]LatencyBucket, 0, len(u.latency)),
+		}
+		for rcode, n := range u.rcodes {
+			s.Rcodes[dns.RcodeToString[rcode]] = n
+		}
+		if u.successes > 0 {
+			s.LatencyAvg = float64(u.latencySum.Microseconds()) / float64(u.successes) / 1000
+		}
+		for i, n := range u.latency {
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = latencyBuckets[i].String()
+			}
+			s.Latency = append(s.Latency, LatencyBucket{LE: le, Count: n})
+		}
+		if p, ok := r.(interface{ PoolStats() PoolStats }); ok {
+			pool := p.PoolStats()
+			s.Pool = &pool
+		}
+		out = append(out, s)
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/util"
+)
+
+func TestMetrics(t *testing.T) {
+	a := NewUdpResolver("192.0.2.1:53")
+	b := NewUdpResolver("192.0.2.2:53")
+	m := NewMetrics()
+
+	ok := new(dns.Msg)
+	nx := new(dns.Msg)
+	nx.Rcode = dns.RcodeNameError
+	m.Report(a, 500*time.Microsecond, ok, nil, false)
+	m.Report(a, 30*time.Millisecond, ok, nil, false)
+	m.Report(a, 10*time.Second, nx, nil, false)
+	m.Report(a, time.Second, nil, errors.New("timeout"), true)
+	m.Report(a, time.Millisecond, nil, errors.New("refused"), false)
+
+	status := m.Status([]Resolver{a, b})
+	if len(status) != 2 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	s := status[0]
+	if s.Queries != 5 || s.Successes != 3 || s.Timeouts != 1 || s.Errors != 1 {
+		t.Errorf("unexpected counters: %+v", s)
+	}
+	if s.Rcodes["NOERROR"] != 2 || s.Rcodes["NXDOMAIN"] != 1 {
+		t.Errorf("unexpected rcodes: %v", s.Rcodes)
+	}
+	if len(s.Latency) != len(latencyBuckets)+1 {
+		t.Fatalf("unexpected buckets: %v", s.Latency)
+	}
+	// 500µs -> 1ms, 30ms -> 50ms, 10s -> +Inf
+	if s.Latency[0].Count != 1 || s.Latency[5].LE != "50ms" || s.Latency[5].Count != 1 || s.Latency[len(latencyBuckets)].LE != "+Inf" || s.Latency[len(latencyBuckets)].Count != 1 {
+		t.Errorf("unexpected histogram: %v", s.Latency)
+	}
+	if s.LatencyAvg < 3343 || s.LatencyAvg > 3344 {
+		t.Errorf("unexpected average latency: %f", s.LatencyAvg)
+	}
+	if s.Pool != nil {
+		t.Error("unexpected pool stats for UDP upstream")
+	}
+	if status[1].Upstream != "192.0.2.2:53" || status[1].Queries != 0 {
+		t.Errorf("unexpected status: %+v", status[1])
+	}
+}
+
+func TestMetricsDotPool(t *testing.T) {
+	cert, _ := testCert(t)
+	certFile, _ := writeCertFiles(t, cert)
+	addr := startDotServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	r, err := NewResolver("tls://"+addr+"#ca="+certFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := discardLog()
+	for i := 0; i < 3; i++ {
+		if _, err := r.Resolve(context.Background(), log, util.CreateQuery("example.com.", "A")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewMetrics().Status([]Resolver{r})[0]
+	if s.Pool == nil || s.Pool.Dials != 1 || s.Pool.Reuses != 2 || s.Pool.Dead != 0 {
+		t.Errorf("unexpected pool stats: %+v", s.Pool)
+	}
+}
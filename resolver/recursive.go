@@ -0,0 +1,520 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/logger"
+)
+
+// RootHints are the IANA root server addresses (https://www.iana.org/domains/root/servers).
+var RootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+	"2001:503:ba3e::2:30", "2801:1b8:10::b", "2001:500:2::c", "2001:500:2d::d",
+	"2001:500:a8::e", "2001:500:2f::f", "2001:500:12::d0d", "2001:500:1::53",
+	"2001:7fe::53", "2001:503:c27::2:30", "2001:7fd::1", "2001:500:9f::42",
+	"2001:dc3::35",
+}
+
+const (
+	// Bounds on a single recursive resolution
+	recursiveMaxDepth   = 8  // nested nameserver lookups / CNAME hops
+	recursiveMaxQueries = 64 // queries sent to authoritative servers
+	recursiveMaxServers = 3  // servers tried for each step
+
+	// recursiveTimeout is the per-server timeout (shorter than DefaultTimeout
+	// as the next server is tried on failure)
+	recursiveTimeout = 2 * time.Second
+
+	// recursiveMaxTTL bounds the time a delegation or address is cached
+	recursiveMaxTTL = 24 * time.Hour
+
+	// recursiveMaxCache is the number of cached delegations (or nameserver
+	// addresses) above which expired entries are swept
+	recursiveMaxCache = 10000
+)
+
+type zoneCut struct {
+	ns      []string // nameserver names
+	expires time.Time
+}
+
+type nsAddrs struct {
+	addrs   []string
+	expires time.Time
+}
+
+// RecursiveResolver resolves queries itself by iterating from the root
+// servers rather than forwarding to an upstream. Referrals are followed with
+// QNAME minimisation (RFC 9156) - each server is only sent the name one label
+// below the zone it is authoritative for - and the delegations (NS) and glue
+// learned along the way are cached for their TTL. Nameservers without glue
+// are resolved recursively (A and AAAA). Records outside the zone of the
+// answering server are discarded (and CNAME targets resolved from the root) so a server cannot
+// inject data for zones it is not authoritative for.
+type RecursiveResolver struct {
+	roots     []string // root server IPs
+	client    dns.Client
+	tcpClient dns.Client
+	address   func(ip string) string // nameserver IP -> host:port
+
+	mu    sync.Mutex
+	zones map[string]*zoneCut // delegations by (lower case) zone
+	hosts map[string]*nsAddrs // nameserver addresses by (lower case) name
+}
+
+func NewRecursiveResolver(roots []string) *RecursiveResolver {
+	return &RecursiveResolver{
+		roots:     roots,
+		client:    dns.Client{Timeout: clientTimeout},
+		tcpClient: dns.Client{Net: "tcp", Timeout: clientTimeout},
+		address:   func(ip string) string { return net.JoinHostPort(ip, "53") },
+		zones:     make(map[string]*zoneCut),
+		hosts:     make(map[string]*nsAddrs),
+	}
+}
+
+func (r *RecursiveResolver) String() string { return "recursive" }
+
+// configure applies the 'roots' option (comma-separated root server IPs,
+// replacing the built-in root hints).
+func (r *RecursiveResolver) configure(dialer *Dialer, options url.Values) error {
+	dialer, options, err := dialer.withOptions(options, false)
+	if err != nil {
+		return err
+	}
+	if dialer.proxied() {
+		return errors.New("Invalid upstream (recursive): recursive resolution cannot be sent through a TCP proxy")
+	}
+	if options.Has("roots") {
+		r.roots = nil
+		for _, v := range options["roots"] {
+			for _, ip := range strings.Split(v, ",") {
+				if net.ParseIP(ip) == nil {
+					return fmt.Errorf("Invalid upstream option (recursive): roots=%s (must be IP addresses)", v)
+				}
+				r.roots = append(r.roots, ip)
+			}
+		}
+		delete(options, "roots")
+	}
+	return unknownOption("recursive", options)
+}
+
+// recursion tracks the work done for a single query.
+type recursion struct {
+	ctx     context.Context
+	log     *logger.Logger
+	do      bool // request DNSSEC records (client set DO)
+	queries int
+}
+
+func (r *RecursiveResolver) Resolve(ctx context.Context, log *logger.Logger, q *dns.Msg) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		return nil, errors.New("Recursive Query Error: expected one question")
+	}
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	question := q.Question[0]
+	state := &recursion{ctx: ctx, log: log}
+	if opt := q.IsEdns0(); opt != nil {
+		state.do = opt.Do()
+	}
+	answer, authority, rcode, err := r.resolve(state, question.Name, question.Qtype, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Recursive Query Error (%s): %s", question.Name, err)
+	}
+	out := new(dns.Msg)
+	out.SetReply(q)
+	out.RecursionAvailable = true
+	out.Rcode = rcode
+	out.Answer = answer
+	out.Ns = authority
+	return out, nil
+}
+
+// resolve iterates from the closest known delegation of qname, returning the
+// answer and authority sections and rcode of the final response.
+func (r *RecursiveResolver) resolve(state *recursion, qname string, qtype uint16, depth int) ([]dns.RR, []dns.RR, int, error) {
+	if depth > recursiveMaxDepth {
+		return nil, nil, 0, errors.New("maximum recursion depth exceeded")
+	}
+	zone := r.closestZone(qname)
+	if qtype == dns.TypeDS && qname != "." {
+		// DS records are served by the parent zone
+		off, _ := dns.NextLabel(qname, 0)
+		zone = r.closestZone(qname[off:])
+	}
+	known := zone    // name already known to exist
+	minimise := true // QNAME minimisation still in use
+	for {
+		servers, err := r.servers(state, zone, depth)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		name, t := qname, qtype
+		if minimise {
+			if name = childName(known, qname); name != qname {
+				t = dns.TypeNS
+			}
+		}
+		resp, err := r.query(state, servers, name, t)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		answer := inZone(resp.Answer, zone)
+
+		if cut, ok := r.referral(resp, zone, name); ok && (qtype != dns.TypeDS || !strings.EqualFold(cut, qname)) {
+			zone, known = cut, cut
+			continue
+		}
+		if name != qname {
+			if resp.Rcode != dns.RcodeSuccess || len(answer) > 0 && answer[0].Header().Rrtype == dns.TypeCNAME {
+				// NXDOMAIN for an ancestor or an alias - some servers get
+				// this wrong for empty non-terminals so ask the full name
+				minimise = false
+			} else {
+				// NODATA (or NS at the apex of a zone on the same servers)
+				known = name
+			}
+			continue
+		}
+
+		// Final response - follow any CNAME chain not answered by this zone
+		chain, target := cnameChain(answer, qname)
+		if target == "" || qtype == dns.TypeCNAME || qtype == dns.TypeANY || resp.Rcode != dns.RcodeSuccess || hasType(answer, target, qtype) {
+			return answer, inZone(resp.Ns, zone), resp.Rcode, nil
+		}
+		state.log.Debugf("Recursive: following CNAME %s -> %s", qname, target)
+		more, authority, rcode, err := r.resolve(state, target, qtype, depth+1)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if state.do {
+			chain = append(chain, signatures(answer, chain)...)
+		}
+		return append(chain, more...), authority, rcode, nil
+	}
+}
+
+// query sends name/qtype to up to recursiveMaxServers of servers in turn,
+// returning the first NOERROR or NXDOMAIN response.
+func (r *RecursiveResolver) query(state *recursion, servers []string, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = false
+	m.SetEdns0(1232, state.do)
+
+	err := errors.New("no nameservers")
+	for i, ip := range servers {
+		if i == recursiveMaxServers {
+			break
+		}
+		if state.queries++; state.queries > recursiveMaxQueries {
+			return nil, errors.New("maximum queries exceeded")
+		}
+		var resp *dns.Msg
+		resp, err = r.exchange(state.ctx, m, r.address(ip))
+		if state.ctx.Err() != nil {
+			return nil, state.ctx.Err()
+		}
+		if err == nil && (len(resp.Question) != 1 || !strings.EqualFold(resp.Question[0].Name, name)) {
+			err = errors.New("question mismatch")
+		}
+		if err == nil && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			err = errors.New(dns.RcodeToString[resp.Rcode])
+		}
+		if err != nil {
+			err = fmt.Errorf("%s %s @%s: %s", name, dns.TypeToString[qtype], ip, err)
+			state.log.Debugf("Recursive: %s", err)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, err
+}
+
+// exchange sends m to addr (retrying over TCP if truncated), bounded by
+// recursiveTimeout.
+func (r *RecursiveResolver) exchange(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, recursiveTimeout)
+	defer cancel()
+	resp, err := exchangeAddr(ctx, &r.client, m, addr)
+	if err == nil && resp.Truncated {
+		resp, err = exchangeAddr(ctx, &r.tcpClient, m, addr)
+	}
+	return resp, err
+}
+
+// referral checks whether resp delegates name to a zone below zone, caching
+// the delegation and its in-bailiwick glue if so.
+func (r *RecursiveResolver) referral(resp *dns.Msg, zone, name string) (string, bool) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return "", false
+	}
+	var cut string
+	var ns []string
+	ttl := recursiveMaxTTL
+	for _, rr := range resp.Ns {
+		v, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(v.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, name) || (cut != "" && owner != cut) {
+			continue
+		}
+		cut = owner
+		ns = append(ns, strings.ToLower(v.Ns))
+		ttl = min(ttl, time.Duration(v.Hdr.Ttl)*time.Second)
+	}
+	if cut == "" {
+		return "", false
+	}
+
+	now := timeNow()
+	glue := make(map[string][]string)
+	glueTTL := make(map[string]time.Duration)
+	for _, rr := range resp.Extra {
+		owner := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(zone, owner) {
+			continue
+		}
+		var ip string
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A.String()
+		case *dns.AAAA:
+			ip = v.AAAA.String()
+		default:
+			continue
+		}
+		if _, seen := glueTTL[owner]; !seen {
+			glueTTL[owner] = recursiveMaxTTL
+		}
+		glue[owner] = append(glue[owner], ip)
+		glueTTL[owner] = min(glueTTL[owner], time.Duration(rr.Header().Ttl)*time.Second)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.zones) > recursiveMaxCache {
+		sweep(r.zones, func(v *zoneCut) bool { return now.After(v.expires) })
+	}
+	r.zones[cut] = &zoneCut{ns: ns, expires: now.Add(ttl)}
+	for _, v := range ns {
+		if addrs, ok := glue[v]; ok {
+			r.setHost(v, sortAddrs(addrs), now.Add(glueTTL[v]))
+		}
+	}
+	return cut, true
+}
+
+// servers returns the nameserver addresses for zone, resolving nameserver
+// names without cached addresses.
+func (r *RecursiveResolver) servers(state *recursion, zone string, depth int) ([]string, error) {
+	if zone == "." {
+		return shuffle(r.roots), nil
+	}
+	now := timeNow()
+	r.mu.Lock()
+	cut, ok := r.zones[zone]
+	var addrs []string
+	var missing []string
+	if ok {
+		for _, ns := range cut.ns {
+			if h, ok := r.hosts[ns]; ok && now.Before(h.expires) {
+				addrs = append(addrs, h.addrs...)
+			} else {
+				missing = append(missing, ns)
+			}
+		}
+	}
+	r.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no delegation for %s", zone)
+	}
+	if len(addrs) > 0 {
+		return shuffle(addrs), nil
+	}
+
+	err := fmt.Errorf("no nameserver addresses for %s", zone)
+	for _, ns := range missing {
+		// Nameservers inside the zone can only be reached with glue
+		if dns.IsSubDomain(zone, ns) {
+			continue
+		}
+		ttl := recursiveMaxTTL
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			answer, _, _, e := r.resolve(state, ns, qtype, depth+1)
+			if e != nil {
+				err = e
+				continue
+			}
+			for _, rr := range answer {
+				switch v := rr.(type) {
+				case *dns.A:
+					addrs = append(addrs, v.A.String())
+				case *dns.AAAA:
+					addrs = append(addrs, v.AAAA.String())
+				default:
+					continue
+				}
+				ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+			}
+		}
+		if len(addrs) > 0 {
+			addrs = sortAddrs(addrs)
+			r.mu.Lock()
+			r.setHost(ns, addrs, timeNow().Add(ttl))
+			r.mu.Unlock()
+			return shuffle(addrs), nil
+		}
+	}
+	return nil, err
+}
+
+// setHost caches the addresses of a nameserver (called with r.mu held).
+func (r *RecursiveResolver) setHost(name string, addrs []string, expires time.Time) {
+	if len(r.hosts) > recursiveMaxCache {
+		now := timeNow()
+		sweep(r.hosts, func(v *nsAddrs) bool { return now.After(v.expires) })
+	}
+	r.hosts[name] = &nsAddrs{addrs: addrs, expires: expires}
+}
+
+// closestZone returns the closest enclosing zone of name with a cached
+// (unexpired) delegation, or the root.
+func (r *RecursiveResolver) closestZone(name string) string {
+	now := timeNow()
+	name = strings.ToLower(dns.Fqdn(name))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		if name == "." {
+			return name
+		}
+		if cut, ok := r.zones[name]; ok && now.Before(cut.expires) {
+			return name
+		}
+		off, end := dns.NextLabel(name, 0)
+		if end {
+			return "."
+		}
+		name = name[off:]
+	}
+}
+
+// childName returns the ancestor of qname one label below known (or qname).
+func childName(known, qname string) string {
+	labels := dns.SplitDomainName(qname)
+	n := dns.CountLabel(known)
+	if n+1 >= len(labels) {
+		return qname
+	}
+	return dns.Fqdn(strings.Join(labels[len(labels)-n-1:], "."))
+}
+
+// inZone returns the records of rrs within zone.
+func inZone(rrs []dns.RR, zone string) []dns.RR {
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if dns.IsSubDomain(zone, rr.Header().Name) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// cnameChain follows CNAME records from name in answer, returning the chain
+// and the final target ("" if name is not an alias).
+func cnameChain(answer []dns.RR, name string) ([]dns.RR, string) {
+	var chain []dns.RR
+	target := ""
+	for i := 0; i < recursiveMaxDepth; i++ {
+		var next *dns.CNAME
+		for _, rr := range answer {
+			if v, ok := rr.(*dns.CNAME); ok && strings.EqualFold(v.Hdr.Name, name) {
+				next = v
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		chain = append(chain, next)
+		target, name = next.Target, next.Target
+	}
+	return chain, target
+}
+
+// signatures returns the RRSIG records in answer covering the records of rrs.
+func signatures(answer []dns.RR, rrs []dns.RR) []dns.RR {
+	var out []dns.RR
+	for _, rr := range answer {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		for _, v := range rrs {
+			if sig.TypeCovered == v.Header().Rrtype && strings.EqualFold(sig.Hdr.Name, v.Header().Name) {
+				out = append(out, sig)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// hasType reports whether answer contains a qtype record for name.
+func hasType(answer []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range answer {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortAddrs orders IPv4 addresses before IPv6 (which is more often
+// unreachable).
+func sortAddrs(addrs []string) []string {
+	out := make([]string, 0, len(addrs))
+	for _, v6 := range []bool{false, true} {
+		for _, v := range addrs {
+			if strings.Contains(v, ":") == v6 {
+				out = append(out, v)
+			}
+		}
+	}
+	return out
+}
+
+// shuffle returns the addresses in random order, IPv4 first.
+func shuffle(addrs []string) []string {
+	out := make([]string, len(addrs))
+	for i, j := range rand.Perm(len(addrs)) {
+		out[i] = addrs[j]
+	}
+	return sortAddrs(out)
+}
+
+// sweep deletes the entries of m for which expired returns true.
+func sweep[T any](m map[string]T, expired func(T) bool) {
+	for k, v := range m {
+		if expired(v) {
+			delete(m, k)
+		}
+	}
+}
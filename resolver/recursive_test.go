@@ -0,0 +1,328 @@
+package resolver
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/util"
+)
+
+// authServer is an in-process authoritative server for a set of zones. NS
+// records below a zone apex are delegations (answered with a referral and
+// any glue); everything else is answered authoritatively.
+type authServer struct {
+	zones     []string
+	records   []dns.RR
+	authority []dns.RR // added to authoritative responses
+
+	mu      sync.Mutex
+	queries []string // "name type" of each query received
+}
+
+func (s *authServer) handler(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	s.mu.Lock()
+	s.queries = append(s.queries, q.Name+" "+dns.TypeToString[q.Qtype])
+	s.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	zone := ""
+	for _, z := range s.zones {
+		if dns.IsSubDomain(z, q.Name) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+	if zone == "" {
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+
+	// Referral
+	for _, rr := range s.records {
+		owner := rr.Header().Name
+		if rr.Header().Rrtype != dns.TypeNS || owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, q.Name) {
+			continue
+		}
+		for _, rr := range s.records {
+			if v, ok := rr.(*dns.NS); ok && v.Hdr.Name == owner {
+				m.Ns = append(m.Ns, v)
+				for _, glue := range s.records {
+					if glue.Header().Rrtype == dns.TypeA && glue.Header().Name == v.Ns {
+						m.Extra = append(m.Extra, glue)
+					}
+				}
+			}
+		}
+		w.WriteMsg(m)
+		return
+	}
+
+	m.Authoritative = true
+	exists := false
+	for _, rr := range s.records {
+		owner := rr.Header().Name
+		if !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(q.Name, owner) {
+			continue
+		}
+		exists = true // name or a name below it exists
+		if strings.EqualFold(owner, q.Name) && (rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME) {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if len(m.Answer) == 0 {
+		if !exists && q.Name != zone {
+			m.Rcode = dns.RcodeNameError
+		}
+		soa, _ := dns.NewRR(zone + " 60 IN SOA ns. hostmaster. 1 3600 600 86400 60")
+		m.Ns = append(m.Ns, soa)
+	}
+	m.Ns = append(m.Ns, s.authority...)
+	w.WriteMsg(m)
+}
+
+func (s *authServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.queries...)
+}
+
+// startRecursiveTest starts the authoritative servers for a small hierarchy
+// (keyed by the IP they are referred to by) and returns a RecursiveResolver
+// using them.
+func startRecursiveTest(t *testing.T) (*RecursiveResolver, map[string]*authServer) {
+	t.Helper()
+	rrs := func(records ...string) []dns.RR {
+		out := make([]dns.RR, len(records))
+		for i, v := range records {
+			rr, err := dns.NewRR(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out[i] = rr
+		}
+		return out
+	}
+	servers := map[string]*authServer{
+		"192.0.2.1": {zones: []string{"."}, records: rrs(
+			". 3600 IN NS a.root.test.",
+			"com. 3600 IN NS a.gtld.com.",
+			"a.gtld.com. 3600 IN A 192.0.2.2",
+			"net. 3600 IN NS a.gtld.net.",
+			"a.gtld.net. 3600 IN A 192.0.2.3",
+		)},
+		"192.0.2.2": {zones: []string{"com."}, records: rrs(
+			"example.com. 3600 IN NS ns1.example.com.",
+			"ns1.example.com. 3600 IN A 192.0.2.10",
+			"other.com. 3600 IN NS ns.provider.net.",
+			"v6.com. 3600 IN NS ns.v6only.net.",
+		)},
+		"192.0.2.3": {zones: []string{"net."}, records: rrs(
+			"provider.net. 3600 IN NS ns.provider.net.",
+			"ns.provider.net. 3600 IN A 192.0.2.20",
+			"v6only.net. 3600 IN NS ns.provider.net.",
+		)},
+		"192.0.2.10": {zones: []string{"example.com."}, records: rrs(
+			"www.example.com. 300 IN A 1.2.3.4",
+			"alias.example.com. 300 IN CNAME www.other.com.",
+			"a.b.c.example.com. 300 IN A 1.2.3.5",
+			// Out of zone - must not be used
+			"www.other.com. 300 IN A 6.6.6.6",
+		), authority: rrs(
+			// Out of zone - must not be returned
+			"com. 3600 IN NS ns.attacker.test.",
+		)},
+		"192.0.2.20": {zones: []string{"provider.net.", "other.com.", "v6only.net."}, records: rrs(
+			"ns.provider.net. 3600 IN A 192.0.2.20",
+			"www.other.com. 300 IN A 5.6.7.8",
+			"ns.v6only.net. 3600 IN AAAA 2001:db8::30",
+		)},
+		"2001:db8::30": {zones: []string{"v6.com."}, records: rrs(
+			"www.v6.com. 300 IN A 9.9.9.9",
+		)},
+	}
+	addrs := make(map[string]string)
+	for ip, s := range servers {
+		addrs[ip] = util.StartTestServer(t, s.handler)
+	}
+	r := NewRecursiveResolver([]string{"192.0.2.1"})
+	r.address = func(ip string) string {
+		if addr, ok := addrs[ip]; ok {
+			return addr
+		}
+		return "127.0.0.1:1"
+	}
+	return r, servers
+}
+
+func TestRecursiveResolver(t *testing.T) {
+	r, servers := startRecursiveTest(t)
+	log := discardLog()
+
+	q := util.CreateQuery("www.example.com.", "A")
+	out, err := r.Resolve(context.Background(), log, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "1.2.3.4")
+	if !out.RecursionAvailable || out.Authoritative {
+		t.Error("unexpected flags in response")
+	}
+
+	// QNAME minimisation - the root and TLD only see the next label
+	if got := servers["192.0.2.1"].received(); strings.Join(got, ",") != "com. NS" {
+		t.Errorf("root: unexpected queries %v", got)
+	}
+	if got := servers["192.0.2.2"].received(); strings.Join(got, ",") != "example.com. NS" {
+		t.Errorf("com: unexpected queries %v", got)
+	}
+
+	// Delegations are cached
+	q = util.CreateQuery("a.b.c.example.com.", "A")
+	if out, err = r.Resolve(context.Background(), log, q); err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "1.2.3.5")
+	if got := len(servers["192.0.2.1"].received()) + len(servers["192.0.2.2"].received()); got != 2 {
+		t.Errorf("delegations not cached: %d root/com queries", got)
+	}
+	expected := "c.example.com. NS,b.c.example.com. NS,a.b.c.example.com. A"
+	if got := servers["192.0.2.10"].received(); strings.Join(got[1:], ",") != expected {
+		t.Errorf("example.com: unexpected queries %v", got)
+	}
+
+	// NXDOMAIN
+	q = util.CreateQuery("missing.example.com.", "A")
+	if out, err = r.Resolve(context.Background(), log, q); err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponseNxdomain(t, q, out)
+
+	// NODATA
+	q = util.CreateQuery("www.example.com.", "AAAA")
+	if out, err = r.Resolve(context.Background(), log, q); err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponseEmpty(t, q, out)
+
+	// Authority records outside the zone are dropped
+	for _, rr := range out.Ns {
+		if !dns.IsSubDomain("example.com.", rr.Header().Name) {
+			t.Errorf("unexpected authority record %s", rr)
+		}
+	}
+}
+
+func TestRecursiveResolverOutOfBailiwick(t *testing.T) {
+	r, _ := startRecursiveTest(t)
+	log := discardLog()
+
+	// other.com is delegated to ns.provider.net without glue
+	q := util.CreateQuery("www.other.com.", "A")
+	out, err := r.Resolve(context.Background(), log, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "5.6.7.8")
+
+	// v6.com is delegated to ns.v6only.net which only has an IPv6 address
+	q = util.CreateQuery("www.v6.com.", "A")
+	if out, err = r.Resolve(context.Background(), log, q); err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "9.9.9.9")
+
+	// CNAME target in another zone is resolved from its own servers rather
+	// than the out of zone record in the alias zone
+	q = util.CreateQuery("alias.example.com.", "A")
+	if out, err = r.Resolve(context.Background(), log, q); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Answer) != 2 || out.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Fatalf("expected CNAME chain, got %v", out.Answer)
+	}
+	if a, ok := out.Answer[1].(*dns.A); !ok || a.A.String() != "5.6.7.8" {
+		t.Errorf("unexpected answer %v", out.Answer[1])
+	}
+}
+
+func TestRecursiveResolverDS(t *testing.T) {
+	r, servers := startRecursiveTest(t)
+	log := discardLog()
+
+	// Cache the example.com delegation
+	if _, err := r.Resolve(context.Background(), log, util.CreateQuery("www.example.com.", "A")); err != nil {
+		t.Fatal(err)
+	}
+
+	// DS is asked of the parent zone rather than the child
+	q := util.CreateQuery("example.com.", "DS")
+	q.SetEdns0(dns.DefaultMsgSize, true)
+	if _, err := r.Resolve(context.Background(), log, q); err != nil {
+		t.Fatal(err)
+	}
+	if got := servers["192.0.2.2"].received(); got[len(got)-1] != "example.com. DS" {
+		t.Errorf("com: unexpected queries %v", got)
+	}
+	for _, v := range servers["192.0.2.10"].received() {
+		if strings.HasSuffix(v, " DS") {
+			t.Errorf("example.com: unexpected DS query")
+		}
+	}
+}
+
+func TestRecursiveResolverExpiry(t *testing.T) {
+
+	// Use mock time.Now
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	r, servers := startRecursiveTest(t)
+	log := discardLog()
+	for _, advance := range []time.Duration{0, time.Minute, 2 * time.Hour} {
+		now = now.Add(advance)
+		q := util.CreateQuery("www.example.com.", "A")
+		out, err := r.Resolve(context.Background(), log, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		util.CheckResponse(t, q, out, "1.2.3.4")
+	}
+	// Delegation TTL is 1 hour - root queried again after expiry
+	if got := len(servers["192.0.2.1"].received()); got != 2 {
+		t.Errorf("expected 2 root queries, got %d", got)
+	}
+}
+
+func TestRecursiveResolverOptions(t *testing.T) {
+	r, err := NewResolver("recursive#roots=192.0.2.1,192.0.2.2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roots := r.(*RecursiveResolver).roots; len(roots) != 2 || roots[1] != "192.0.2.2" {
+		t.Errorf("unexpected roots %v", roots)
+	}
+	if r, _ = NewResolver("recursive", nil); len(r.(*RecursiveResolver).roots) != len(RootHints) {
+		t.Error("expected default root hints")
+	}
+	for _, upstream := range []string{
+		"recursive#roots=a.root-servers.net",
+		"recursive#xxx",
+		"recursive#proxy=socks5://127.0.0.1:1080",
+	} {
+		if _, err := NewResolver(upstream, nil); err == nil {
+			t.Errorf("%s: expected error", upstream)
+		}
+	}
+}
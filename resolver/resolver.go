@@ -2,162 +2,494 @@ package resolver
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/paulc/dinosaur-dns/logger"
+	"github.com/quic-go/quic-go"
 )
 
 // Resolver is the interface implemented by all upstream resolver types.
 type Resolver interface {
-	Resolve(log *logger.Logger, r *dns.Msg) (*dns.Msg, error)
+	// Resolve sends r upstream. The query is abandoned when ctx is done; if
+	// ctx has no deadline DefaultTimeout applies.
+	Resolve(ctx context.Context, log *logger.Logger, r *dns.Msg) (*dns.Msg, error)
 	String() string
 }
 
-const (
-	// upstreamTimeout is the per-request deadline applied to all resolver types,
-	// bounding worst-case query latency for a single upstream call.
-	upstreamTimeout = 5 * time.Second
+// NewResolver creates a resolver from an upstream spec, selecting the type
+// from the scheme prefix and adding the default port if none is given:
+//
+//	https://host/path          DoH
+//	sdns://stamp               DNSCrypt v2
+//	tls://[name@]host[:853]    DoT
+//	quic://[name@]host[:853]   DoQ
+//	tcp://host[:53]            plain TCP
+//	host[:53]                  plain UDP (with TCP fallback on truncation)
+//	recursive                  iterative resolution from the root servers
+//
+// For DoT and DoQ an optional 'name@' prefix sets the TLS server name used
+// for SNI and certificate verification when host is an IP address.
+//
+// Per-upstream options follow a '#' as '&'-separated key[=value] pairs
+// (e.g. https://dns.google/resolve#json or tls://10.0.0.1#ca=/etc/ca.pem).
+//
+// DoT, DoQ and DoH connections are opened through dialer (nil dials
+// directly using the system resolver).
+func NewResolver(upstream string, dialer *Dialer) (Resolver, error) {
+	if upstream == "" {
+		return nil, errors.New("Invalid upstream: empty")
+	}
+	upstream, options, err := splitOptions(upstream)
+	if err != nil {
+		return nil, err
+	}
+	var r configurable
+	switch {
+	case upstream == "recursive":
+		r = NewRecursiveResolver(RootHints)
+	case strings.HasPrefix(upstream, "sdns://"):
+		if r, err = NewDnscryptResolver(upstream); err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(upstream, "https://"):
+		r = NewDohResolver(upstream)
+	case strings.HasPrefix(upstream, "tls://"):
+		r = NewDotResolver(withPort(upstream, "853"))
+	case strings.HasPrefix(upstream, "quic://"):
+		r = NewDoqResolver(withPort(upstream, "853"))
+	case strings.HasPrefix(upstream, "tcp://"):
+		r = NewTcpResolver(withPort(upstream, "53"))
+	default:
+		r = NewUdpResolver(withPort(upstream, "53"))
+	}
+	if err := r.configure(dialer, options); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// splitOptions separates the '#key=value&...' options suffix from an upstream
+// spec. Keys and values are %-unescaped but '+' is kept literally (it is
+// common in base64 SPKI pins).
+func splitOptions(upstream string) (string, url.Values, error) {
+	options := url.Values{}
+	upstream, fragment, found := strings.Cut(upstream, "#")
+	if !found {
+		return upstream, options, nil
+	}
+	for _, kv := range strings.Split(fragment, "&") {
+		if kv == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		key, err := url.PathUnescape(k)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid upstream options (%s): %s", fragment, err)
+		}
+		value, err := url.PathUnescape(v)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid upstream options (%s): %s", fragment, err)
+		}
+		options.Add(key, value)
+	}
+	return upstream, options, nil
+}
+
+// configurable is implemented by resolvers created by NewResolver.
+type configurable interface {
+	Resolver
+	// configure applies the dialer and per-upstream options.
+	configure(dialer *Dialer, options url.Values) error
+}
 
-	// dotPoolSize is the maximum number of idle TLS connections in the DoT pool.
-	dotPoolSize = 5
+// unknownOption returns an error naming the first unrecognised option, or nil
+// if options is empty.
+func unknownOption(upstream string, options url.Values) error {
+	if len(options) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return fmt.Errorf("Invalid upstream option (%s): %s", upstream, keys[0])
+}
+
+// withPort appends port to upstream if it does not already end with one.
+func withPort(upstream string, port string) string {
+	if !regexp.MustCompile(`:\d+$`).MatchString(upstream) {
+		return upstream + ":" + port
+	}
+	return upstream
+}
+
+const (
+	// DefaultTimeout is the query deadline applied when the context passed to
+	// Resolve has none (and the default budget for a proxied query).
+	DefaultTimeout = 5 * time.Second
+
+	// clientTimeout is the upper bound set on dns.Client exchanges; the
+	// context deadline normally applies first.
+	clientTimeout = time.Minute
+
+	// dotMaxConns is the maximum number of open connections to a DoT upstream
+	// and dotMaxPending the number of outstanding queries on each before
+	// another is opened.
+	dotMaxConns   = 2
+	dotMaxPending = 32
+
+	// dotMaxQueries is the limit on outstanding queries on a DoT connection
+	// (including abandoned ones still awaiting a response).
+	dotMaxQueries = 4096
 )
 
+// dotReadTimeout is how long a DoT connection with outstanding queries may
+// go without receiving a response before it is considered dead (e.g. a
+// dropped NAT mapping that the kernel would take minutes to notice).
+var dotReadTimeout = DefaultTimeout
+
+// queryContext returns ctx bounded by DefaultTimeout if it has no deadline.
+func queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, DefaultTimeout)
+}
+
+// exchange sends q over conn. dns.Client only applies the context deadline,
+// so cancellation is handled by expiring the connection deadline.
+func exchange(ctx context.Context, client *dns.Client, q *dns.Msg, conn *dns.Conn) (*dns.Msg, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	out, _, err := client.ExchangeWithConnContext(ctx, q, conn)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return out, err
+}
+
+// exchangeAddr sends q to address on a new connection.
+func exchangeAddr(ctx context.Context, client *dns.Client, q *dns.Msg, address string) (*dns.Msg, error) {
+	conn, err := client.DialContext(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchange(ctx, client, q, conn)
+}
+
 // ── UDP Resolver ──────────────────────────────────────────────────────────────
 
 // UdpResolver sends plain UDP DNS queries. UDP is stateless so there is no
 // connection to pool, but the dns.Client is kept on the struct so its Timeout
-// is set once and shared across all concurrent calls.
+// is set once and shared across all concurrent calls. If the response is
+// truncated (TC bit set) the query is retried over TCP to the same server so
+// that large responses are returned complete (and can be cached).
+//
+// Responses must echo the ID and question of the query. With Case0x20 ('0x20'
+// option) the letter case of the qname is randomised and must be echoed
+// exactly, which makes off-path spoofing much harder (draft-vixie-dnsext-dns0x20);
+// the response is returned with the case of the original query.
 type UdpResolver struct {
-	Upstream string
-	client   dns.Client
+	Upstream  string
+	Case0x20  bool
+	client    dns.Client
+	tcpClient dns.Client
 }
 
-func (r *UdpResolver) Resolve(log *logger.Logger, q *dns.Msg) (*dns.Msg, error) {
-	out, _, err := r.client.Exchange(q, r.Upstream)
+func (r *UdpResolver) Resolve(ctx context.Context, log *logger.Logger, q *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	sent := q
+	if r.Case0x20 && len(q.Question) == 1 {
+		sent = q.Copy()
+		sent.Question[0].Name = randomCase(q.Question[0].Name)
+	}
+	out, err := exchangeAddr(ctx, &r.client, sent, r.Upstream)
+	if err == nil {
+		err = r.checkResponse(sent, out)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("DNS Query Error: %s", err)
 	}
+	if out.Truncated {
+		log.Debugf("Truncated UDP response from %s - retrying over TCP", r.Upstream)
+		out, err = exchangeAddr(ctx, &r.tcpClient, sent, r.Upstream)
+		if err == nil {
+			err = r.checkResponse(sent, out)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("DNS Query Error (TCP fallback): %s", err)
+		}
+	}
+	if sent != q {
+		restoreCase(out, sent.Question[0].Name, q.Question[0].Name)
+	}
 	return out, nil
 }
 
+// checkResponse rejects a response whose ID or question differs from the
+// query (the qname must match exactly with Case0x20).
+func (r *UdpResolver) checkResponse(q *dns.Msg, out *dns.Msg) error {
+	if out.Id != q.Id {
+		return errors.New("response ID mismatch")
+	}
+	if len(out.Question) != len(q.Question) {
+		return errors.New("response question mismatch")
+	}
+	for i, v := range q.Question {
+		u := out.Question[i]
+		if u.Qtype != v.Qtype || u.Qclass != v.Qclass || !strings.EqualFold(u.Name, v.Name) {
+			return errors.New("response question mismatch")
+		}
+		if r.Case0x20 && u.Name != v.Name {
+			return errors.New("response qname case mismatch (0x20)")
+		}
+	}
+	return nil
+}
+
 func (r *UdpResolver) String() string { return r.Upstream }
 
+// configure applies the '0x20' option.
+func (r *UdpResolver) configure(dialer *Dialer, options url.Values) error {
+	dialer, options, err := dialer.withOptions(options, false)
+	if err != nil {
+		return err
+	}
+	if dialer.proxied() {
+		return fmt.Errorf("Invalid upstream (%s): UDP cannot be sent through a TCP proxy (use tcp://)", r.Upstream)
+	}
+	if options.Has("0x20") {
+		r.Case0x20 = true
+		delete(options, "0x20")
+	}
+	return unknownOption(r.Upstream, options)
+}
+
 func NewUdpResolver(upstream string) *UdpResolver {
 	return &UdpResolver{
-		Upstream: upstream,
-		client:   dns.Client{Timeout: upstreamTimeout},
+		Upstream:  upstream,
+		client:    dns.Client{Timeout: clientTimeout},
+		tcpClient: dns.Client{Net: "tcp", Timeout: clientTimeout},
 	}
 }
 
-// ── DoT Resolver ──────────────────────────────────────────────────────────────
+// randomCase returns name with the case of each letter chosen at random.
+func randomCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && rand.IntN(2) == 1 {
+			b[i] = c ^ 0x20
+		}
+	}
+	return string(b)
+}
 
-type dotConn struct {
-	conn *dns.Conn
+// restoreCase sets the question and the owner of records named sent (the
+// randomised qname) in out back to name.
+func restoreCase(out *dns.Msg, sent string, name string) {
+	for i := range out.Question {
+		out.Question[i].Name = name
+	}
+	for _, section := range [][]dns.RR{out.Answer, out.Ns, out.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Name == sent {
+				h.Name = name
+			}
+		}
+	}
 }
 
-// DotResolver maintains a bounded pool of reusable TLS connections to a single
-// DoT upstream. Idle connections are health-checked before reuse; dead ones are
-// closed and replaced. A shared tls.Config with a session cache enables TLS
-// session resumption across all connections.
-type DotResolver struct {
+// ── TCP Resolver ──────────────────────────────────────────────────────────────
+
+// TcpResolver sends plain DNS queries over TCP, one connection per query.
+type TcpResolver struct {
 	upstream string
 	address  string
-	client   dns.Client    // shared across all connections; holds TLS config and timeouts
-	pool     chan *dotConn // buffered channel acts as the idle-connection pool
+	client   dns.Client
+	dialer   *Dialer // opens the TCP connection (nil = direct)
 }
 
-// newConn dials a fresh TLS connection to the upstream.
-func (r *DotResolver) newConn() (*dotConn, error) {
-	conn, err := r.client.Dial(r.address)
+func (r *TcpResolver) Resolve(ctx context.Context, log *logger.Logger, q *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	conn, err := r.dialer.DialContext(ctx, "tcp", r.address)
 	if err != nil {
-		return nil, fmt.Errorf("DoT dial: %w", err)
+		return nil, fmt.Errorf("DNS Query Error: %s", err)
+	}
+	defer conn.Close()
+	out, err := exchange(ctx, &r.client, q, &dns.Conn{Conn: conn})
+	if err != nil {
+		return nil, fmt.Errorf("DNS Query Error: %s", err)
 	}
-	return &dotConn{conn: conn}, nil
+	return out, nil
 }
 
-// isAlive reports whether an idle pooled connection is still open.
-//
-// It sets a 1 ms read deadline and attempts a single-byte read:
-//   - timeout error  → connection is alive and idle (nothing to read)
-//   - io.EOF / other → server has closed the connection
-//
-// The 1 ms deadline is short enough that no real DNS response will arrive
-// during the check, so the read is non-destructive on a healthy idle connection.
-func isAlive(c *dotConn) bool {
-	var b [1]byte
-	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
-	defer c.conn.SetReadDeadline(time.Time{})
-	_, err := c.conn.Read(b[:])
+func (r *TcpResolver) String() string { return r.upstream }
+
+// configure sets the dialer ('proxy' option).
+func (r *TcpResolver) configure(dialer *Dialer, options url.Values) error {
+	dialer, options, err := dialer.withOptions(options, true)
 	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return true // idle but open
-		}
-		return false // EOF, reset, or other close signal
+		return err
 	}
-	return true // unexpected data, but connection is clearly alive
+	r.dialer = dialer
+	return unknownOption(r.upstream, options)
 }
 
-// getConn returns a healthy connection from the pool, or dials a new one.
-// Dead connections detected by isAlive are closed and skipped.
-func (r *DotResolver) getConn() (*dotConn, error) {
-	for {
-		select {
-		case c := <-r.pool:
-			if isAlive(c) {
-				return c, nil
-			}
-			c.conn.Close() // dead — discard and try next
-		default:
-			return r.newConn() // pool empty — dial fresh
-		}
+func NewTcpResolver(upstream string) *TcpResolver {
+	return &TcpResolver{
+		upstream: upstream,
+		address:  strings.TrimPrefix(upstream, "tcp://"),
+		client:   dns.Client{Net: "tcp", Timeout: clientTimeout},
 	}
 }
 
-// putConn returns a connection to the idle pool.
-// If the pool is already full the connection is closed immediately.
-func (r *DotResolver) putConn(c *dotConn) {
-	select {
-	case r.pool <- c:
-	default:
-		c.conn.Close()
+// ── DoT Resolver ──────────────────────────────────────────────────────────────
+
+// DotResolver pipelines queries to a single DoT upstream over a few shared
+// TLS connections (see dotConn). A new connection is only opened when every
+// open one has dotMaxPending queries outstanding (up to dotMaxConns). A
+// shared tls.Config with a session cache enables TLS session resumption
+// across all connections.
+type DotResolver struct {
+	upstream  string
+	address   string
+	tlsConfig *tls.Config
+	dialer    *Dialer // opens the TCP connection (nil = direct)
+
+	mu       sync.Mutex
+	conns    []*dotConn    // open connections
+	dialing  int           // connections being dialed
+	dialDone chan struct{} // closed when the latest dial completes
+
+	// Connection counters (see PoolStats)
+	dials  atomic.Uint64
+	reuses atomic.Uint64
+	dead   atomic.Uint64
+}
+
+// newConn dials a fresh TLS connection to the upstream. The TLS server name
+// is always the configured host, even when the dialer connects to a
+// bootstrap-resolved IP.
+func (r *DotResolver) newConn(ctx context.Context) (*dotConn, error) {
+	conn, err := r.dialer.DialContext(ctx, "tcp", r.address)
+	if err != nil {
+		return nil, fmt.Errorf("DoT dial: %w", err)
+	}
+	tlsConn := tls.Client(conn, r.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("DoT dial: %w", err)
 	}
+	r.dials.Add(1)
+	return newDotConn(tlsConn), nil
 }
 
-// isTransientConnErr reports whether err is a connection-level error that
-// warrants a retry with a fresh connection. This covers the common case of
-// a server-side idle timeout: the remote sends TCP FIN, which Go surfaces as
-// io.EOF on the next read — not net.ErrClosed.
-func isTransientConnErr(err error) bool {
-	return errors.Is(err, io.EOF) ||
-		errors.Is(err, io.ErrUnexpectedEOF) ||
-		errors.Is(err, net.ErrClosed)
+// getConn returns the open connection with the fewest outstanding queries,
+// or dials a new one if there is none or all are busy. Connections that have
+// failed (e.g. closed by the server when idle) are discarded. The dial is
+// done without holding r.mu (connections being dialed count towards
+// dotMaxConns) and queries with no open connection wait for it.
+func (r *DotResolver) getConn(ctx context.Context) (*dotConn, error) {
+	r.mu.Lock()
+	for {
+		var best *dotConn
+		bestPending := 0
+		conns := r.conns[:0]
+		for _, c := range r.conns {
+			pending, alive := c.status()
+			if !alive {
+				r.dead.Add(1)
+				continue
+			}
+			conns = append(conns, c)
+			if best == nil || pending < bestPending {
+				best, bestPending = c, pending
+			}
+		}
+		clear(r.conns[len(conns):])
+		r.conns = conns
+		if best != nil && (bestPending < dotMaxPending || len(r.conns)+r.dialing >= dotMaxConns) {
+			r.mu.Unlock()
+			r.reuses.Add(1)
+			return best, nil
+		}
+		if best != nil || r.dialDone == nil {
+			break
+		}
+		done := r.dialDone
+		r.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		r.mu.Lock()
+	}
+
+	done := make(chan struct{})
+	r.dialing++
+	r.dialDone = done
+	r.mu.Unlock()
+
+	c, err := r.newConn(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dialing--
+	if r.dialDone == done {
+		r.dialDone = nil
+	}
+	close(done)
+	if err != nil {
+		return nil, err
+	}
+	r.conns = append(r.conns, c)
+	return c, nil
 }
 
-func (r *DotResolver) Resolve(log *logger.Logger, q *dns.Msg) (out *dns.Msg, err error) {
+func (r *DotResolver) Resolve(ctx context.Context, log *logger.Logger, q *dns.Msg) (out *dns.Msg, err error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
 	const maxAttempts = 3
 	for attempt := 0; attempt < maxAttempts; attempt++ {
 		var c *dotConn
-		c, err = r.getConn()
+		c, err = r.getConn(ctx)
 		if err != nil {
 			return // dial failed — no point retrying immediately
 		}
-		out, _, err = r.client.ExchangeWithConn(q, c.conn)
+		out, err = c.exchange(ctx, q)
 		if err == nil {
-			r.putConn(c)
 			return
 		}
-		c.conn.Close() // always close on any exchange error
-		if !isTransientConnErr(err) {
-			return // non-transient (e.g. malformed response) — propagate immediately
+		if _, alive := c.status(); ctx.Err() != nil || alive {
+			return // timeout or query-level error — propagate immediately
 		}
+		// Connection failed under us (e.g. server closed it with queries
+		// outstanding) — retry on a fresh one
 		log.Debugf("DoT transient error (attempt %d/%d): %s", attempt+1, maxAttempts, err)
 	}
 	return
@@ -165,56 +497,162 @@ func (r *DotResolver) Resolve(log *logger.Logger, q *dns.Msg) (out *dns.Msg, err
 
 func (r *DotResolver) String() string { return r.upstream }
 
+// PoolStats returns the connection counters.
+func (r *DotResolver) PoolStats() PoolStats {
+	return PoolStats{Dials: r.dials.Load(), Reuses: r.reuses.Load(), Dead: r.dead.Load()}
+}
+
+// configure sets the dialer ('proxy' option) and applies the TLS options
+// (see applyTLSOptions).
+func (r *DotResolver) configure(dialer *Dialer, options url.Values) error {
+	dialer, options, err := dialer.withOptions(options, true)
+	if err != nil {
+		return err
+	}
+	r.dialer = dialer
+	rest, err := applyTLSOptions(r.tlsConfig, options)
+	if err != nil {
+		return err
+	}
+	return unknownOption(r.upstream, rest)
+}
+
 func NewDotResolver(upstream string) *DotResolver {
-	address := strings.TrimPrefix(upstream, "tls://")
+	name, address := splitAuthName(strings.TrimPrefix(upstream, "tls://"))
+	if name == "" {
+		name, _, _ = net.SplitHostPort(address)
+	}
 	return &DotResolver{
 		upstream: upstream,
 		address:  address,
-		client: dns.Client{
-			Net: "tcp-tls",
-			// Shared TLS config with a session cache so that reconnections
-			// after idle-timeout drops can resume the TLS session (~0 RTT
-			// overhead) rather than doing a full handshake (~1 RTT extra).
-			TLSConfig: &tls.Config{
-				ClientSessionCache: tls.NewLRUClientSessionCache(64),
-			},
-			// Timeout covers both ExchangeWithConn and (via Dialer) the
-			// initial TLS handshake, bounding worst-case latency.
-			Timeout: upstreamTimeout,
-			Dialer: &net.Dialer{
-				Timeout:   upstreamTimeout,
-				KeepAlive: 30 * time.Second,
-			},
+		// Shared TLS config with a session cache so that reconnections after
+		// idle-timeout drops can resume the TLS session (~0 RTT overhead)
+		// rather than doing a full handshake (~1 RTT extra).
+		tlsConfig: &tls.Config{
+			ServerName:         name,
+			ClientSessionCache: tls.NewLRUClientSessionCache(64),
 		},
-		pool: make(chan *dotConn, dotPoolSize),
 	}
 }
 
 // ── DoH Resolver ─────────────────────────────────────────────────────────────
 
+// DohMode selects the request format used by DohResolver.
+type DohMode int
+
+const (
+	// DohPost - RFC 8484 POST with an application/dns-message body (default)
+	DohPost DohMode = iota
+	// DohGet - RFC 8484 GET with a base64url ?dns= parameter (HTTP cacheable)
+	DohGet
+	// DohJSON - Google/Cloudflare JSON API (?name=&type=, application/dns-json)
+	DohJSON
+)
+
+func (m DohMode) String() string {
+	switch m {
+	case DohGet:
+		return "get"
+	case DohJSON:
+		return "json"
+	default:
+		return "post"
+	}
+}
+
 // DohResolver sends DNS queries over HTTPS. A single *http.Client is kept on
 // the struct so its underlying http.Transport — which pools TCP connections and
 // caches TLS sessions — is shared across all calls, avoiding a new TLS
 // handshake per query.
 type DohResolver struct {
 	Upstream string
+	Mode     DohMode
 	client   *http.Client
 }
 
-func (r *DohResolver) Resolve(log *logger.Logger, q *dns.Msg) (*dns.Msg, error) {
-
-	pack, err := q.Pack()
+// configure sets the dialer ('proxy' option) and applies the per-upstream
+// options:
+//
+//	get   use RFC 8484 GET requests
+//	json  use the JSON API
+//
+// together with the TLS options (see applyTLSOptions).
+func (r *DohResolver) configure(dialer *Dialer, options url.Values) error {
+	dialer, options, err := dialer.withOptions(options, true)
 	if err != nil {
-		return nil, fmt.Errorf("Error packing record: %s", err)
+		return err
+	}
+	transport := r.client.Transport.(*http.Transport)
+	if dialer != nil {
+		transport.DialContext = dialer.DialContext
+	}
+	options, err = applyTLSOptions(transport.TLSClientConfig, options)
+	if err != nil {
+		return err
+	}
+	for k := range options {
+		switch k {
+		case "get":
+			r.Mode = DohGet
+		case "json":
+			r.Mode = DohJSON
+		default:
+			return fmt.Errorf("Invalid upstream option (%s): %s", r.Upstream, k)
+		}
+	}
+	if options.Has("get") && options.Has("json") {
+		return fmt.Errorf("Invalid upstream options (%s): get and json are exclusive", r.Upstream)
+	}
+	return nil
+}
+
+// newRequest builds the HTTP request for q in the configured mode.
+func (r *DohResolver) newRequest(ctx context.Context, q *dns.Msg) (*http.Request, error) {
+	if r.Mode == DohJSON {
+		return newDohJSONRequest(ctx, r.Upstream, q)
 	}
 
-	request, err := http.NewRequest("POST", r.Upstream, bytes.NewReader(pack))
+	// RFC 8484 recommends ID 0 so that identical queries are cacheable; the
+	// caller's ID is restored on the response
+	wire := q.Copy()
+	wire.Id = 0
+	pack, err := wire.Pack()
 	if err != nil {
-		return nil, fmt.Errorf("Error creating HTTP request: %s", err)
+		return nil, fmt.Errorf("Error packing record: %s", err)
 	}
 
+	var request *http.Request
+	if r.Mode == DohGet {
+		u, err := url.Parse(r.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating HTTP request: %s", err)
+		}
+		params := u.Query()
+		params.Set("dns", base64.RawURLEncoding.EncodeToString(pack))
+		u.RawQuery = params.Encode()
+		request, err = http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating HTTP request: %s", err)
+		}
+	} else {
+		request, err = http.NewRequestWithContext(ctx, "POST", r.Upstream, bytes.NewReader(pack))
+		if err != nil {
+			return nil, fmt.Errorf("Error creating HTTP request: %s", err)
+		}
+		request.Header.Set("content-type", "application/dns-message")
+	}
 	request.Header.Set("Accept", "application/dns-message")
-	request.Header.Set("content-type", "application/dns-message")
+	return request, nil
+}
+
+func (r *DohResolver) Resolve(ctx context.Context, log *logger.Logger, q *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	request, err := r.newRequest(ctx, q)
+	if err != nil {
+		return nil, err
+	}
 
 	resp, err := r.client.Do(request)
 	if err != nil {
@@ -232,10 +670,18 @@ func (r *DohResolver) Resolve(log *logger.Logger, q *dns.Msg) (*dns.Msg, error)
 		return nil, fmt.Errorf("Error reading HTTP body: %s", err)
 	}
 
-	out := new(dns.Msg)
-	if err = out.Unpack(buffer.Bytes()); err != nil {
-		return nil, fmt.Errorf("Error parsing DNS response: %s", err)
+	var out *dns.Msg
+	if r.Mode == DohJSON {
+		if out, err = parseDohJSON(q, buffer.Bytes()); err != nil {
+			return nil, err
+		}
+	} else {
+		out = new(dns.Msg)
+		if err = out.Unpack(buffer.Bytes()); err != nil {
+			return nil, fmt.Errorf("Error parsing DNS response: %s", err)
+		}
 	}
+	out.Id = q.Id
 
 	return out, nil
 
@@ -247,8 +693,9 @@ func NewDohResolver(upstream string) *DohResolver {
 	return &DohResolver{
 		Upstream: upstream,
 		client: &http.Client{
-			// Timeout covers the full round-trip (dial + TLS + request + response body).
-			Timeout: upstreamTimeout,
+			// The request context deadline covers the full round-trip (dial +
+			// TLS + request + response body); Timeout is only an upper bound.
+			Timeout: clientTimeout,
 			Transport: &http.Transport{
 				// Per-resolver TLS session cache: reconnections after an idle-timeout
 				// drop can resume the session instead of doing a full handshake.
@@ -258,13 +705,240 @@ func NewDohResolver(upstream string) *DohResolver {
 				ForceAttemptHTTP2:     true,
 				MaxIdleConns:          5,
 				IdleConnTimeout:       90 * time.Second,
-				TLSHandshakeTimeout:   upstreamTimeout,
+				TLSHandshakeTimeout:   DefaultTimeout,
 				ExpectContinueTimeout: 1 * time.Second,
 				DialContext: (&net.Dialer{
-					Timeout:   upstreamTimeout,
 					KeepAlive: 30 * time.Second,
 				}).DialContext,
 			},
 		},
 	}
 }
+
+// ── DoQ Resolver ──────────────────────────────────────────────────────────────
+
+// DoqResolver sends DNS queries over QUIC (RFC 9250). A single QUIC connection
+// is shared by all concurrent queries, each of which runs on its own
+// bidirectional stream, so one slow response does not hold up the others
+// (no head-of-line blocking as with a TCP connection). The shared tls.Config
+// carries a session cache so that reconnections can resume the session and
+// send the query as 0-RTT data.
+type DoqResolver struct {
+	upstream   string
+	address    string
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+	dialer     *Dialer // resolves the upstream host (nil = system resolver)
+
+	mu      sync.Mutex
+	conn    *quic.Conn    // shared connection; nil until first use or after close
+	dialing chan struct{} // closed when the in-flight dial completes
+}
+
+// getConn returns the shared connection, dialling a new one if there is none
+// or the previous one has been closed (idle timeout, server GOAWAY, etc.).
+// The dial is done without holding r.mu and concurrent queries wait for it.
+func (r *DoqResolver) getConn(ctx context.Context) (*quic.Conn, error) {
+	r.mu.Lock()
+	for {
+		if r.conn != nil {
+			select {
+			case <-r.conn.Context().Done():
+				r.conn = nil // closed — fall through and redial
+			default:
+				conn := r.conn
+				r.mu.Unlock()
+				return conn, nil
+			}
+		}
+		if r.dialing == nil {
+			break
+		}
+		dialing := r.dialing
+		r.mu.Unlock()
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		r.mu.Lock()
+	}
+
+	dialing := make(chan struct{})
+	r.dialing = dialing
+	r.mu.Unlock()
+
+	conn, err := r.dial(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dialing = nil
+	close(dialing)
+	if err != nil {
+		return nil, err
+	}
+	r.conn = conn
+	return conn, nil
+}
+
+// dial opens a QUIC connection to the first reachable upstream address.
+func (r *DoqResolver) dial(ctx context.Context) (*quic.Conn, error) {
+	addrs, err := r.dialer.lookup(ctx, r.address)
+	if err != nil {
+		return nil, fmt.Errorf("DoQ dial: %w", err)
+	}
+	for i, addr := range addrs {
+		attempt, cancel := attemptContext(ctx, i, len(addrs))
+		var conn *quic.Conn
+		conn, err = quic.DialAddrEarly(attempt, addr, r.tlsConfig, r.quicConfig)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("DoQ dial: %w", err)
+}
+
+// dropConn closes conn and clears it as the shared connection (unless another
+// goroutine has already replaced it).
+func (r *DoqResolver) dropConn(conn *quic.Conn) {
+	r.mu.Lock()
+	if r.conn == conn {
+		r.conn = nil
+	}
+	r.mu.Unlock()
+	conn.CloseWithError(0, "")
+}
+
+// nextConn replaces conn after the server rejected its 0-RTT data. The
+// handshake has completed by then, so the replacement connection is usable
+// without another round trip.
+func (r *DoqResolver) nextConn(ctx context.Context, conn *quic.Conn) {
+	next, err := conn.NextConnection(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == conn {
+		r.conn = nil
+		if err == nil {
+			r.conn = next
+		}
+	}
+}
+
+// exchange sends a single query on a new stream. Per RFC 9250 §4.2 the query
+// is sent with a 2-byte length prefix and a message ID of 0, and the client
+// closes its side of the stream after writing the query.
+func (r *DoqResolver) exchange(ctx context.Context, conn *quic.Conn, q *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	wire := q.Copy()
+	wire.Id = 0
+	pack, err := wire.Pack()
+	if err != nil {
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, fmt.Errorf("Error packing record: %s", err)
+	}
+	buf := make([]byte, 2+len(pack))
+	binary.BigEndian.PutUint16(buf, uint16(len(pack)))
+	copy(buf[2:], pack)
+	if _, err = stream.Write(buf); err != nil {
+		stream.CancelRead(0)
+		return nil, err
+	}
+	stream.Close() // STREAM FIN — signals the end of the query
+
+	var length [2]byte
+	if _, err = io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(stream, resp); err != nil {
+		return nil, err
+	}
+
+	out := new(dns.Msg)
+	if err = out.Unpack(resp); err != nil {
+		return nil, fmt.Errorf("Error parsing DNS response: %s", err)
+	}
+	out.Id = q.Id
+	return out, nil
+}
+
+func (r *DoqResolver) Resolve(ctx context.Context, log *logger.Logger, q *dns.Msg) (out *dns.Msg, err error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+
+	const maxAttempts = 2
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		var conn *quic.Conn
+		conn, err = r.getConn(ctx)
+		if err != nil {
+			return // dial failed — no point retrying immediately
+		}
+		out, err = r.exchange(ctx, conn, q)
+		if err == nil {
+			return
+		}
+		switch {
+		case errors.Is(err, quic.Err0RTTRejected):
+			r.nextConn(ctx, conn)
+		case conn.Context().Err() != nil:
+			r.dropConn(conn) // connection closed under us — retry on a fresh one
+		default:
+			return // stream-level error or timeout — propagate immediately
+		}
+		log.Debugf("DoQ transient error (attempt %d/%d): %s", attempt+1, maxAttempts, err)
+	}
+	return
+}
+
+func (r *DoqResolver) String() string { return r.upstream }
+
+// configure sets the dialer and applies the TLS options (see
+// applyTLSOptions).
+func (r *DoqResolver) configure(dialer *Dialer, options url.Values) error {
+	dialer, options, err := dialer.withOptions(options, false)
+	if err != nil {
+		return err
+	}
+	if dialer.proxied() {
+		return fmt.Errorf("Invalid upstream (%s): QUIC cannot be sent through a TCP proxy", r.upstream)
+	}
+	r.dialer = dialer
+	rest, err := applyTLSOptions(r.tlsConfig, options)
+	if err != nil {
+		return err
+	}
+	return unknownOption(r.upstream, rest)
+}
+
+func NewDoqResolver(upstream string) *DoqResolver {
+	name, address := splitAuthName(strings.TrimPrefix(upstream, "quic://"))
+	if name == "" {
+		name, _, _ = net.SplitHostPort(address)
+	}
+	return &DoqResolver{
+		upstream: upstream,
+		address:  address,
+		tlsConfig: &tls.Config{
+			ServerName: name,
+			NextProtos: []string{"doq"},
+			// Session cache enables resumption and 0-RTT on reconnection.
+			ClientSessionCache: tls.NewLRUClientSessionCache(64),
+		},
+		quicConfig: &quic.Config{
+			HandshakeIdleTimeout: DefaultTimeout,
+			MaxIdleTimeout:       30 * time.Second,
+		},
+	}
+}
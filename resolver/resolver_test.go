@@ -1,11 +1,24 @@
 package resolver
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -13,12 +26,55 @@ import (
 	"github.com/miekg/dns"
 	"github.com/paulc/dinosaur-dns/logger"
 	"github.com/paulc/dinosaur-dns/util"
+	"github.com/quic-go/quic-go"
 )
 
 // ── helpers ───────────────────────────────────────────────────────────────────
 
 func discardLog() *logger.Logger { return logger.New(logger.NewDiscard(true)) }
 
+// testCert generates a self-signed certificate for 127.0.0.1 / localhost and
+// returns it together with a pool that trusts it.
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// answerA returns a reply to q with a single A record answer.
+func answerA(q *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	if len(q.Question) > 0 {
+		rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 1.2.3.4")
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return resp
+}
+
 // dohEchoHandler returns an HTTP handler that parses a DoH POST body and
 // replies with a minimal A record answer, allowing connection-reuse tests to
 // make real successful requests.
@@ -35,13 +91,7 @@ func dohEchoHandler(t *testing.T) http.Handler {
 			http.Error(w, "unpack error", http.StatusBadRequest)
 			return
 		}
-		resp := new(dns.Msg)
-		resp.SetReply(q)
-		if len(q.Question) > 0 {
-			rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 1.2.3.4")
-			resp.Answer = append(resp.Answer, rr)
-		}
-		b, _ := resp.Pack()
+		b, _ := answerA(q).Pack()
 		w.Header().Set("Content-Type", "application/dns-message")
 		w.Write(b)
 	})
@@ -52,7 +102,7 @@ func dohEchoHandler(t *testing.T) http.Handler {
 func TestUdpResolver(t *testing.T) {
 	r := NewUdpResolver("1.1.1.1:53")
 	q := util.CreateQuery("127.0.0.1.nip.io.", "A")
-	out, err := r.Resolve(discardLog(), q)
+	out, err := r.Resolve(context.Background(), discardLog(), q)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -83,7 +133,7 @@ func TestUdpResolverTimeout(t *testing.T) {
 
 	q := util.CreateQuery("example.com.", "A")
 	start := time.Now()
-	_, err = r.Resolve(discardLog(), q)
+	_, err = r.Resolve(context.Background(), discardLog(), q)
 	elapsed := time.Since(start)
 
 	if err == nil {
@@ -94,24 +144,458 @@ func TestUdpResolverTimeout(t *testing.T) {
 	}
 }
 
+func TestUdpResolverCancel(t *testing.T) {
+	// Bind a UDP socket that accepts datagrams but never replies.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := NewUdpResolver(conn.LocalAddr().String())
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = r.Resolve(ctx, discardLog(), util.CreateQuery("example.com.", "A"))
+	if err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Fatalf("expected cancellation error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled query blocked for %v", elapsed)
+	}
+}
+
+// truncatingHandler answers over UDP with an empty truncated response and
+// over TCP with a full answer.
+func truncatingHandler(w dns.ResponseWriter, q *dns.Msg) {
+	if util.IsTCP(w) {
+		w.WriteMsg(answerA(q))
+		return
+	}
+	out := new(dns.Msg)
+	out.SetReply(q)
+	out.Truncated = true
+	w.WriteMsg(out)
+}
+
+func TestUdpResolverTruncated(t *testing.T) {
+	addr := util.StartTestServer(t, truncatingHandler)
+	r := NewUdpResolver(addr)
+	q := util.CreateQuery("large.example.com.", "TXT")
+	out, err := r.Resolve(context.Background(), discardLog(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Truncated {
+		t.Error("expected TCP fallback to return a complete response")
+	}
+	util.CheckResponse(t, q, out, "1.2.3.4")
+}
+
+func TestUdpResolver0x20(t *testing.T) {
+	received := make(chan string, 1)
+	addr := util.StartTestServer(t, func(w dns.ResponseWriter, q *dns.Msg) {
+		received <- q.Question[0].Name
+		out := new(dns.Msg)
+		out.SetReply(q)
+		rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 1.2.3.4")
+		out.Answer = append(out.Answer, rr)
+		w.WriteMsg(out)
+	})
+	r, err := NewResolver(addr+"#0x20", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The qname is sent in mixed case and restored in the response
+	name := "abcdefghijklmnopqrstuvwxyz.example.com."
+	q := util.CreateQuery(name, "A")
+	out, err := r.Resolve(context.Background(), discardLog(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "1.2.3.4")
+	if sent := <-received; sent == name || !strings.EqualFold(sent, name) {
+		t.Errorf("qname not randomised: %s", sent)
+	}
+	if out.Question[0].Name != name || out.Answer[0].Header().Name != name {
+		t.Errorf("case not restored: %s", out)
+	}
+}
+
+func TestUdpResolverMismatch(t *testing.T) {
+	// Server answers with the qname in lower case and the wrong qtype for
+	// "wrong-type." queries
+	addr := util.StartTestServer(t, func(w dns.ResponseWriter, q *dns.Msg) {
+		out := new(dns.Msg)
+		out.SetReply(q)
+		out.Question[0].Name = strings.ToLower(q.Question[0].Name)
+		if out.Question[0].Name == "wrong-type." {
+			out.Question[0].Qtype = dns.TypeAAAA
+		}
+		w.WriteMsg(out)
+	})
+	for _, v := range []struct {
+		upstream string
+		qname    string
+		ok       bool
+	}{
+		{addr, "example.com.", true},
+		{addr, "EXAMPLE.com.", true},
+		{addr, "wrong-type.", false},
+		{addr + "#0x20", "abcdefghijklmnopqrstuvwxyz.example.com.", false},
+	} {
+		r, err := NewResolver(v.upstream, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Resolve(context.Background(), discardLog(), util.CreateQuery(v.qname, "A")); (err == nil) != v.ok {
+			t.Errorf("%s %s: unexpected result %v", v.upstream, v.qname, err)
+		}
+	}
+}
+
+// ── TCP Resolver ──────────────────────────────────────────────────────────────
+
+func TestTcpResolver(t *testing.T) {
+	addr := util.StartTestServer(t, truncatingHandler)
+	r := NewTcpResolver("tcp://" + addr)
+	q := util.CreateQuery("test.example.com.", "A")
+	out, err := r.Resolve(context.Background(), discardLog(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "1.2.3.4")
+	if r.String() != "tcp://"+addr {
+		t.Errorf("unexpected String(): %s", r)
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	for upstream, expected := range map[string]string{
+		"1.1.1.1":                              "*resolver.UdpResolver 1.1.1.1:53",
+		"1.1.1.1:5353":                         "*resolver.UdpResolver 1.1.1.1:5353",
+		"tcp://1.1.1.1":                        "*resolver.TcpResolver tcp://1.1.1.1:53",
+		"tls://1.1.1.1":                        "*resolver.DotResolver tls://1.1.1.1:853",
+		"quic://dns.adguard-dns.com":           "*resolver.DoqResolver quic://dns.adguard-dns.com:853",
+		"https://cloudflare-dns.com/dns-query": "*resolver.DohResolver https://cloudflare-dns.com/dns-query",
+	} {
+		r, err := NewResolver(upstream, nil)
+		if err != nil {
+			t.Errorf("%s: %s", upstream, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T %s", r, r); got != expected {
+			t.Errorf("%s: expected %s, got %s", upstream, expected, got)
+		}
+	}
+	if _, err := NewResolver("", nil); err == nil {
+		t.Error("expected error for empty upstream")
+	}
+	for upstream, mode := range map[string]DohMode{
+		"https://cloudflare-dns.com/dns-query":     DohPost,
+		"https://cloudflare-dns.com/dns-query#get": DohGet,
+		"https://dns.google/resolve#json":          DohJSON,
+	} {
+		r, err := NewResolver(upstream, nil)
+		if err != nil {
+			t.Errorf("%s: %s", upstream, err)
+			continue
+		}
+		if r.(*DohResolver).Mode != mode {
+			t.Errorf("%s: expected mode %s, got %s", upstream, mode, r.(*DohResolver).Mode)
+		}
+		if strings.Contains(r.String(), "#") {
+			t.Errorf("%s: options not stripped (%s)", upstream, r)
+		}
+	}
+	for _, upstream := range []string{
+		"https://dns.google/resolve#get&json",
+		"https://dns.google/resolve#xxx",
+		"1.1.1.1#get",
+		"tcp://1.1.1.1#0x20",
+	} {
+		if _, err := NewResolver(upstream, nil); err == nil {
+			t.Errorf("%s: expected error", upstream)
+		}
+	}
+}
+
 // ── DoT Resolver ──────────────────────────────────────────────────────────────
 
 func TestDotResolver(t *testing.T) {
 	r := NewDotResolver("tls://1.1.1.1:853")
 	q := util.CreateQuery("127.0.0.1.nip.io.", "A")
-	out, err := r.Resolve(discardLog(), q)
+	out, err := r.Resolve(context.Background(), discardLog(), q)
 	if err != nil {
 		t.Fatal(err)
 	}
 	util.CheckResponse(t, q, out, "127.0.0.1")
 }
 
+// pipelineServer is a DoT server that reads queries as they arrive and
+// answers each (with answerA) after the delay in its first label ("d50" =
+// 50 ms), so responses are returned out of order. If closeAfter is set the
+// first connection is closed on receiving that many queries, leaving the
+// earlier ones unanswered.
+type pipelineServer struct {
+	addr       string
+	certFile   string
+	closeAfter int
+	conns      atomic.Int32
+}
+
+func startPipelineServer(t *testing.T, closeAfter int) *pipelineServer {
+	t.Helper()
+	cert, _ := testCert(t)
+	certFile, _ := writeCertFiles(t, cert)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	s := &pipelineServer{addr: listener.Addr().String(), certFile: certFile, closeAfter: closeAfter}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, s.conns.Add(1) == 1)
+		}
+	}()
+	return s
+}
+
+func (s *pipelineServer) serve(conn net.Conn, first bool) {
+	defer conn.Close()
+	wmu := sync.Mutex{}
+	for n := 1; ; n++ {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		if first && n == s.closeAfter {
+			return
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(buf); err != nil {
+			return
+		}
+		go func() {
+			var delay int
+			fmt.Sscanf(q.Question[0].Name, "d%d.", &delay)
+			time.Sleep(time.Duration(delay) * time.Millisecond)
+			out, _ := answerA(q).Pack()
+			wmu.Lock()
+			defer wmu.Unlock()
+			conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(out))))
+			conn.Write(out)
+		}()
+	}
+}
+
+func TestDotResolverPipelining(t *testing.T) {
+	s := startPipelineServer(t, 0)
+	r, err := NewResolver("tls://"+s.addr+"#ca="+s.certFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := discardLog()
+
+	// Slow query first - the fast ones are answered (out of order) on the
+	// same connection without waiting for it
+	slow := make(chan error)
+	go func() {
+		q := util.CreateQuery("d300.example.com.", "A")
+		_, err := r.Resolve(context.Background(), log, q)
+		slow <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := util.CreateQuery(fmt.Sprintf("d%d.example.com.", 10*i), "A")
+			out, err := r.Resolve(context.Background(), log, q)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			util.CheckResponse(t, q, out, "1.2.3.4")
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("queries blocked behind slow query: %s", elapsed)
+	}
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+	if stats := r.(*DotResolver).PoolStats(); stats.Dials != 1 || s.conns.Load() != 1 {
+		t.Errorf("expected a single connection: %+v", stats)
+	}
+}
+
+func TestDotResolverDeadConn(t *testing.T) {
+	defer func(timeout time.Duration) { dotReadTimeout = timeout }(dotReadTimeout)
+	dotReadTimeout = 100 * time.Millisecond
+
+	s := startPipelineServer(t, 0)
+	r, err := NewResolver("tls://"+s.addr+"#ca="+s.certFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := discardLog()
+
+	// The server stops answering - the connection is retired once nothing
+	// has been received for dotReadTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.Resolve(ctx, log, util.CreateQuery("d5000.example.com.", "A")); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	q := util.CreateQuery("d0.example.com.", "A")
+	out, err := r.Resolve(context.Background(), log, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "1.2.3.4")
+	if stats := r.(*DotResolver).PoolStats(); stats.Dials != 2 || stats.Dead != 1 {
+		t.Errorf("expected query on a new connection: %+v", stats)
+	}
+}
+
+func TestDotConnBusy(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := newDotConn(client)
+	defer c.fail(errors.New("done"))
+
+	c.mu.Lock()
+	for i := 0; i < dotMaxQueries; i++ {
+		c.pending[uint16(i)] = &dotQuery{}
+	}
+	c.mu.Unlock()
+	if _, err := c.exchange(context.Background(), util.CreateQuery("example.com.", "A")); err == nil || err.Error() != "DoT connection busy" {
+		t.Errorf("expected busy error, got %v", err)
+	}
+}
+
+func TestDotResolverSlowDial(t *testing.T) {
+	// Server accepts connections but never completes the TLS handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	r, err := NewResolver("tls://"+l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := discardLog()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go r.Resolve(ctx, log, util.CreateQuery("example.com.", "A"))
+	time.Sleep(20 * time.Millisecond)
+
+	// A second query gives up at its own deadline rather than waiting for
+	// the first dial
+	start := time.Now()
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel2()
+	if _, err := r.Resolve(ctx2, log, util.CreateQuery("example.com.", "A")); err == nil {
+		t.Error("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("query blocked behind dial: %s", elapsed)
+	}
+	if stats := r.(*DotResolver).PoolStats(); stats.Dials != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestDotResolverServerClose(t *testing.T) {
+	// First connection is closed by the server with queries outstanding
+	s := startPipelineServer(t, 3)
+	r, err := NewResolver("tls://"+s.addr+"#ca="+s.certFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := discardLog()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := util.CreateQuery(fmt.Sprintf("d50.q%d.example.com.", i), "A")
+			out, err := r.Resolve(context.Background(), log, q)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			util.CheckResponse(t, q, out, "1.2.3.4")
+		}()
+	}
+	wg.Wait()
+	if stats := r.(*DotResolver).PoolStats(); stats.Dials != 2 || stats.Dead != 1 {
+		t.Errorf("expected queries retried on a new connection: %+v", stats)
+	}
+}
+
+func TestDotResolverCancel(t *testing.T) {
+	s := startPipelineServer(t, 0)
+	r, err := NewResolver("tls://"+s.addr+"#ca="+s.certFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := discardLog()
+
+	// An abandoned query does not affect the connection; its late response
+	// is discarded
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.Resolve(ctx, log, util.CreateQuery("d200.example.com.", "A")); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		q := util.CreateQuery("d100.example.com.", "A")
+		out, err := r.Resolve(context.Background(), log, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		util.CheckResponse(t, q, out, "1.2.3.4")
+	}
+	if stats := r.(*DotResolver).PoolStats(); stats.Dials != 1 || stats.Dead != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
 // ── DoH Resolver ──────────────────────────────────────────────────────────────
 
 func TestDohResolver(t *testing.T) {
 	r := NewDohResolver("https://cloudflare-dns.com/dns-query")
 	q := util.CreateQuery("127.0.0.1.nip.io.", "A")
-	out, err := r.Resolve(discardLog(), q)
+	out, err := r.Resolve(context.Background(), discardLog(), q)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -148,7 +632,7 @@ func TestDohResolverTimeout(t *testing.T) {
 
 	q := util.CreateQuery("example.com.", "A")
 	start := time.Now()
-	_, err := r.Resolve(discardLog(), q)
+	_, err := r.Resolve(context.Background(), discardLog(), q)
 	elapsed := time.Since(start)
 
 	if err == nil {
@@ -178,7 +662,7 @@ func TestDohResolverConnectionReuse(t *testing.T) {
 	const n = 5
 	for i := 0; i < n; i++ {
 		q := util.CreateQuery(fmt.Sprintf("test%d.example.com.", i), "A")
-		if _, err := r.Resolve(log, q); err != nil {
+		if _, err := r.Resolve(context.Background(), log, q); err != nil {
 			t.Fatalf("request %d failed: %v", i, err)
 		}
 	}
@@ -187,3 +671,307 @@ func TestDohResolverConnectionReuse(t *testing.T) {
 		t.Errorf("expected 1 TCP connection (keep-alive reuse) across %d requests, got %d", n, got)
 	}
 }
+
+func TestDohResolverGet(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "expected GET", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Query().Get("key") != "value" {
+			http.Error(w, "existing query parameters not preserved", http.StatusBadRequest)
+			return
+		}
+		b, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(b); err != nil || q.Id != 0 {
+			http.Error(w, "invalid query", http.StatusBadRequest)
+			return
+		}
+		b, _ = answerA(q).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	r := NewDohResolver(srv.URL + "/dns-query?key=value")
+	r.Mode = DohGet
+	q := util.CreateQuery("example.com.", "A")
+	out, err := r.Resolve(context.Background(), discardLog(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "1.2.3.4")
+}
+
+func TestDohResolverJSON(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/dns-json" {
+			http.Error(w, "unsupported accept type", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-json")
+		switch params := r.URL.Query(); params.Get("name") + " " + params.Get("type") {
+		case "www.example.com. 1":
+			io.WriteString(w, `{"Status":0,"TC":false,"RD":true,"RA":true,"AD":true,"CD":false,
+				"Question":[{"name":"www.example.com.","type":1}],
+				"Answer":[{"name":"www.example.com.","type":5,"TTL":300,"data":"example.com."},
+				          {"name":"example.com.","type":1,"TTL":60,"data":"127.0.0.1"}]}`)
+		case "missing.example.com. 28":
+			io.WriteString(w, `{"Status":3,"TC":false,"RD":true,"RA":true,"AD":false,"CD":false,
+				"Question":[{"name":"missing.example.com.","type":28}],
+				"Authority":[{"name":"example.com.","type":6,"TTL":900,
+				              "data":"ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 900"}]}`)
+		case "bad.example.com. 1":
+			io.WriteString(w, `{"Status":0,"Answer":[{"name":"bad.example.com.","type":1,"TTL":60,"data":"not-an-ip"}]}`)
+		default:
+			http.Error(w, "unexpected query", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	r := NewDohResolver(srv.URL + "/resolve")
+	r.Mode = DohJSON
+	log := discardLog()
+
+	q := util.CreateQuery("www.example.com.", "A")
+	out, err := r.Resolve(context.Background(), log, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Answer) != 2 || out.Answer[0].Header().Rrtype != dns.TypeCNAME || out.Answer[0].Header().Ttl != 300 {
+		t.Fatalf("unexpected answer: %v", out.Answer)
+	}
+	if a, ok := out.Answer[1].(*dns.A); !ok || a.A.String() != "127.0.0.1" {
+		t.Errorf("unexpected answer: %v", out.Answer[1])
+	}
+	if !out.Response || !out.RecursionAvailable || !out.AuthenticatedData {
+		t.Errorf("flags not translated: %s", out.MsgHdr.String())
+	}
+
+	q = util.CreateQuery("missing.example.com.", "AAAA")
+	out, err = r.Resolve(context.Background(), log, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Rcode != dns.RcodeNameError || len(out.Ns) != 1 || out.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("unexpected NXDOMAIN response: %s", out)
+	}
+
+	if _, err = r.Resolve(context.Background(), log, util.CreateQuery("bad.example.com.", "A")); err == nil {
+		t.Error("expected error for invalid record data")
+	}
+}
+
+// ── DoQ Resolver ──────────────────────────────────────────────────────────────
+
+// doqServer is a minimal in-process RFC 9250 stand-in. Each stream carries
+// one length-prefixed query which is answered by answerA. ids records the
+// message IDs seen on the wire; conns counts accepted connections.
+type doqServer struct {
+	listener *quic.Listener
+	pool     *x509.CertPool
+	conns    int32
+	ids      chan uint16
+}
+
+func startDoqServer(t *testing.T) *doqServer {
+	t.Helper()
+	cert, pool := testCert(t)
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"doq"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &doqServer{listener: listener, pool: pool, ids: make(chan uint16, 100)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			go s.serveConn(conn)
+		}
+	}()
+	return s
+}
+
+func (s *doqServer) serveConn(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			msg, err := io.ReadAll(stream)
+			if err != nil || len(msg) < 2 {
+				return
+			}
+			q := new(dns.Msg)
+			if err := q.Unpack(msg[2:]); err != nil {
+				return
+			}
+			select {
+			case s.ids <- q.Id:
+			default:
+			}
+			b, _ := answerA(q).Pack()
+			buf := make([]byte, 2+len(b))
+			binary.BigEndian.PutUint16(buf, uint16(len(b)))
+			copy(buf[2:], b)
+			stream.Write(buf)
+		}()
+	}
+}
+
+func (s *doqServer) resolver() *DoqResolver {
+	r := NewDoqResolver("quic://" + s.listener.Addr().String())
+	r.tlsConfig.RootCAs = s.pool
+	return r
+}
+
+func TestDoqResolver(t *testing.T) {
+	srv := startDoqServer(t)
+	r := srv.resolver()
+
+	q := util.CreateQuery("test.example.com.", "A")
+	out, err := r.Resolve(context.Background(), discardLog(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "1.2.3.4")
+	if out.Id != q.Id {
+		t.Errorf("response ID %d does not match query ID %d", out.Id, q.Id)
+	}
+	if id := <-srv.ids; id != 0 {
+		t.Errorf("expected message ID 0 on the wire (RFC 9250 §4.2.1), got %d", id)
+	}
+}
+
+func TestDoqResolverConnectionReuse(t *testing.T) {
+	srv := startDoqServer(t)
+	r := srv.resolver()
+	log := discardLog()
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		q := util.CreateQuery(fmt.Sprintf("test%d.example.com.", i), "A")
+		if _, err := r.Resolve(context.Background(), log, q); err != nil {
+			t.Fatalf("request %d failed: %v", i, err)
+		}
+	}
+
+	if got := atomic.LoadInt32(&srv.conns); got != 1 {
+		t.Errorf("expected 1 QUIC connection across %d requests, got %d", n, got)
+	}
+}
+
+func TestDoqResolverReconnect(t *testing.T) {
+	srv := startDoqServer(t)
+	r := srv.resolver()
+	log := discardLog()
+
+	if _, err := r.Resolve(context.Background(), log, util.CreateQuery("one.example.com.", "A")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close the shared connection as an idle timeout would
+	r.mu.Lock()
+	r.conn.CloseWithError(0, "")
+	r.mu.Unlock()
+
+	q := util.CreateQuery("two.example.com.", "A")
+	out, err := r.Resolve(context.Background(), log, q)
+	if err != nil {
+		t.Fatalf("expected reconnect after close, got: %v", err)
+	}
+	util.CheckResponse(t, q, out, "1.2.3.4")
+
+	if got := atomic.LoadInt32(&srv.conns); got != 2 {
+		t.Errorf("expected 2 QUIC connections (original + reconnect), got %d", got)
+	}
+}
+
+func TestDoqResolverTimeout(t *testing.T) {
+	// UDP socket that swallows packets — the QUIC handshake never completes.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const shortTimeout = 150 * time.Millisecond
+	r := NewDoqResolver("quic://" + conn.LocalAddr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	start := time.Now()
+	_, err = r.Resolve(ctx, discardLog(), util.CreateQuery("example.com.", "A"))
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("expected a timeout error, got nil")
+	}
+	if elapsed > 3*shortTimeout {
+		t.Errorf("resolver blocked for %v — timeout (%v) did not fire promptly", elapsed, shortTimeout)
+	}
+}
+
+func TestDoqResolverSlowDial(t *testing.T) {
+	// UDP socket that swallows packets — the QUIC handshake never completes.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := NewDoqResolver("quic://" + conn.LocalAddr().String())
+	log := discardLog()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go r.Resolve(ctx, log, util.CreateQuery("example.com.", "A"))
+	time.Sleep(20 * time.Millisecond)
+
+	// A second query gives up at its own deadline rather than waiting for
+	// the first dial
+	start := time.Now()
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel2()
+	if _, err := r.Resolve(ctx2, log, util.CreateQuery("example.com.", "A")); err == nil {
+		t.Error("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("query blocked behind dial: %s", elapsed)
+	}
+}
+
+func TestDoqResolverConcurrentDial(t *testing.T) {
+	srv := startDoqServer(t)
+	r := srv.resolver()
+	log := discardLog()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := util.CreateQuery(fmt.Sprintf("test%d.example.com.", i), "A")
+			if _, err := r.Resolve(context.Background(), log, q); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&srv.conns); got != 1 {
+		t.Errorf("expected concurrent queries to share 1 QUIC connection, got %d", got)
+	}
+}
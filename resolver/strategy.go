@@ -0,0 +1,278 @@
+package resolver
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulc/dinosaur-dns/logger"
+)
+
+// Strategy decides the order in which the resolvers of an upstream set are
+// tried, and learns from the outcome of each query. Implementations must be
+// safe for concurrent use.
+type Strategy interface {
+	// Order returns upstreams in the order they should be tried. The
+	// returned slice may be reordered but upstreams itself is not modified.
+	Order(upstreams []Resolver) []Resolver
+	// Fanout returns the number of upstreams queried concurrently on each
+	// attempt (1 = sequential).
+	Fanout() int
+	// Report records the outcome of a single query sent to r.
+	Report(log *logger.Logger, r Resolver, rtt time.Duration, err error)
+	String() string
+}
+
+// NewStrategy parses a strategy spec for an upstream set of n resolvers:
+//
+//	failover        try in configured order (default)
+//	race[:N]        query the first N upstreams concurrently (default 2), first answer wins
+//	round-robin     rotate the starting upstream on every query
+//	weighted:W,...  weighted random start (one weight per upstream)
+//	latency         prefer the upstream with the lowest EWMA latency
+func NewStrategy(spec string, n int) (Strategy, error) {
+	name, arg, hasArg := strings.Cut(spec, ":")
+	switch name {
+	case "", "failover":
+		if hasArg {
+			break
+		}
+		return NewFailoverStrategy(), nil
+	case "race":
+		fanout := 2
+		if hasArg {
+			v, err := strconv.Atoi(arg)
+			if err != nil || v < 1 {
+				return nil, fmt.Errorf("Invalid strategy (%s): race count must be a positive integer", spec)
+			}
+			fanout = v
+		}
+		return NewRaceStrategy(fanout), nil
+	case "round-robin":
+		if hasArg {
+			break
+		}
+		return NewRoundRobinStrategy(), nil
+	case "weighted":
+		if !hasArg {
+			return nil, fmt.Errorf("Invalid strategy (%s): weights required", spec)
+		}
+		weights := make([]int, 0, n)
+		for _, v := range strings.Split(arg, ",") {
+			w, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || w < 0 {
+				return nil, fmt.Errorf("Invalid strategy (%s): weights must be non-negative integers", spec)
+			}
+			weights = append(weights, w)
+		}
+		if len(weights) != n {
+			return nil, fmt.Errorf("Invalid strategy (%s): %d weights for %d upstreams", spec, len(weights), n)
+		}
+		return NewWeightedStrategy(weights), nil
+	case "latency":
+		if hasArg {
+			break
+		}
+		return NewLatencyStrategy(), nil
+	}
+	return nil, fmt.Errorf("Invalid strategy: %s", spec)
+}
+
+// rotate returns a copy of upstreams starting at index start.
+func rotate(upstreams []Resolver, start int) []Resolver {
+	out := make([]Resolver, 0, len(upstreams))
+	if len(upstreams) == 0 {
+		return out
+	}
+	start %= len(upstreams)
+	out = append(out, upstreams[start:]...)
+	return append(out, upstreams[:start]...)
+}
+
+// ── Failover ──────────────────────────────────────────────────────────────────
+
+// FailoverStrategy tries upstreams in the configured order. Failing upstreams
+// are skipped by the HealthChecker rather than reordered here, so the
+// configured order is restored as soon as an upstream recovers.
+type FailoverStrategy struct{}
+
+func NewFailoverStrategy() *FailoverStrategy {
+	return &FailoverStrategy{}
+}
+
+func (s *FailoverStrategy) Order(upstreams []Resolver) []Resolver {
+	return append(upstreams[:0:0], upstreams...)
+}
+
+func (s *FailoverStrategy) Fanout() int { return 1 }
+
+func (s *FailoverStrategy) Report(log *logger.Logger, r Resolver, rtt time.Duration, err error) {}
+
+func (s *FailoverStrategy) String() string { return "failover" }
+
+// ── Race ──────────────────────────────────────────────────────────────────────
+
+// RaceStrategy sends each query to the first N upstreams concurrently and
+// uses the first successful answer. If all N fail the next N are tried.
+type RaceStrategy struct {
+	fanout int
+}
+
+func NewRaceStrategy(fanout int) *RaceStrategy {
+	return &RaceStrategy{fanout: fanout}
+}
+
+func (s *RaceStrategy) Order(upstreams []Resolver) []Resolver {
+	return append(upstreams[:0:0], upstreams...)
+}
+
+func (s *RaceStrategy) Fanout() int { return s.fanout }
+
+func (s *RaceStrategy) Report(log *logger.Logger, r Resolver, rtt time.Duration, err error) {}
+
+func (s *RaceStrategy) String() string { return fmt.Sprintf("race:%d", s.fanout) }
+
+// ── Round-robin ───────────────────────────────────────────────────────────────
+
+// RoundRobinStrategy starts each query at the next upstream in turn, falling
+// through the rest of the list in order on error.
+type RoundRobinStrategy struct {
+	next atomic.Uint64
+}
+
+func NewRoundRobinStrategy() *RoundRobinStrategy {
+	return &RoundRobinStrategy{}
+}
+
+func (s *RoundRobinStrategy) Order(upstreams []Resolver) []Resolver {
+	if len(upstreams) == 0 {
+		return rotate(upstreams, 0)
+	}
+	return rotate(upstreams, int((s.next.Add(1)-1)%uint64(len(upstreams))))
+}
+
+func (s *RoundRobinStrategy) Fanout() int { return 1 }
+
+func (s *RoundRobinStrategy) Report(log *logger.Logger, r Resolver, rtt time.Duration, err error) {}
+
+func (s *RoundRobinStrategy) String() string { return "round-robin" }
+
+// ── Weighted ──────────────────────────────────────────────────────────────────
+
+// WeightedStrategy orders upstreams by weighted random sampling without
+// replacement, so an upstream with weight 3 is tried first three times as
+// often as one with weight 1. Zero-weight upstreams are only used as a last
+// resort. Weights are positional and match the configured upstream order.
+type WeightedStrategy struct {
+	weights []int
+}
+
+func NewWeightedStrategy(weights []int) *WeightedStrategy {
+	return &WeightedStrategy{weights: weights}
+}
+
+func (s *WeightedStrategy) Order(upstreams []Resolver) []Resolver {
+	type candidate struct {
+		r Resolver
+		w int
+	}
+	pending := make([]candidate, len(upstreams))
+	total := 0
+	for i, r := range upstreams {
+		w := 1
+		if i < len(s.weights) {
+			w = s.weights[i]
+		}
+		pending[i] = candidate{r, w}
+		total += w
+	}
+	out := make([]Resolver, 0, len(upstreams))
+	for total > 0 {
+		n := rand.Intn(total)
+		for i, c := range pending {
+			if n < c.w {
+				out = append(out, c.r)
+				total -= c.w
+				pending = append(pending[:i], pending[i+1:]...)
+				break
+			}
+			n -= c.w
+		}
+	}
+	// Remaining zero-weight upstreams in configured order
+	for _, c := range pending {
+		out = append(out, c.r)
+	}
+	return out
+}
+
+func (s *WeightedStrategy) Fanout() int { return 1 }
+
+func (s *WeightedStrategy) Report(log *logger.Logger, r Resolver, rtt time.Duration, err error) {}
+
+func (s *WeightedStrategy) String() string {
+	w := make([]string, len(s.weights))
+	for i, v := range s.weights {
+		w[i] = strconv.Itoa(v)
+	}
+	return "weighted:" + strings.Join(w, ",")
+}
+
+// ── Lowest latency ────────────────────────────────────────────────────────────
+
+// latencyAlpha is the EWMA smoothing factor: the weight given to the newest
+// sample.
+const latencyAlpha = 0.3
+
+// LatencyStrategy tracks an exponentially weighted moving average of each
+// upstream's response time and tries the fastest first. Errors count as a
+// sample of DefaultTimeout so a failing upstream drifts to the back.
+// Upstreams without a sample yet sort first so that they get measured.
+type LatencyStrategy struct {
+	sync.Mutex
+	ewma map[Resolver]float64
+}
+
+func NewLatencyStrategy() *LatencyStrategy {
+	return &LatencyStrategy{ewma: make(map[Resolver]float64)}
+}
+
+func (s *LatencyStrategy) Order(upstreams []Resolver) []Resolver {
+	out := append(upstreams[:0:0], upstreams...)
+	s.Lock()
+	defer s.Unlock()
+	sort.SliceStable(out, func(i, j int) bool {
+		return s.ewma[out[i]] < s.ewma[out[j]]
+	})
+	return out
+}
+
+func (s *LatencyStrategy) Fanout() int { return 1 }
+
+func (s *LatencyStrategy) Report(log *logger.Logger, r Resolver, rtt time.Duration, err error) {
+	if err != nil {
+		rtt = DefaultTimeout
+	}
+	sample := float64(rtt)
+	s.Lock()
+	defer s.Unlock()
+	if prev, ok := s.ewma[r]; ok {
+		s.ewma[r] = latencyAlpha*sample + (1-latencyAlpha)*prev
+	} else {
+		s.ewma[r] = sample
+	}
+}
+
+// Latency returns the current EWMA latency for r (0 if not yet measured).
+func (s *LatencyStrategy) Latency(r Resolver) time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return time.Duration(s.ewma[r])
+}
+
+func (s *LatencyStrategy) String() string { return "latency" }
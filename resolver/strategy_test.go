@@ -0,0 +1,125 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/logger"
+)
+
+// namedResolver is a no-op Resolver used to test ordering.
+type namedResolver struct{ name string }
+
+func (r *namedResolver) Resolve(context.Context, *logger.Logger, *dns.Msg) (*dns.Msg, error) {
+	return nil, nil
+}
+func (r *namedResolver) String() string { return r.name }
+
+func testUpstreams(names ...string) []Resolver {
+	out := make([]Resolver, len(names))
+	for i, v := range names {
+		out[i] = &namedResolver{v}
+	}
+	return out
+}
+
+func orderString(upstreams []Resolver) (s string) {
+	for _, r := range upstreams {
+		s += r.String()
+	}
+	return
+}
+
+func TestNewStrategy(t *testing.T) {
+	for spec, expected := range map[string]string{
+		"":               "failover",
+		"failover":       "failover",
+		"race":           "race:2",
+		"race:3":         "race:3",
+		"round-robin":    "round-robin",
+		"weighted:3,1,0": "weighted:3,1,0",
+		"latency":        "latency",
+	} {
+		s, err := NewStrategy(spec, 3)
+		if err != nil {
+			t.Errorf("%q: %s", spec, err)
+			continue
+		}
+		if s.String() != expected {
+			t.Errorf("%q: expected %s, got %s", spec, expected, s)
+		}
+	}
+	for _, spec := range []string{"random", "race:0", "race:x", "weighted", "weighted:1,2", "weighted:1,-1,1", "latency:5"} {
+		if _, err := NewStrategy(spec, 3); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
+
+func TestFailoverStrategy(t *testing.T) {
+	s := NewFailoverStrategy()
+	upstreams := testUpstreams("a", "b", "c")
+	s.Report(discardLog(), upstreams[0], 0, errors.New("fail"))
+	if got := orderString(s.Order(upstreams)); got != "abc" {
+		t.Fatalf("expected abc, got %s", got)
+	}
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	s := NewRoundRobinStrategy()
+	upstreams := testUpstreams("a", "b", "c")
+	for _, expected := range []string{"abc", "bca", "cab", "abc"} {
+		if got := orderString(s.Order(upstreams)); got != expected {
+			t.Errorf("expected %s, got %s", expected, got)
+		}
+	}
+}
+
+func TestWeightedStrategy(t *testing.T) {
+	s := NewWeightedStrategy([]int{3, 1, 0})
+	upstreams := testUpstreams("a", "b", "c")
+	first := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		order := orderString(s.Order(upstreams))
+		if len(order) != 3 || order[2] != 'c' {
+			t.Fatalf("zero-weight upstream should always be last: %s", order)
+		}
+		first[order[:1]]++
+	}
+	// Expect ~3000/1000 split
+	if first["a"] < 2700 || first["a"] > 3300 {
+		t.Errorf("unexpected weighted distribution: %v", first)
+	}
+}
+
+func TestLatencyStrategy(t *testing.T) {
+	s := NewLatencyStrategy()
+	log := discardLog()
+	upstreams := testUpstreams("a", "b", "c")
+
+	s.Report(log, upstreams[0], 50*time.Millisecond, nil)
+	s.Report(log, upstreams[1], 10*time.Millisecond, nil)
+	// c not yet measured - should be tried first
+	if got := orderString(s.Order(upstreams)); got != "cba" {
+		t.Fatalf("expected cba, got %s", got)
+	}
+
+	s.Report(log, upstreams[2], 0, errors.New("fail"))
+	if got := orderString(s.Order(upstreams)); got != "bac" {
+		t.Fatalf("expected bac, got %s", got)
+	}
+
+	// EWMA moves towards new samples
+	for i := 0; i < 20; i++ {
+		s.Report(log, upstreams[0], time.Millisecond, nil)
+	}
+	if got := orderString(s.Order(upstreams)); got != "abc" {
+		t.Fatalf("expected abc, got %s", got)
+	}
+	if l := s.Latency(upstreams[0]); l > 2*time.Millisecond {
+		t.Errorf("EWMA did not converge: %s", l)
+	}
+}
@@ -0,0 +1,89 @@
+package resolver
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// splitAuthName separates an optional 'name@' authentication-name prefix from
+// a host:port address (e.g. cloudflare-dns.com@1.1.1.1:853).
+func splitAuthName(address string) (name string, addr string) {
+	if name, addr, found := strings.Cut(address, "@"); found {
+		return name, addr
+	}
+	return "", address
+}
+
+// applyTLSOptions configures c from the TLS upstream options and returns the
+// options it did not consume:
+//
+//	ca=FILE          verify the server against the PEM CA bundle in FILE
+//	                 instead of the system roots
+//	pin=SPKI[,SPKI]  require a certificate in the chain whose SubjectPublicKeyInfo
+//	                 SHA-256 digest (base64) matches one of the pins (repeatable)
+//	cert=FILE        client certificate (PEM), requires key
+//	key=FILE         client private key (PEM), requires cert
+func applyTLSOptions(c *tls.Config, options url.Values) (url.Values, error) {
+	rest := url.Values{}
+	for k, v := range options {
+		rest[k] = v
+	}
+
+	if ca := rest.Get("ca"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Error reading CA file (%s): no certificates found", ca)
+		}
+		c.RootCAs = pool
+	}
+	delete(rest, "ca")
+
+	if cert, key := rest.Get("cert"), rest.Get("key"); cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, errors.New("Invalid TLS options: cert and key must be given together")
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate: %s", err)
+		}
+		c.Certificates = []tls.Certificate{pair}
+	}
+	delete(rest, "cert")
+	delete(rest, "key")
+
+	if values, ok := rest["pin"]; ok {
+		pins := make(map[string]bool)
+		for _, v := range values {
+			for _, pin := range strings.Split(v, ",") {
+				digest, err := base64.StdEncoding.DecodeString(pin)
+				if err != nil || len(digest) != sha256.Size {
+					return nil, fmt.Errorf("Invalid TLS pin (%s): expected base64 SHA-256 digest", pin)
+				}
+				pins[string(digest)] = true
+			}
+		}
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[string(digest[:])] {
+					return nil
+				}
+			}
+			return errors.New("TLS pin mismatch: no certificate matches the SPKI pin set")
+		}
+	}
+	delete(rest, "pin")
+
+	return rest, nil
+}
@@ -0,0 +1,184 @@
+package resolver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/util"
+)
+
+// startDotServer starts an in-process DoT server answering with answerA and
+// returns its address.
+func startDotServer(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{
+		Listener: listener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			w.WriteMsg(answerA(r))
+		}),
+	}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return listener.Addr().String()
+}
+
+// writeCertFiles writes cert and its key as PEM files and returns the paths.
+func writeCertFiles(t *testing.T, cert tls.Certificate) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// spkiPin returns the base64 SHA-256 SPKI pin for cert.
+func spkiPin(cert tls.Certificate) string {
+	digest := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+func TestSplitOptions(t *testing.T) {
+	upstream, options, err := splitOptions("tls://1.1.1.1#ca=/tmp/ca%20file.pem&pin=ab+c/d=&pin=xyz&get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upstream != "tls://1.1.1.1" {
+		t.Errorf("unexpected upstream: %s", upstream)
+	}
+	if options.Get("ca") != "/tmp/ca file.pem" || len(options["pin"]) != 2 || options["pin"][0] != "ab+c/d=" || !options.Has("get") {
+		t.Errorf("unexpected options: %v", options)
+	}
+}
+
+func TestDotResolverTLSOptions(t *testing.T) {
+	cert, _ := testCert(t)
+	other, _ := testCert(t)
+	certFile, _ := writeCertFiles(t, cert)
+	otherFile, _ := writeCertFiles(t, other)
+	addr := startDotServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	log := discardLog()
+	for upstream, ok := range map[string]bool{
+		"tls://" + addr:                                                                      false, // not in system roots
+		"tls://" + addr + "#ca=" + certFile:                                                  true,
+		"tls://" + addr + "#ca=" + otherFile:                                                 false,
+		"tls://localhost@" + addr + "#ca=" + certFile:                                        true,
+		"tls://wrong.test@" + addr + "#ca=" + certFile:                                       false, // name not in certificate
+		"tls://" + addr + "#ca=" + certFile + "&pin=" + spkiPin(cert):                        true,
+		"tls://" + addr + "#ca=" + certFile + "&pin=" + spkiPin(other) + "," + spkiPin(cert): true,
+		"tls://" + addr + "#ca=" + certFile + "&pin=" + spkiPin(other):                       false,
+	} {
+		r, err := NewResolver(upstream, nil)
+		if err != nil {
+			t.Errorf("%s: %s", upstream, err)
+			continue
+		}
+		q := util.CreateQuery("example.com.", "A")
+		out, err := r.Resolve(context.Background(), log, q)
+		if ok && err != nil {
+			t.Errorf("%s: %s", upstream, err)
+		} else if ok {
+			util.CheckResponse(t, q, out, "1.2.3.4")
+		} else if err == nil {
+			t.Errorf("%s: expected TLS verification error", upstream)
+		}
+	}
+}
+
+func TestDotResolverClientCert(t *testing.T) {
+	cert, pool := testCert(t)
+	certFile, keyFile := writeCertFiles(t, cert)
+	addr := startDotServer(t, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+
+	log := discardLog()
+	r, err := NewResolver("tls://"+addr+"#ca="+certFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Resolve(context.Background(), log, util.CreateQuery("example.com.", "A")); err == nil {
+		t.Error("expected error without client certificate")
+	}
+
+	r, err = NewResolver("tls://"+addr+"#ca="+certFile+"&cert="+certFile+"&key="+keyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := util.CreateQuery("example.com.", "A")
+	out, err := r.Resolve(context.Background(), log, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "1.2.3.4")
+}
+
+func TestDohResolverTLSOptions(t *testing.T) {
+	cert, _ := testCert(t)
+	certFile, _ := writeCertFiles(t, cert)
+	srv := httptest.NewUnstartedServer(dohEchoHandler(t))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	r, err := NewResolver(srv.URL+"/dns-query#get&ca="+certFile+"&pin="+spkiPin(cert), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.(*DohResolver).Mode != DohGet {
+		t.Error("DoH option not applied alongside TLS options")
+	}
+	r.(*DohResolver).Mode = DohPost // dohEchoHandler only handles POST
+	q := util.CreateQuery("example.com.", "A")
+	out, err := r.Resolve(context.Background(), discardLog(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util.CheckResponse(t, q, out, "1.2.3.4")
+}
+
+func TestTLSOptionsInvalid(t *testing.T) {
+	cert, _ := testCert(t)
+	certFile, keyFile := writeCertFiles(t, cert)
+	for _, upstream := range []string{
+		"tls://127.0.0.1#ca=/nonexistent.pem",
+		"tls://127.0.0.1#ca=" + keyFile, // no certificates
+		"tls://127.0.0.1#cert=" + certFile,
+		"tls://127.0.0.1#pin=notbase64!",
+		"tls://127.0.0.1#pin=" + base64.StdEncoding.EncodeToString([]byte("short")),
+		"quic://127.0.0.1#xxx",
+		"tcp://127.0.0.1#ca=" + certFile,
+	} {
+		if _, err := NewResolver(upstream, nil); err == nil {
+			t.Errorf("%s: expected error", upstream)
+		}
+	}
+	if _, err := NewResolver("quic://localhost@127.0.0.1#ca="+certFile, nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io/fs"
 	"strings"
 	"time"
 
@@ -19,11 +21,27 @@ func StartServer(ctx context.Context, proxy_config *config.ProxyConfig, ready ch
 	// We have now setup Logger so use this
 	log := proxy_config.Log
 
-	json_config, _ := json.MarshalIndent(proxy_config.UserConfig, "", "  ")
-	log.Debugf("%s\n", string(json_config))
+	if proxy_config.UserConfig != nil {
+		json_config, _ := json.MarshalIndent(proxy_config.UserConfig.Redacted(), "", "  ")
+		log.Debugf("%s\n", string(json_config))
+	}
+
+	// Reload saved cache before the listeners start so that the first queries
+	// are answered from it (a missing or corrupt file just means a cold cache)
+	if proxy_config.CacheFile != "" {
+		if n, err := proxy_config.Cache.LoadFile(proxy_config.CacheFile); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Warning: ignoring cache file %s: %s", proxy_config.CacheFile, err)
+			}
+		} else {
+			log.Printf("Cache: loaded %d entries from %s", n, proxy_config.CacheFile)
+		}
+	}
 
-	// Register handler before starting listeners so no query can arrive with an empty mux
-	dns.HandleFunc(".", proxy.MakeHandler(proxy_config))
+	// Register handler before starting listeners so no query can arrive with
+	// an empty mux. In-flight upstream queries are cancelled on shutdown.
+	handler := proxy.MakeContextHandler(proxy_config)
+	dns.HandleFunc(".", func(w dns.ResponseWriter, q *dns.Msg) { handler(ctx, w, q) })
 
 	// Start listeners
 	for _, listenAddr := range proxy_config.ListenAddr {
@@ -95,6 +113,26 @@ func StartServer(ctx context.Context, proxy_config *config.ProxyConfig, ready ch
 		}
 	}()
 
+	// Start cache save goroutine if enabled
+	if proxy_config.CacheFile != "" && proxy_config.CacheSaveInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(proxy_config.CacheSaveInterval)
+				saveCache(proxy_config)
+			}
+		}()
+	}
+
+	// Start upstream health check goroutine if enabled
+	if proxy_config.HealthInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(proxy_config.HealthInterval)
+				proxy_config.Health.Probe(ctx, log, proxy_config.AllUpstreams())
+			}
+		}()
+	}
+
 	// Start blocklist update goroutine if enabled
 	if proxy_config.Refresh {
 		go func() {
@@ -130,6 +168,13 @@ func StartServer(ctx context.Context, proxy_config *config.ProxyConfig, ready ch
 
 	log.Printf("Started server: %s", strings.Join(proxy_config.ListenAddr, " "))
 	log.Printf("Upstream: %s", strings.Join(upstream, " "))
+	for _, zone := range proxy_config.Forward {
+		forward := make([]string, len(zone.Upstream))
+		for i, v := range zone.Upstream {
+			forward[i] = v.String()
+		}
+		log.Printf("Forward: %s -> %s", zone.Domain, strings.Join(forward, " "))
+	}
 	log.Printf("Blocklist: %d entries", proxy_config.BlockList.Count())
 	log.Printf("ACL: %s", strings.Join(AclToString(proxy_config.Acl), " "))
 
@@ -141,7 +186,20 @@ func StartServer(ctx context.Context, proxy_config *config.ProxyConfig, ready ch
 	select {
 	case <-ctx.Done():
 		log.Print("Shutting down")
+		if proxy_config.CacheFile != "" {
+			saveCache(proxy_config)
+		}
 		return
 	}
 
 }
+
+// saveCache writes the cache to proxy_config.CacheFile.
+func saveCache(proxy_config *config.ProxyConfig) {
+	log := proxy_config.Log
+	if n, err := proxy_config.Cache.SaveFile(proxy_config.CacheFile); err != nil {
+		log.Printf("Error saving cache file %s: %s", proxy_config.CacheFile, err)
+	} else {
+		log.Printf("Cache: saved %d entries to %s", n, proxy_config.CacheFile)
+	}
+}
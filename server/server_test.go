@@ -3,10 +3,12 @@ package server
 import (
 	"context"
 	"fmt"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/paulc/dinosaur-dns/cache"
 	"github.com/paulc/dinosaur-dns/config"
 	"github.com/paulc/dinosaur-dns/logger"
 	"github.com/paulc/dinosaur-dns/resolver"
@@ -181,3 +183,46 @@ func TestCacheFlush(t *testing.T) {
 		cancelCtx()
 	}
 }
+
+func TestCacheFile(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "cache")
+
+	// Saved cache
+	saved := cache.New()
+	msg := &dns.Msg{}
+	msg.SetQuestion("saved.example.com.", dns.TypeA)
+	rr, _ := dns.NewRR("saved.example.com. 300 IN A 1.2.3.4")
+	msg.Answer = append(msg.Answer, rr)
+	saved.Add(msg)
+	if _, err := saved.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy_config := config.NewProxyConfig()
+	proxy_config.CacheFile = path
+	proxy_config.Log = logger.New(logger.NewDiscard(false))
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	ready := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		StartServer(ctx, proxy_config, ready)
+		close(done)
+	}()
+	<-ready
+
+	// Reloaded at startup
+	if _, found := proxy_config.Cache.GetName("saved.example.com.", "A"); !found {
+		t.Fatal("Cache entry not loaded")
+	}
+
+	// Saved on shutdown
+	proxy_config.Cache.DeleteName("saved.example.com.", "A", false)
+	cancelCtx()
+	<-done
+	reloaded := cache.New()
+	if n, err := reloaded.LoadFile(path); err != nil || n != 0 {
+		t.Errorf("Cache not saved on shutdown: %d %v", n, err)
+	}
+}
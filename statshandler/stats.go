@@ -16,6 +16,7 @@ type ConnectionLog struct {
 	Blocked   bool
 	Cached    bool
 	Error     bool
+	Upstream  string // upstream that answered (empty if cached/blocked)
 }
 
 func (c ConnectionLog) MarshalJSON() ([]byte, error) {
@@ -30,6 +31,7 @@ func (c ConnectionLog) MarshalJSON() ([]byte, error) {
 		Blocked   bool    `json:"blocked"`
 		Cached    bool    `json:"cached"`
 		Error     bool    `json:"error"`
+		Upstream  string  `json:"upstream"`
 	}{
 		c.Timestamp.Format(time.RFC3339),
 		c.Client,
@@ -41,6 +43,7 @@ func (c ConnectionLog) MarshalJSON() ([]byte, error) {
 		c.Blocked,
 		c.Cached,
 		c.Error,
+		c.Upstream,
 	})
 }
 
@@ -8,6 +8,45 @@ import (
 	"github.com/miekg/dns"
 )
 
+// StartTestServer starts an in-process DNS server on 127.0.0.1 serving both
+// UDP and TCP on the same (random) port and returns its address. The servers
+// are shut down when the test completes.
+func StartTestServer(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+	for attempt := 0; attempt < 10; attempt++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// TCP port may already be in use - retry with a new UDP port
+		l, err := net.Listen("tcp", pc.LocalAddr().String())
+		if err != nil {
+			pc.Close()
+			continue
+		}
+		udpStarted, tcpStarted := make(chan struct{}), make(chan struct{})
+		udp := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(udpStarted) }}
+		tcp := &dns.Server{Listener: l, Handler: handler, NotifyStartedFunc: func() { close(tcpStarted) }}
+		go udp.ActivateAndServe()
+		go tcp.ActivateAndServe()
+		<-udpStarted
+		<-tcpStarted
+		t.Cleanup(func() {
+			udp.Shutdown()
+			tcp.Shutdown()
+		})
+		return pc.LocalAddr().String()
+	}
+	t.Fatal("Unable to bind test server")
+	return ""
+}
+
+// IsTCP reports whether the query arrived over TCP.
+func IsTCP(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.TCPAddr)
+	return ok
+}
+
 // Testing helpers
 
 func CreateQuery(qname string, qtype string) *dns.Msg {